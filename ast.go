@@ -0,0 +1,370 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/parser"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	celmodel "k8s.io/apiextensions-apiserver/third_party/forked/celopenapi/model"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// parseEnv parses rules without expanding macros, so calls such as
+// self.all(x, ...) stay recognizable as calls in the resulting AST.
+var parseEnv = mustNewParseEnv()
+
+func mustNewParseEnv() *cel.Env {
+	env, err := cel.NewEnv(cel.ClearMacros())
+	if err != nil {
+		panic(err)
+	}
+	return env
+}
+
+// parseRule parses rule into an unchecked AST with macros left unexpanded.
+func parseRule(rule string) (*cel.Ast, error) {
+	ast, issues := parseEnv.Parse(rule)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	return ast, nil
+}
+
+// prefixParser parses rules like parseEnv, keeping the expression it recovers
+// from rules with syntax errors.
+var prefixParser = mustNewPrefixParser()
+
+func mustNewPrefixParser() *parser.Parser {
+	p, err := parser.NewParser()
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// parsedPrefix is a rule parsed as far as possible.
+type parsedPrefix struct {
+	// Expr is the parsed rule, or the expression preceding its first syntax
+	// error, with macros left unexpanded. It is nil if nothing precedes it.
+	Expr *expr.Expr
+	// Positions are the offsets of the expressions of Expr in the rule, in
+	// code points, by expression ID.
+	Positions map[int64]int32
+	// ErrorOffsets are the offsets of the syntax errors in the rule, in code
+	// points.
+	ErrorOffsets []int32
+	// Source is the rule, by code point.
+	Source []rune
+}
+
+// parseRulePrefix parses rule like parseRule, but also parses rules with
+// syntax errors, up to the first error. Rules selecting fields that must be
+// escaped, such as self.max-size or self.8080, often parse only partially.
+func parseRulePrefix(rule string) *parsedPrefix {
+	source := common.NewTextSource(rule)
+	parsed, errs := prefixParser.Parse(source)
+	prefix := &parsedPrefix{
+		Expr:      parsed.GetExpr(),
+		Positions: parsed.GetSourceInfo().GetPositions(),
+		Source:    []rune(rule),
+	}
+	for _, e := range errs.GetErrors() {
+		if offset, ok := source.LocationOffset(e.Location); ok {
+			prefix.ErrorOffsets = append(prefix.ErrorOffsets, offset)
+		}
+	}
+	return prefix
+}
+
+// exprPosition returns the position of e in the source of ast, or nil if it
+// is unknown.
+func exprPosition(ast *cel.Ast, e *expr.Expr) *Position {
+	offset, ok := ast.SourceInfo().GetPositions()[e.GetId()]
+	if !ok {
+		return nil
+	}
+	location, ok := ast.Source().OffsetLocation(offset)
+	if !ok {
+		return nil
+	}
+	return &Position{Line: location.Line(), Column: location.Column() + 1}
+}
+
+// visitExpr calls visit for e and every expression beneath it, parents before
+// children. If visit returns false, the children of that expression are
+// skipped. Unlike schemas, expressions can be visited recursively: the CEL
+// parser rejects expressions nested more than 200 levels deep.
+func visitExpr(e *expr.Expr, visit func(e *expr.Expr) bool) {
+	if e == nil || !visit(e) {
+		return
+	}
+	switch k := e.ExprKind.(type) {
+	case *expr.Expr_SelectExpr:
+		visitExpr(k.SelectExpr.Operand, visit)
+	case *expr.Expr_CallExpr:
+		visitExpr(k.CallExpr.Target, visit)
+		for _, arg := range k.CallExpr.Args {
+			visitExpr(arg, visit)
+		}
+	case *expr.Expr_ListExpr:
+		for _, elem := range k.ListExpr.Elements {
+			visitExpr(elem, visit)
+		}
+	case *expr.Expr_StructExpr:
+		for _, entry := range k.StructExpr.Entries {
+			if mapKey, ok := entry.KeyKind.(*expr.Expr_CreateStruct_Entry_MapKey); ok {
+				visitExpr(mapKey.MapKey, visit)
+			}
+			visitExpr(entry.Value, visit)
+		}
+	case *expr.Expr_ComprehensionExpr:
+		visitExpr(k.ComprehensionExpr.IterRange, visit)
+		visitExpr(k.ComprehensionExpr.AccuInit, visit)
+		visitExpr(k.ComprehensionExpr.LoopCondition, visit)
+		visitExpr(k.ComprehensionExpr.LoopStep, visit)
+		visitExpr(k.ComprehensionExpr.Result, visit)
+	}
+}
+
+// selectPath returns the field names selected from the identifier root by e,
+// e.g. ["spec", "replicas"] for self.spec.replicas when root is "self". The
+// second return value is false if e is not a chain of field selections
+// starting at root.
+func selectPath(e *expr.Expr, root string) ([]string, bool) {
+	var path []string
+	for {
+		switch k := e.ExprKind.(type) {
+		case *expr.Expr_IdentExpr:
+			if k.IdentExpr.Name != root {
+				return nil, false
+			}
+			// reverse, since fields were collected from the outermost selection inward
+			for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+				path[i], path[j] = path[j], path[i]
+			}
+			return path, true
+		case *expr.Expr_SelectExpr:
+			path = append(path, k.SelectExpr.Field)
+			e = k.SelectExpr.Operand
+		default:
+			return nil, false
+		}
+	}
+}
+
+// isIdent returns true if e is a reference to the identifier name.
+func isIdent(e *expr.Expr, name string) bool {
+	ident, ok := e.ExprKind.(*expr.Expr_IdentExpr)
+	return ok && ident.IdentExpr.Name == name
+}
+
+// callExpr returns e as a call if it is one.
+func callExpr(e *expr.Expr) (*expr.Expr_Call, bool) {
+	call, ok := e.ExprKind.(*expr.Expr_CallExpr)
+	if !ok {
+		return nil, false
+	}
+	return call.CallExpr, true
+}
+
+// constNumber returns the numeric value of e if it is an int, uint or double
+// literal, including negated literals.
+func constNumber(e *expr.Expr) (float64, bool) {
+	if call, ok := callExpr(e); ok && call.Function == operators.Negate && len(call.Args) == 1 {
+		value, ok := constNumber(call.Args[0])
+		return -value, ok
+	}
+	constant, ok := e.ExprKind.(*expr.Expr_ConstExpr)
+	if !ok {
+		return 0, false
+	}
+	switch k := constant.ConstExpr.ConstantKind.(type) {
+	case *expr.Constant_Int64Value:
+		return float64(k.Int64Value), true
+	case *expr.Constant_Uint64Value:
+		return float64(k.Uint64Value), true
+	case *expr.Constant_DoubleValue:
+		return k.DoubleValue, true
+	}
+	return 0, false
+}
+
+// constString returns the value of e if it is a string literal.
+func constString(e *expr.Expr) (string, bool) {
+	constant, ok := e.ExprKind.(*expr.Expr_ConstExpr)
+	if !ok {
+		return "", false
+	}
+	str, ok := constant.ConstExpr.ConstantKind.(*expr.Constant_StringValue)
+	if !ok {
+		return "", false
+	}
+	return str.StringValue, true
+}
+
+// isSizeOf returns true if e is size(root) or root.size().
+func isSizeOf(e *expr.Expr, root string) bool {
+	call, ok := callExpr(e)
+	if !ok || call.Function != "size" {
+		return false
+	}
+	if call.Target != nil {
+		return len(call.Args) == 0 && isIdent(call.Target, root)
+	}
+	return len(call.Args) == 1 && isIdent(call.Args[0], root)
+}
+
+// schemaRef is the schema node an expression refers to. If the expression
+// selects fields that the schema does not declare, the node is the deepest
+// declared node along the way and the remaining field names are in Rest.
+type schemaRef struct {
+	Schema *structuralschema.Structural
+	Path   *field.Path
+	Rest   []string
+}
+
+// comprehensionMacros lists the macros that bind their first argument to the
+// elements (or keys) of their target.
+var comprehensionMacros = map[string]bool{
+	operators.All:       true,
+	operators.Exists:    true,
+	operators.ExistsOne: true,
+	operators.Map:       true,
+	operators.Filter:    true,
+}
+
+// visitSchemaRefs calls visit for every field selection and index expression
+// in e that can be traced back to an identifier in scope, along with the
+// schema node it refers to. Variables bound by comprehension macros over
+// lists are added to the scope of the macro body. Both an expression and its
+// operands are visited, so visit is called for self.a and self.a.b alike.
+func visitSchemaRefs(e *expr.Expr, scope map[string]schemaRef, visit func(e *expr.Expr, ref schemaRef)) {
+	if e == nil {
+		return
+	}
+	switch k := e.ExprKind.(type) {
+	case *expr.Expr_SelectExpr, *expr.Expr_IdentExpr:
+		if ref, ok := resolveSchemaRef(e, scope); ok {
+			visit(e, ref)
+		}
+		if sel, ok := k.(*expr.Expr_SelectExpr); ok {
+			visitSchemaRefs(sel.SelectExpr.Operand, scope, visit)
+		}
+		return
+	case *expr.Expr_CallExpr:
+		call := k.CallExpr
+		if call.Function == operators.Index {
+			if ref, ok := resolveSchemaRef(e, scope); ok {
+				visit(e, ref)
+			}
+		}
+		if comprehensionMacros[call.Function] && call.Target != nil && len(call.Args) >= 2 {
+			visitSchemaRefs(call.Target, scope, visit)
+			bodyScope := macroScope(call, scope)
+			for _, arg := range call.Args[1:] {
+				visitSchemaRefs(arg, bodyScope, visit)
+			}
+			return
+		}
+		visitSchemaRefs(call.Target, scope, visit)
+		for _, arg := range call.Args {
+			visitSchemaRefs(arg, scope, visit)
+		}
+		return
+	}
+	visitExpr(e, func(child *expr.Expr) bool {
+		if child == e {
+			return true
+		}
+		visitSchemaRefs(child, scope, visit)
+		return false
+	})
+}
+
+// macroScope returns the scope of the body of the comprehension macro call.
+// If the macro iterates over a list in scope, its iteration variable refers
+// to the items of that list.
+func macroScope(call *expr.Expr_Call, scope map[string]schemaRef) map[string]schemaRef {
+	iterVar, ok := call.Args[0].ExprKind.(*expr.Expr_IdentExpr)
+	if !ok {
+		return scope
+	}
+	bodyScope := make(map[string]schemaRef, len(scope)+1)
+	for name, ref := range scope {
+		bodyScope[name] = ref
+	}
+	// the iteration variable shadows any outer variable of the same name
+	delete(bodyScope, iterVar.IdentExpr.Name)
+	if target, ok := resolveSchemaRef(call.Target, scope); ok && len(target.Rest) == 0 && target.Schema.Type == "array" && target.Schema.Items != nil {
+		bodyScope[iterVar.IdentExpr.Name] = schemaRef{Schema: target.Schema.Items, Path: target.Path.Child("items")}
+	}
+	return bodyScope
+}
+
+// resolveSchemaRef returns the schema node e refers to, if e is an
+// identifier in scope followed by field selections and index operations.
+func resolveSchemaRef(e *expr.Expr, scope map[string]schemaRef) (schemaRef, bool) {
+	switch k := e.ExprKind.(type) {
+	case *expr.Expr_IdentExpr:
+		ref, ok := scope[k.IdentExpr.Name]
+		return ref, ok
+	case *expr.Expr_SelectExpr:
+		ref, ok := resolveSchemaRef(k.SelectExpr.Operand, scope)
+		if !ok {
+			return ref, false
+		}
+		return selectField(ref, k.SelectExpr.Field), true
+	case *expr.Expr_CallExpr:
+		if k.CallExpr.Function != operators.Index || len(k.CallExpr.Args) != 2 {
+			return schemaRef{}, false
+		}
+		ref, ok := resolveSchemaRef(k.CallExpr.Args[0], scope)
+		if !ok {
+			return ref, false
+		}
+		if len(ref.Rest) > 0 {
+			ref.Rest = append(append([]string{}, ref.Rest...), "[]")
+			return ref, true
+		}
+		if ref.Schema.Type == "array" && ref.Schema.Items != nil {
+			return schemaRef{Schema: ref.Schema.Items, Path: ref.Path.Child("items")}, true
+		}
+		if ref.Schema.AdditionalProperties != nil && ref.Schema.AdditionalProperties.Structural != nil {
+			return schemaRef{Schema: ref.Schema.AdditionalProperties.Structural, Path: ref.Path.Child("additionalProperties")}, true
+		}
+		ref.Rest = []string{"[]"}
+		return ref, true
+	}
+	return schemaRef{}, false
+}
+
+// selectField returns the schema node for the (escaped) field name selected
+// from ref.
+func selectField(ref schemaRef, name string) schemaRef {
+	if len(ref.Rest) == 0 {
+		if propName, ok := celmodel.Unescape(name); ok {
+			if prop, ok := ref.Schema.Properties[propName]; ok {
+				return schemaRef{Schema: &prop, Path: ref.Path.Child("properties").Key(propName)}
+			}
+		}
+		if ref.Schema.AdditionalProperties != nil && ref.Schema.AdditionalProperties.Structural != nil {
+			return schemaRef{Schema: ref.Schema.AdditionalProperties.Structural, Path: ref.Path.Child("additionalProperties")}
+		}
+	}
+	return schemaRef{Schema: ref.Schema, Path: ref.Path, Rest: append(append([]string{}, ref.Rest...), name)}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// BundleManifest is a CRD manifest read from an OLM bundle.
+type BundleManifest struct {
+	// Path is the path of the file holding the manifest.
+	Path string
+	Data []byte
+}
+
+// bundleManifestsDir is the directory of an OLM bundle holding its
+// ClusterServiceVersion and CRDs.
+const bundleManifestsDir = "manifests"
+
+// BundleCRDs returns the CRD manifests of the OLM bundle in dir, v1 or
+// v1beta1, in file name order. Other manifests, such as the
+// ClusterServiceVersion, are skipped. An error is returned if dir is not an
+// OLM bundle.
+func BundleCRDs(dir string) ([]BundleManifest, error) {
+	kinds, err := bundleKinds(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not an OLM bundle: %w", dir, err)
+	}
+	var manifests []BundleManifest
+	hasCSV := false
+	for _, kind := range kinds {
+		switch kind.Kind {
+		case "ClusterServiceVersion":
+			hasCSV = true
+		case "CustomResourceDefinition":
+			manifests = append(manifests, BundleManifest{Path: kind.path, Data: kind.data})
+		}
+	}
+	if !hasCSV {
+		return nil, fmt.Errorf("%s is not an OLM bundle: %s holds no ClusterServiceVersion", dir, filepath.Join(dir, bundleManifestsDir))
+	}
+	return manifests, nil
+}
+
+// bundleFile is a manifest of an OLM bundle, along with its kind.
+type bundleFile struct {
+	metav1.TypeMeta
+	path string
+	data []byte
+}
+
+// bundleKinds reads the YAML and JSON manifests in the manifests directory of
+// dir, in file name order, as ioutil.ReadDir sorts them. Files that are not
+// manifests are skipped.
+func bundleKinds(dir string) ([]bundleFile, error) {
+	manifestsDir := filepath.Join(dir, bundleManifestsDir)
+	entries, err := ioutil.ReadDir(manifestsDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []bundleFile
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml" && ext != ".json") {
+			continue
+		}
+		path := filepath.Join(manifestsDir, entry.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		file := bundleFile{path: path, data: data}
+		if err := yaml.Unmarshal(data, &file.TypeMeta); err != nil {
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
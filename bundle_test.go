@@ -0,0 +1,101 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const clusterServiceVersion = `
+apiVersion: operators.coreos.com/v1alpha1
+kind: ClusterServiceVersion
+metadata:
+  name: widget-operator.v0.1.0
+spec:
+  customresourcedefinitions:
+    owned:
+    - name: widgets.example.com
+      kind: Widget
+      version: v1
+`
+
+func TestBundleCRDs(t *testing.T) {
+	tests := []struct {
+		name          string
+		files         map[string]string
+		expectedFiles []string
+		expectError   bool
+	}{
+		{
+			name: "bundle",
+			files: map[string]string{
+				"widget-operator.clusterserviceversion.yaml": clusterServiceVersion,
+				"widgets.crd.yaml":                           linterCRD,
+				"legacy.crd.yaml":                            v1beta1CRD,
+				"service.yaml":                               "apiVersion: v1\nkind: Service\n",
+				"README.md":                                  "not a manifest",
+			},
+			expectedFiles: []string{"legacy.crd.yaml", "widgets.crd.yaml"},
+		},
+		{
+			name: "no ClusterServiceVersion",
+			files: map[string]string{
+				"widgets.crd.yaml": linterCRD,
+			},
+			expectError: true,
+		},
+		{
+			name:        "no manifests directory",
+			expectError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.files != nil {
+				manifestsDir := filepath.Join(dir, "manifests")
+				if err := os.Mkdir(manifestsDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				for name, content := range tt.files {
+					if err := ioutil.WriteFile(filepath.Join(manifestsDir, name), []byte(content), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			manifests, err := BundleCRDs(dir)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if len(manifests) != len(tt.expectedFiles) {
+				t.Fatalf("Wrong manifests (got %v, expected %v)", manifests, tt.expectedFiles)
+			}
+			for i, manifest := range manifests {
+				expectedPath := filepath.Join(dir, "manifests", tt.expectedFiles[i])
+				if manifest.Path != expectedPath || string(manifest.Data) != tt.files[tt.expectedFiles[i]] {
+					t.Errorf("Wrong manifest (expected %s, got %s)", expectedPath, manifest.Path)
+				}
+			}
+		})
+	}
+}
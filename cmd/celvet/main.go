@@ -14,17 +14,13 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 
 	"github.com/DangerOnTheRanger/celvet"
-	api "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
-	apiinstall "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/install"
-	apiv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
-	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
-	"k8s.io/apimachinery/pkg/runtime"
-	runtimeserializer "k8s.io/apimachinery/pkg/runtime/serializer"
+	"sigs.k8s.io/yaml"
 
 	flag "github.com/spf13/pflag"
 )
@@ -32,72 +28,227 @@ import (
 func main() {
 
 	humanReadable := flag.BoolP("human-readable", "r", true, "print out values in human-readable formats")
+	kubeVersion := flag.String("kube-version", celvet.DefaultKubeVersion.String(), "Kubernetes release(s) the CRD must work on, e.g. 1.25 or >=1.25,<1.28")
+	crdFiles := flag.StringSlice("crd", nil, "CRD file defining a resource matched by the admission policy or webhooks being linted, or the paramKind of the policy (can be repeated)")
+	jobs := flag.IntP("jobs", "j", 0, "number of CRD versions to lint at the same time (default: number of CPUs)")
+	timeout := flag.Duration("timeout", 0, "time allowed to lint each CRD, e.g. 30s (default: no limit)")
+	maxDepth := flag.Int("max-depth", celvet.DefaultMaxDepth, "deepest schema nesting checked; deeper schemas are reported without being checked (negative: no limit)")
+	maxNodes := flag.Int("max-nodes", celvet.DefaultMaxNodes, "largest number of schema nodes checked; larger schemas are reported without being checked (negative: no limit)")
+	failOnWarning := flag.Bool("fail-on-warning", false, "exit with a non-zero code on warnings, not only on errors")
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "%s [flags] crd-file\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "%s [flags] crd-policy-webhook-or-openapi-file-or-bundle-dir...\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
 	args := flag.Args()
-	if len(args) != 1 {
+	if len(args) == 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
-
-	crdFile := args[0]
-	fileBytes, err := ioutil.ReadFile(crdFile)
+	versions, err := celvet.ParseVersionRange(*kubeVersion)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error reading %s: %s\n", crdFile, err)
+		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
-	scheme := runtime.NewScheme()
-	apiinstall.Install(scheme)
-	codecs := runtimeserializer.NewCodecFactory(scheme)
-	decode := codecs.UniversalDeserializer().Decode
-	obj, _, err := decode(fileBytes, nil, nil)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error while decoding: %s\n", err)
-		os.Exit(1)
+	if !versions.Modeled() {
+		fmt.Fprintf(os.Stderr, "warning: Kubernetes %s may offer CEL libraries celvet does not know of; rules using them are reported as compile errors\n", versions)
 	}
-	switch obj.(type) {
-	case *apiv1.CustomResourceDefinition:
-	default:
-		fmt.Fprintf(os.Stderr, "unexpected decoded object (expected CustomResourceDefinition), got %T\n", obj)
-		os.Exit(1)
+
+	failSeverity := celvet.SeverityError
+	if *failOnWarning {
+		failSeverity = celvet.SeverityWarning
 	}
-	spec := obj.(*apiv1.CustomResourceDefinition).Spec
-	// TODO(DangerOnTheRanger): support multiple CRD versions
-	v1Schema := spec.Versions[0].Schema.OpenAPIV3Schema
-	schema := &api.JSONSchemaProps{}
-	err = apiv1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(v1Schema, schema, nil)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error during schema conversion: %s\n", err)
-		os.Exit(1)
+
+	exitCode := 0
+	var crdFileNames []string
+	var manifests [][]byte
+	// inBundle is true for the manifests read from OLM bundles
+	var inBundle []bool
+	var openAPIFileNames []string
+	var openAPIDocuments [][]byte
+	for _, file := range args {
+		// only name files when there is more than one
+		prefix := ""
+		if len(args) > 1 {
+			prefix = file + ": "
+		}
+		if info, err := os.Stat(file); err == nil && info.IsDir() {
+			bundleCRDs, err := celvet.BundleCRDs(file)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				exitCode = 1
+				continue
+			}
+			for _, manifest := range bundleCRDs {
+				crdFileNames = append(crdFileNames, manifest.Path)
+				manifests = append(manifests, manifest.Data)
+				inBundle = append(inBundle, true)
+			}
+			continue
+		}
+		fileBytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading %s: %s\n", file, err)
+			exitCode = 1
+			continue
+		}
+		var typeMeta struct {
+			Kind string `json:"kind"`
+			// set by OpenAPI v3 documents instead of kind
+			OpenAPI string `json:"openapi"`
+		}
+		if err := yaml.Unmarshal(fileBytes, &typeMeta); err == nil {
+			if typeMeta.OpenAPI != "" {
+				openAPIFileNames = append(openAPIFileNames, file)
+				openAPIDocuments = append(openAPIDocuments, fileBytes)
+				continue
+			}
+			switch typeMeta.Kind {
+			case "ValidatingAdmissionPolicy":
+				exitCode |= lintAdmission(fileBytes, *crdFiles, lintPolicy, prefix)
+				continue
+			case "ValidatingWebhookConfiguration", "MutatingWebhookConfiguration":
+				exitCode |= lintAdmission(fileBytes, *crdFiles, lintWebhooks, prefix)
+				continue
+			}
+		}
+		crdFileNames = append(crdFileNames, file)
+		manifests = append(manifests, fileBytes)
+		inBundle = append(inBundle, false)
 	}
-	structural, err := structuralschema.NewStructural(schema)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error converting to structural schema: %s\n", err)
-		os.Exit(1)
+
+	linter := celvet.NewLinter(celvet.Options{KubeVersions: &versions, HumanReadable: *humanReadable, Jobs: *jobs, Timeout: *timeout,
+		MaxDepth: *maxDepth, MaxNodes: *maxNodes})
+	for i, result := range lintManifests(linter, crdFileNames, manifests, inBundle) {
+		prefix := ""
+		if len(args) > 1 || len(manifests) > 1 {
+			prefix = crdFileNames[i] + ": "
+		}
+		multipleVersions := false
+		if crd, err := celvet.DecodeCRD(manifests[i]); err == nil {
+			multipleVersions = len(crd.Spec.Versions) > 1
+		}
+		// only name versions when there is more than one
+		exitCode |= printFindings(prefix, result.Findings, result.Err, multipleVersions, failSeverity)
 	}
+	for i, document := range openAPIDocuments {
+		prefix := ""
+		if len(args) > 1 {
+			prefix = openAPIFileNames[i] + ": "
+		}
+		findings, err := linter.LintOpenAPIDocument(context.Background(), document)
+		// findings are named by the schema they are about
+		exitCode |= printFindings(prefix, findings, err, true, failSeverity)
+	}
+	os.Exit(exitCode)
+}
 
-	limitErrors := celvet.CheckMaxLimits(structural)
-	for _, lintError := range limitErrors {
-		fmt.Fprintf(os.Stderr, "%s\n", lintError)
+// lintManifests lints manifests, those read from OLM bundles with
+// LintBundleManifests so that their findings point into their versions, and
+// returns their results in the same order.
+func lintManifests(linter *celvet.Linter, fileNames []string, manifests [][]byte, inBundle []bool) []celvet.ManifestResult {
+	var files [][]byte
+	var fileIndexes []int
+	var bundleManifests []celvet.BundleManifest
+	var bundleIndexes []int
+	for i, manifest := range manifests {
+		if inBundle[i] {
+			bundleManifests = append(bundleManifests, celvet.BundleManifest{Path: fileNames[i], Data: manifest})
+			bundleIndexes = append(bundleIndexes, i)
+		} else {
+			files = append(files, manifest)
+			fileIndexes = append(fileIndexes, i)
+		}
+	}
+	results := make([]celvet.ManifestResult, len(manifests))
+	for i, result := range linter.LintManifests(context.Background(), files) {
+		results[fileIndexes[i]] = result
 	}
+	for i, result := range linter.LintBundleManifests(context.Background(), bundleManifests) {
+		results[bundleIndexes[i]] = result
+	}
+	return results
+}
 
-	costErrors, compileErrors := celvet.CheckExprCost(structural)
-	for _, lintError := range costErrors {
-		if *humanReadable {
-			fmt.Fprintf(os.Stderr, "%s\n", lintError.HumanReadableError())
+// printFindings prints findings and err prefixed by prefix, and by the
+// version of each finding if printVersions is true, and returns the exit code,
+// which is non-zero if err is set or a finding is at least as severe as
+// failSeverity.
+func printFindings(prefix string, findings []celvet.Finding, err error, printVersions bool, failSeverity celvet.Severity) int {
+	exitCode := 0
+	for _, finding := range findings {
+		if printVersions {
+			fmt.Fprintf(os.Stderr, "%s%s: %s\n", prefix, finding.Version, finding)
 		} else {
-			fmt.Fprintf(os.Stderr, "%s\n", lintError.Error())
+			fmt.Fprintf(os.Stderr, "%s%s\n", prefix, finding)
+		}
+		if finding.Severity >= failSeverity {
+			exitCode = 1
 		}
 	}
-	for _, compileError := range compileErrors {
-		fmt.Fprintf(os.Stderr, "%s\n", compileError)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%s\n", prefix, err)
+		exitCode = 1
 	}
+	return exitCode
+}
 
-	if len(limitErrors)+len(costErrors)+len(compileErrors) > 0 {
-		os.Exit(1)
+// lintAdmission lints the expressions of an admission policy or webhook
+// configuration with lint, typing them with the schemas of the CRDs in
+// crdFiles and the built-in resources, prints the results prefixed by prefix
+// and returns the exit code.
+func lintAdmission(data []byte, crdFiles []string, lint func([]byte, []celvet.AdmissionSchema) ([]*celvet.AdmissionExpressionError, error), prefix string) int {
+	var schemas []celvet.AdmissionSchema
+	for _, crdFile := range crdFiles {
+		crdBytes, err := ioutil.ReadFile(crdFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading %s: %s\n", crdFile, err)
+			return 1
+		}
+		crd, err := celvet.DecodeCRD(crdBytes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", crdFile, err)
+			return 1
+		}
+		crdSchemas, err := celvet.CRDAdmissionSchemas(crd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: error converting to structural schema: %s\n", crdFile, err)
+			return 1
+		}
+		schemas = append(schemas, crdSchemas...)
+	}
+
+	results, err := lint(data, schemas)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%s\n", prefix, err)
+		return 1
+	}
+	numErrors := 0
+	for _, lintError := range results {
+		fmt.Fprintf(os.Stderr, "%s%s\n", prefix, lintError)
+		if !lintError.Informational() {
+			numErrors++
+		}
+	}
+	if numErrors > 0 {
+		return 1
+	}
+	return 0
+}
+
+func lintPolicy(data []byte, schemas []celvet.AdmissionSchema) ([]*celvet.AdmissionExpressionError, error) {
+	policy, err := celvet.ParseValidatingAdmissionPolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding: %w", err)
+	}
+	return celvet.CheckAdmissionPolicy(policy, schemas)
+}
+
+func lintWebhooks(data []byte, schemas []celvet.AdmissionSchema) ([]*celvet.AdmissionExpressionError, error) {
+	config, err := celvet.ParseWebhookConfiguration(data)
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding: %w", err)
 	}
+	return celvet.CheckWebhookMatchConditions(config, schemas)
 }
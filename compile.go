@@ -0,0 +1,350 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types/ref"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	schemacel "k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel/library"
+	celmodel "k8s.io/apiextensions-apiserver/third_party/forked/celopenapi/model"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ruleCompiler compiles the expressions declared on the nodes of a schema.
+// schemacel.Compile builds the declaration types of a node and everything
+// beneath it, then a CEL environment, every time it is called, so compiling
+// every node of a large schema spends most of its time building the same
+// types and type checkers over and over. ruleCompiler builds the types of the
+// whole schema once, and declares self with the type name selfType, which its
+// type provider resolves to the type of the node being compiled. Nodes whose
+// types only differ by the object they contain thus share an environment: the
+// schema only needs one environment per kind of node, e.g. objects, lists of
+// objects and strings. Compilation results are cached by the type of self and
+// expression so that checks compiling the same rules share the work. It is
+// safe for concurrent use, although it compiles one expression at a time.
+type ruleCompiler struct {
+	// provider is the type provider of every shared environment, or nil if
+	// the schema root does not support rules, in which case every node gets
+	// an environment of its own.
+	provider *selfTypeProvider
+	// base is the environment the shared environments extend.
+	base *cel.Env
+	// types are the declaration types of the nodes with rules, by path.
+	types map[string]*celmodel.DeclType
+	// depthErr is set if the schema is deeper than MaxSchemaDepth, in which
+	// case no expression is compiled: celmodel.NewRuleTypes and
+	// schemacel.Compile recurse into the schema.
+	depthErr error
+
+	mu sync.Mutex
+	// envs are the shared environments by the type of self, and the
+	// environments of nodes that do not have a shared type by path.
+	envs    map[string]envResult
+	results map[compileKey]schemacel.CompilationResult
+}
+
+// envResult is an environment, or the error building it. The estimator and
+// cardinality of shared environments are left unset, as they vary by node.
+type envResult struct {
+	env *ruleEnv
+	err error
+}
+
+// compileKey identifies an expression compiled against a type of self. The
+// result of compiling an expression depends on the fields, sizes and
+// cardinality of self, which are all captured by its declaration type, so
+// nodes sharing a declaration type share results. Nodes without a recorded
+// declaration type are identified by their environment instead, which is
+// built from their own schema.
+type compileKey struct {
+	selfType    *celmodel.DeclType
+	env         *ruleEnv
+	source      string
+	resultTypes string
+}
+
+// schemaTypeName is the type name of the root of the schema in the shared
+// environments, which prefixes the type names of the objects beneath it.
+const schemaTypeName = "openAPIV3Schema"
+
+// newRuleCompiler returns a ruleCompiler for the nodes of schema, the root of
+// a CRD version schema at rootPath. Nodes are compiled by their paths beneath
+// rootPath.
+func newRuleCompiler(schema *structuralschema.Structural, rootPath *field.Path) *ruleCompiler {
+	c := &ruleCompiler{
+		types:   map[string]*celmodel.DeclType{},
+		envs:    map[string]envResult{},
+		results: map[compileKey]schemacel.CompilationResult{},
+	}
+	if err := walk(schema, rootPath, WalkLimits{MaxDepth: MaxSchemaDepth}, func(*Node) bool { return true }); err != nil {
+		c.depthErr = fmt.Errorf("rules not compiled: %w", err)
+		return c
+	}
+	env, err := cel.NewEnv(
+		cel.HomogeneousAggregateLiterals(),
+	)
+	if err != nil {
+		return c
+	}
+	reg := celmodel.NewRegistry(env)
+	rt, err := celmodel.NewRuleTypes(schemaTypeName, schema, true, reg)
+	if err != nil || rt == nil {
+		return c
+	}
+	root, ok := rt.FindDeclType(schemaTypeName)
+	if !ok {
+		return c
+	}
+	opts, err := rt.EnvOptions(env.TypeProvider())
+	if err != nil {
+		return c
+	}
+	// the first option sets rt as the type provider, which is replaced by
+	// one resolving selfType as well
+	rt.TypeProvider = env.TypeProvider()
+	provider := &selfTypeProvider{RuleTypes: rt}
+	opts = append([]cel.EnvOption{cel.CustomTypeProvider(provider)}, opts[1:]...)
+	opts = append(opts, cel.HomogeneousAggregateLiterals())
+	opts = append(opts, library.ExtensionLibs...)
+	if c.base, err = env.Extend(opts...); err != nil {
+		c.base = nil
+		return c
+	}
+	c.provider = provider
+	c.collectTypes(schema, root, rootPath)
+	return c
+}
+
+// collectTypes records declType, the declaration type of schema, and the
+// types of the nodes with rules beneath it. Recording every node would cost
+// memory quadratic in the depth of the schema, as nodes are recorded by path;
+// other nodes compiled by checks, such as the targets of rule relocations, get
+// an environment of their own. Nodes the apiserver leaves out of the type of
+// their parent, such as properties whose names cannot be escaped, are not
+// recorded. collectTypes does not recurse, so that it can handle schemas of
+// any depth.
+func (c *ruleCompiler) collectTypes(schema *structuralschema.Structural, declType *celmodel.DeclType, path *field.Path) {
+	type typedNode struct {
+		schema   *structuralschema.Structural
+		declType *celmodel.DeclType
+		path     *field.Path
+	}
+	stack := []typedNode{{schema, declType, path}}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if len(node.schema.Extensions.XValidations) > 0 {
+			c.types[node.path.String()] = node.declType
+		}
+		switch node.schema.Type {
+		case "array":
+			if node.schema.Items != nil && node.declType.IsList() {
+				stack = append(stack, typedNode{node.schema.Items, node.declType.ElemType, node.path.Child("items")})
+			}
+		case "object":
+			if node.schema.AdditionalProperties != nil && node.schema.AdditionalProperties.Structural != nil {
+				if node.declType.IsMap() {
+					stack = append(stack, typedNode{node.schema.AdditionalProperties.Structural, node.declType.ElemType, node.path.Child("additionalProperties")})
+				}
+				continue
+			}
+			if !node.declType.IsObject() {
+				continue
+			}
+			for propName, propSchema := range node.schema.Properties {
+				propSchema := propSchema
+				escaped, ok := celmodel.Escape(propName)
+				if !ok {
+					continue
+				}
+				if propField, ok := node.declType.Fields[escaped]; ok && propField.Type != nil {
+					stack = append(stack, typedNode{&propSchema, propField.Type, node.path.Child("properties").Key(propName)})
+				}
+			}
+		}
+	}
+}
+
+// env returns the environment of the expressions declared on schema, the node
+// at path, the object type selfType must resolve to, if any, and the key of
+// source compiled on the node. c.mu must be held.
+func (c *ruleCompiler) env(schema *structuralschema.Structural, path *field.Path, isResourceRoot bool, source string, resultTypes ...*expr.Type) (*ruleEnv, *celmodel.DeclType, compileKey, error) {
+	if c.depthErr != nil {
+		return nil, nil, compileKey{}, c.depthErr
+	}
+	var typeNames []string
+	for _, resultType := range resultTypes {
+		typeNames = append(typeNames, resultType.String())
+	}
+	key := compileKey{source: source, resultTypes: strings.Join(typeNames, "|")}
+	declType, ok := c.types[path.String()]
+	if !ok || c.provider == nil {
+		cached, ok := c.envs[path.String()]
+		if !ok {
+			cached.env, cached.err = newRuleEnv(schema, isResourceRoot)
+			c.envs[path.String()] = cached
+		}
+		key.env = cached.env
+		return cached.env, nil, key, cached.err
+	}
+	key.selfType = declType
+	selfType, object := selfExprType(declType)
+	envKey := selfType.String()
+	cached, ok := c.envs[envKey]
+	if !ok {
+		cached.env = &ruleEnv{}
+		cached.env.env, cached.err = c.base.Extend(cel.Declarations(
+			decls.NewVar(schemacel.ScopedVarName, selfType),
+			decls.NewVar(schemacel.OldScopedVarName, selfType),
+		))
+		c.envs[envKey] = cached
+	}
+	if cached.err != nil {
+		return nil, nil, key, cached.err
+	}
+	return &ruleEnv{
+		env:            cached.env.env,
+		estimator:      &library.CostEstimator{SizeEstimator: &sizeEstimator{roots: map[string]*celmodel.DeclType{schemacel.ScopedVarName: declType, schemacel.OldScopedVarName: declType}, fallback: declType}},
+		maxCardinality: celmodel.MaxCardinality(schema),
+	}, object, key, nil
+}
+
+// selfExprType returns the type of self in the shared environments for a node
+// of type t, where the object in t, if any, is replaced by selfType, along
+// with that object.
+func selfExprType(t *celmodel.DeclType) (*expr.Type, *celmodel.DeclType) {
+	// the lists and maps around the object, outermost first
+	var containers []*celmodel.DeclType
+	for t.IsList() || t.IsMap() {
+		containers = append(containers, t)
+		t = t.ElemType
+	}
+	exprType, object := t.ExprType(), (*celmodel.DeclType)(nil)
+	if t.IsObject() {
+		exprType, object = decls.NewObjectType(scopedTypeName), t
+	}
+	for i := len(containers) - 1; i >= 0; i-- {
+		if containers[i].IsList() {
+			exprType = decls.NewListType(exprType)
+		} else {
+			exprType = decls.NewMapType(containers[i].KeyType.ExprType(), exprType)
+		}
+	}
+	return exprType, object
+}
+
+// compile compiles source, an expression declared on schema, the node at path,
+// like ruleEnv.compile. An error is returned if the environment of the node
+// cannot be built.
+func (c *ruleCompiler) compile(schema *structuralschema.Structural, path *field.Path, isResourceRoot bool, source string, resultTypes ...*expr.Type) (schemacel.CompilationResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	env, object, key, err := c.env(schema, path, isResourceRoot, source, resultTypes...)
+	if err != nil {
+		return schemacel.CompilationResult{}, err
+	}
+	if cached, ok := c.results[key]; ok {
+		return cached, nil
+	}
+	c.setSelf(object)
+	result := env.compile(source, resultTypes...)
+	c.results[key] = result
+	return result, nil
+}
+
+// setSelf makes selfType resolve to object in the shared environments until
+// it is called again. Types are only looked up while expressions are checked
+// and their programs planned, which is always done right after setSelf with
+// c.mu held: programs do not look types up once planned, so selfType can
+// resolve to another object once c.mu is released.
+func (c *ruleCompiler) setSelf(object *celmodel.DeclType) {
+	if c.provider != nil {
+		c.provider.self = object
+	}
+}
+
+// selfTypeProvider resolves selfType to the object type self, in addition to
+// the types of a schema.
+type selfTypeProvider struct {
+	*celmodel.RuleTypes
+	// self is only set by ruleCompiler.setSelf, and only read while
+	// ruleCompiler holds its mutex.
+	self *celmodel.DeclType
+}
+
+func (p *selfTypeProvider) FindType(typeName string) (*expr.Type, bool) {
+	if typeName == scopedTypeName && p.self != nil {
+		return decls.NewTypeType(decls.NewObjectType(scopedTypeName)), true
+	}
+	return p.RuleTypes.FindType(typeName)
+}
+
+func (p *selfTypeProvider) FindFieldType(typeName, fieldName string) (*ref.FieldType, bool) {
+	if typeName == scopedTypeName && p.self != nil {
+		return p.RuleTypes.FindFieldType(p.self.TypeName(), fieldName)
+	}
+	return p.RuleTypes.FindFieldType(typeName, fieldName)
+}
+
+// compileRules compiles the rules declared on schema, the node at path, with
+// the same results as schemacel.Compile. Nodes without rules are not compiled.
+func (c *ruleCompiler) compileRules(schema *structuralschema.Structural, path *field.Path, isResourceRoot bool) ([]schemacel.CompilationResult, error) {
+	if len(schema.Extensions.XValidations) == 0 {
+		return nil, nil
+	}
+	if c.depthErr != nil {
+		return nil, c.depthErr
+	}
+	if _, ok := c.types[path.String()]; !ok || c.base == nil {
+		// schemacel.Compile knows how to report nodes that do not support
+		// rules
+		return schemacel.Compile(schema, isResourceRoot, schemacel.PerCallLimit)
+	}
+	results := make([]schemacel.CompilationResult, len(schema.Extensions.XValidations))
+	for i, rule := range schema.Extensions.XValidations {
+		result, err := c.compile(schema, path, isResourceRoot, rule.Rule, decls.Bool)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
+// check type-checks source, an expression declared on schema, the node at
+// path, and returns its checked AST, or nil if it does not compile. Checked
+// ASTs are not cached, as they are only needed by the checks inspecting the
+// types of expressions.
+func (c *ruleCompiler) check(schema *structuralschema.Structural, path *field.Path, isResourceRoot bool, source string) *cel.Ast {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	env, object, _, err := c.env(schema, path, isResourceRoot, source)
+	if err != nil {
+		return nil
+	}
+	c.setSelf(object)
+	ast, issues := env.env.Compile(source)
+	if issues != nil && issues.Err() != nil {
+		return nil
+	}
+	return ast
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	schemacel "k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestRuleCompiler(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema *structuralschema.Structural
+	}{
+		{
+			name: "nested",
+			schema: withRule(genRootSchema("list", withRule(genArraySchema(int64ptr(10), withRule(genMapSchema(nil, withRule(genStringSchema(int64ptr(5)), `self.startsWith("a")`)), `self.all(k, self[k] != k)`)), `self.size() > 1`)),
+				`has(self.list) && self.list.all(x, x.size() > 0)`),
+		},
+		{
+			name:   "object references",
+			schema: genRootSchema("list", withRule(genArraySchema(int64ptr(10), genLargeSchema(1, 2)), `self.all(x, x.name0 == x.object1.name1 && x.list0.size() < 5)`)),
+		},
+		{
+			name:   "transition rule",
+			schema: genRootSchema("value", withRule(genIntegerSchema(), `self >= oldSelf`)),
+		},
+		{
+			name:   "compile errors",
+			schema: genRootSchema("value", withRule(withRule(genStringSchema(nil), `self.nope`), `self`)),
+		},
+		{
+			name:   "embedded resource",
+			schema: genRootSchema("embedded", withRule(genEmbeddedResourceSchema(), `self.metadata.name == self.kind`)),
+		},
+		{
+			name: "unescapable property name",
+			schema: &structuralschema.Structural{
+				Generic: structuralschema.Generic{Type: "object"},
+				Properties: map[string]structuralschema.Structural{
+					"a b": *withRule(genStringSchema(int64ptr(10)), `self.size() > 1`),
+				},
+			},
+		},
+		{
+			name:   "scalar root",
+			schema: withRule(genStringSchema(nil), `self.all(x, true)`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compiler := newRuleCompiler(tt.schema, field.NewPath("spec", "validation", "openAPIV3Schema"))
+			compiled := 0
+			Walk(tt.schema, func(node *Node) bool {
+				expected, expectedErr := schemacel.Compile(node.Schema, node.IsResourceRoot, schemacel.PerCallLimit)
+				results, err := compiler.compileRules(node.Schema, node.Path, node.IsResourceRoot)
+				if (err == nil) != (expectedErr == nil) {
+					t.Fatalf("Wrong error for %s (expected %v, got %v)", node.Path, expectedErr, err)
+				}
+				if len(results) != len(expected) {
+					t.Fatalf("Wrong number of results for %s (expected %d, got %d)", node.Path, len(expected), len(results))
+				}
+				for i, result := range results {
+					want := expected[i]
+					if (result.Error == nil) != (want.Error == nil) || (result.Program == nil) != (want.Program == nil) {
+						t.Errorf("Wrong result for %s rule %d (expected %+v, got %+v)", node.Path, i, want, result)
+					}
+					if result.MaxCost != want.MaxCost || result.MaxCardinality != want.MaxCardinality || result.TransitionRule != want.TransitionRule {
+						t.Errorf("Wrong estimates for %s rule %d (expected cost %d, cardinality %d, transition %t, got %d, %d, %t)", node.Path, i,
+							want.MaxCost, want.MaxCardinality, want.TransitionRule, result.MaxCost, result.MaxCardinality, result.TransitionRule)
+					}
+					compiled++
+				}
+				return true
+			})
+			if compiled == 0 {
+				t.Fatal("No rules compiled")
+			}
+		})
+	}
+}
+
+func TestRuleCompilerCache(t *testing.T) {
+	schema := genRootSchema("value", withRule(withRule(genStringSchema(int64ptr(10)), `self.size() > 1`), `self.size() > 1`))
+	compiler := newRuleCompiler(schema, field.NewPath("spec", "validation", "openAPIV3Schema"))
+	var results []schemacel.CompilationResult
+	for i := 0; i < 2; i++ {
+		Walk(schema, func(node *Node) bool {
+			nodeResults, err := compiler.compileRules(node.Schema, node.Path, node.IsResourceRoot)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			results = append(results, nodeResults...)
+			return true
+		})
+	}
+	if len(results) != 4 {
+		t.Fatalf("Wrong number of results (expected 4, got %d)", len(results))
+	}
+	for _, result := range results[1:] {
+		if result.Program != results[0].Program {
+			t.Errorf("Rule compiled more than once")
+		}
+	}
+	if len(compiler.envs) != 1 || len(compiler.results) != 1 {
+		t.Errorf("Wrong cache size (expected 1 environment and 1 result, got %d and %d)", len(compiler.envs), len(compiler.results))
+	}
+}
+
+func TestRuleCompilerDepth(t *testing.T) {
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	schema := genNestedSchema(MaxSchemaDepth+1, withRule(genStringSchema(int64ptr(10)), `self.size() > 1`), func(schema *structuralschema.Structural) *structuralschema.Structural {
+		return genRootSchema("value", schema)
+	})
+	compiler := newRuleCompiler(schema, field.NewPath("spec", "validation", "openAPIV3Schema"))
+	node := Node{Schema: schema, Path: rootPath, IsResourceRoot: true}
+	for node.Schema.Properties != nil {
+		value := node.Schema.Properties["value"]
+		node = Node{Schema: &value, Path: node.Path.Child("properties").Key("value")}
+	}
+	_, err := compiler.compileRules(node.Schema, node.Path, node.IsResourceRoot)
+	var limitErr *WalkLimitError
+	if !errors.As(err, &limitErr) || limitErr.MaxDepth != MaxSchemaDepth {
+		t.Errorf("Expected the schema to be too deep to compile, got %v", err)
+	}
+}
+
+func TestRuleCompilerCacheByType(t *testing.T) {
+	// the same rule on nodes of different types must not share a result
+	schema := genRootSchema("short", withRule(genStringSchema(int64ptr(10)), `self.matches('^a')`))
+	schema.Properties["long"] = *withRule(genStringSchema(int64ptr(1000)), `self.matches('^a')`)
+	compiler := newRuleCompiler(schema, field.NewPath("spec", "validation", "openAPIV3Schema"))
+	costs := map[string]uint64{}
+	Walk(schema, func(node *Node) bool {
+		results, err := compiler.compileRules(node.Schema, node.Path, node.IsResourceRoot)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for _, result := range results {
+			costs[node.Path.String()] = result.MaxCost
+		}
+		return true
+	})
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	short, long := costs[rootPath.Child("properties").Key("short").String()], costs[rootPath.Child("properties").Key("long").String()]
+	if short == 0 || short >= long {
+		t.Errorf("Wrong costs (expected the short string to be cheaper, got %d and %d)", short, long)
+	}
+	if len(compiler.results) != 2 {
+		t.Errorf("Wrong cache size (expected 2 results, got %d)", len(compiler.results))
+	}
+}
+
+// genLargeSchema returns an object schema of the given depth where every
+// object has width properties: a string, a list of objects and an object, each
+// with a rule.
+func genLargeSchema(depth, width int) *structuralschema.Structural {
+	schema := &structuralschema.Structural{
+		Generic:    structuralschema.Generic{Type: "object"},
+		Properties: map[string]structuralschema.Structural{},
+	}
+	for i := 0; i < width; i++ {
+		schema.Properties[fmt.Sprintf("name%d", i)] = *withRule(genStringSchema(int64ptr(64)), `self.startsWith("a")`)
+		if depth > 0 {
+			schema.Properties[fmt.Sprintf("list%d", i)] = *withRule(genArraySchema(int64ptr(10), genLargeSchema(depth-1, width)), `self.size() > 0`)
+			schema.Properties[fmt.Sprintf("object%d", i)] = *withRule(genLargeSchema(depth-1, width), `has(self.name0)`)
+		}
+	}
+	return schema
+}
+
+func benchmarkSchemas(b *testing.B, run func(b *testing.B, schema *structuralschema.Structural)) {
+	for _, size := range []struct{ depth, width int }{{1, 4}, {2, 4}, {2, 8}} {
+		schema := genLargeSchema(size.depth, size.width)
+		nodes := 0
+		Walk(schema, func(*Node) bool {
+			nodes++
+			return true
+		})
+		b.Run(fmt.Sprintf("%d nodes", nodes), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				run(b, schema)
+			}
+		})
+	}
+}
+
+func BenchmarkCheckExprCost(b *testing.B) {
+	benchmarkSchemas(b, func(b *testing.B, schema *structuralschema.Structural) {
+		if _, compileErrors := CheckExprCost(schema); len(compileErrors) > 0 {
+			b.Fatalf("Unexpected errors: %v", compileErrors)
+		}
+	})
+}
+
+// BenchmarkCompilePerNode compiles every node of the schema on its own, as
+// CheckExprCost used to, for comparison with BenchmarkCheckExprCost.
+func BenchmarkCompilePerNode(b *testing.B) {
+	benchmarkSchemas(b, func(b *testing.B, schema *structuralschema.Structural) {
+		Walk(schema, func(node *Node) bool {
+			if _, err := schemacel.Compile(node.Schema, node.IsResourceRoot, schemacel.PerCallLimit); err != nil {
+				b.Fatalf("Unexpected error: %s", err)
+			}
+			return true
+		})
+	})
+}
+
+func BenchmarkLint(b *testing.B) {
+	linter := NewLinter(Options{})
+	benchmarkSchemas(b, func(b *testing.B, schema *structuralschema.Structural) {
+		target := &Target{Schema: schema, KubeVersions: *linter.options.KubeVersions, CostLimits: CostLimitsFor(*linter.options.KubeVersions), rules: newRuleCompiler(schema, field.NewPath("spec", "validation", "openAPIV3Schema"))}
+		for _, check := range linter.checks {
+			if _, err := check.Run(context.Background(), target); err != nil {
+				b.Fatalf("Unexpected error: %s", err)
+			}
+		}
+	})
+}
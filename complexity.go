@@ -0,0 +1,214 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/cel-go/common/operators"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	schemacel "k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel"
+	celmodel "k8s.io/apiextensions-apiserver/third_party/forked/celopenapi/model"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ComplexityError represents a rule that nests comprehension macros (all,
+// exists, exists_one, map, filter) over the same collection, or over a
+// collection and one of its ancestors, making its cost polynomial in the
+// size of the collection.
+type ComplexityError struct {
+	// Path represents the path to the rule.
+	Path *field.Path
+	// CollectionPath represents the path to the collection iterated by the
+	// outermost of the nested macros.
+	CollectionPath *field.Path
+	// Degree is the number of nested macros, i.e. the rule is O(n^Degree).
+	Degree int
+	// ListType is the x-kubernetes-list-type that would enforce the same
+	// uniqueness constraint for free, if the nested macros appear to compare
+	// list items with each other. It is empty otherwise.
+	ListType string
+	// ListMapKeys are the x-kubernetes-list-map-keys to use along with a
+	// ListType of "map".
+	ListMapKeys []string
+}
+
+func (c *ComplexityError) Error() string {
+	msg := fmt.Sprintf("rule %q nests %d comprehensions over %q, which is O(n^%d) in its size", c.Path.String(), c.Degree, c.CollectionPath.String(), c.Degree)
+	switch c.ListType {
+	case "set":
+		msg += "; if the rule enforces uniqueness, set x-kubernetes-list-type: set instead"
+	case "map":
+		msg += fmt.Sprintf("; if the rule enforces uniqueness, set x-kubernetes-list-type: map with x-kubernetes-list-map-keys: [%s] instead", strings.Join(c.ListMapKeys, ", "))
+	}
+	return msg
+}
+
+// CheckComplexity takes a schema and returns an error for every rule that
+// nests comprehension macros over the same collection or an ancestor of it.
+func CheckComplexity(schema *structuralschema.Structural) []*ComplexityError {
+	return checkComplexity(schema, field.NewPath("spec", "validation", "openAPIV3Schema"))
+}
+
+func checkComplexity(schema *structuralschema.Structural, root *field.Path) []*ComplexityError {
+	var complexityErrors []*ComplexityError
+	walkFrom(schema, root, func(node *Node) bool {
+		for i, rule := range node.Schema.Extensions.XValidations {
+			ast, err := parseRule(rule.Rule)
+			if err != nil {
+				// reported by CheckExprCost as a compilation error
+				continue
+			}
+			scope := map[string]schemaRef{
+				schemacel.ScopedVarName:    {Schema: node.Schema, Path: node.Path},
+				schemacel.OldScopedVarName: {Schema: node.Schema, Path: node.Path},
+			}
+			var worst *ComplexityError
+			findNestedMacros(ast.Expr(), scope, nil, func(frames []macroFrame) {
+				if worst != nil && worst.Degree >= len(frames) {
+					return
+				}
+				worst = &ComplexityError{
+					Path:           node.Path.Child("x-kubernetes-validations").Index(i).Child("rule"),
+					CollectionPath: frames[0].target.Path,
+					Degree:         len(frames),
+				}
+				if len(frames) == 2 && frames[0].target.Path.String() == frames[1].target.Path.String() && frames[0].target.Schema.Type == "array" {
+					worst.ListType, worst.ListMapKeys = uniquenessListType(frames[0], frames[1])
+				}
+			})
+			if worst != nil {
+				complexityErrors = append(complexityErrors, worst)
+			}
+		}
+		return true
+	})
+	return complexityErrors
+}
+
+// macroFrame is a comprehension macro iterating over a schema collection.
+type macroFrame struct {
+	call    *expr.Expr_Call
+	iterVar string
+	target  schemaRef
+}
+
+// findNestedMacros walks e and calls report with the chain of enclosing
+// macros for every macro that iterates over the same collection as, or an
+// ancestor of the collection of, an enclosing macro.
+func findNestedMacros(e *expr.Expr, scope map[string]schemaRef, frames []macroFrame, report func([]macroFrame)) {
+	if e == nil {
+		return
+	}
+	call, ok := callExpr(e)
+	if !ok || !comprehensionMacros[call.Function] || call.Target == nil || len(call.Args) < 2 {
+		visitExpr(e, func(child *expr.Expr) bool {
+			if child == e {
+				return true
+			}
+			findNestedMacros(child, scope, frames, report)
+			return false
+		})
+		return
+	}
+
+	findNestedMacros(call.Target, scope, frames, report)
+	bodyFrames := frames
+	if target, ok := resolveSchemaRef(call.Target, scope); ok && len(target.Rest) == 0 && isCollection(target.Schema) {
+		frame := macroFrame{call: call, target: target}
+		if iterVar, ok := call.Args[0].ExprKind.(*expr.Expr_IdentExpr); ok {
+			frame.iterVar = iterVar.IdentExpr.Name
+		}
+		var chain []macroFrame
+		for _, outer := range frames {
+			if isSameOrAncestorPath(target.Path, outer.target.Path) {
+				chain = append(chain, outer)
+			}
+		}
+		if len(chain) > 0 {
+			report(append(chain, frame))
+		}
+		bodyFrames = append(append([]macroFrame{}, frames...), frame)
+	}
+	bodyScope := macroScope(call, scope)
+	for _, arg := range call.Args[1:] {
+		findNestedMacros(arg, bodyScope, bodyFrames, report)
+	}
+}
+
+// isCollection returns true if schema is a list or a map.
+func isCollection(schema *structuralschema.Structural) bool {
+	return schema.Type == "array" || (schema.AdditionalProperties != nil && schema.AdditionalProperties.Structural != nil)
+}
+
+// isSameOrAncestorPath returns true if path is equal to other or is one of
+// its ancestors.
+func isSameOrAncestorPath(path, other *field.Path) bool {
+	p, o := path.String(), other.String()
+	return p == o || strings.HasPrefix(o, p+".") || strings.HasPrefix(o, p+"[")
+}
+
+// uniquenessListType returns the list type that would replace nested macros
+// over the same list comparing the iteration variables of outer and inner
+// with each other, along with the list map keys for map lists.
+func uniquenessListType(outer, inner macroFrame) (string, []string) {
+	if outer.iterVar == "" || inner.iterVar == "" {
+		return "", nil
+	}
+	scalarComparison := false
+	keys := map[string]bool{}
+	for _, arg := range inner.call.Args[1:] {
+		visitExpr(arg, func(e *expr.Expr) bool {
+			call, ok := callExpr(e)
+			if !ok || (call.Function != operators.Equals && call.Function != operators.NotEquals) || len(call.Args) != 2 {
+				return true
+			}
+			lhs, rhs := call.Args[0], call.Args[1]
+			if (isIdent(lhs, outer.iterVar) && isIdent(rhs, inner.iterVar)) || (isIdent(lhs, inner.iterVar) && isIdent(rhs, outer.iterVar)) {
+				scalarComparison = true
+				return false
+			}
+			lhsFields, lhsOk := selectPath(lhs, outer.iterVar)
+			rhsFields, rhsOk := selectPath(rhs, inner.iterVar)
+			if !lhsOk || !rhsOk {
+				lhsFields, lhsOk = selectPath(lhs, inner.iterVar)
+				rhsFields, rhsOk = selectPath(rhs, outer.iterVar)
+			}
+			if lhsOk && rhsOk && len(lhsFields) == 1 && len(rhsFields) == 1 && lhsFields[0] == rhsFields[0] {
+				keys[lhsFields[0]] = true
+				return false
+			}
+			return true
+		})
+	}
+	items := outer.target.Schema.Items
+	if scalarComparison && items != nil && items.Type != "object" && items.Type != "array" {
+		return "set", nil
+	}
+	if len(keys) > 0 && items != nil && items.Type == "object" {
+		var listMapKeys []string
+		for key := range keys {
+			if unescaped, ok := celmodel.Unescape(key); ok {
+				key = unescaped
+			}
+			listMapKeys = append(listMapKeys, key)
+		}
+		sort.Strings(listMapKeys)
+		return "map", listMapKeys
+	}
+	return "", nil
+}
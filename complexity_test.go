@@ -0,0 +1,89 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"strings"
+	"testing"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestComplexity(t *testing.T) {
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	rulePath := rootPath.Child("x-kubernetes-validations").Index(0).Child("rule")
+	tests := []struct {
+		name           string
+		schema         *structuralschema.Structural
+		expectedErrors []*ComplexityError
+	}{
+		{
+			name:           "singleMacro",
+			schema:         withRule(genArraySchema(nil, genStringSchema(nil)), `self.all(x, x.size() < 10)`),
+			expectedErrors: []*ComplexityError{},
+		},
+		{
+			name:           "nestedOverChildCollection",
+			schema:         withRule(genArraySchema(nil, genArraySchema(nil, genIntegerSchema())), `self.all(x, x.all(y, y > 0))`),
+			expectedErrors: []*ComplexityError{},
+		},
+		{
+			name:   "uniqueScalars",
+			schema: withRule(genArraySchema(nil, genStringSchema(nil)), `self.all(x, self.exists_one(y, x == y))`),
+			expectedErrors: []*ComplexityError{
+				{Path: rulePath, CollectionPath: rootPath, Degree: 2, ListType: "set"},
+			},
+		},
+		{
+			name: "uniqueKeys",
+			schema: withRule(genArraySchema(nil, genRootSchema("name", genStringSchema(nil))),
+				`self.all(x, self.filter(y, y.name == x.name).size() == 1)`),
+			expectedErrors: []*ComplexityError{
+				{Path: rulePath, CollectionPath: rootPath, Degree: 2, ListType: "map", ListMapKeys: []string{"name"}},
+			},
+		},
+		{
+			name: "ancestorCollection",
+			schema: withRule(genRootSchema("groups", genArraySchema(nil, genRootSchema("members", genArraySchema(nil, genStringSchema(nil))))),
+				`self.groups.all(g, g.members.all(m, self.groups.exists(o, o.members.exists(n, n == m))))`),
+			expectedErrors: []*ComplexityError{
+				{Path: rulePath, CollectionPath: rootPath.Child("properties").Key("groups"), Degree: 3},
+			},
+		},
+		{
+			name:   "cubic",
+			schema: withRule(genMapSchema(nil, genIntegerSchema()), `self.all(a, self.all(b, self.all(c, self[a] + self[b] != self[c])))`),
+			expectedErrors: []*ComplexityError{
+				{Path: rulePath, CollectionPath: rootPath, Degree: 3},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors := CheckComplexity(test.schema)
+			if len(errors) != len(test.expectedErrors) {
+				t.Fatalf("Wrong number of expected errors (got %v, expected %v)", errors, test.expectedErrors)
+			}
+			for i, seenError := range errors {
+				expectedError := test.expectedErrors[i]
+				if seenError.Path.String() != expectedError.Path.String() || seenError.CollectionPath.String() != expectedError.CollectionPath.String() ||
+					seenError.Degree != expectedError.Degree || seenError.ListType != expectedError.ListType ||
+					strings.Join(seenError.ListMapKeys, ",") != strings.Join(expectedError.ListMapKeys, ",") {
+					t.Errorf("Wrong error (expected %v, got %v)", expectedError, seenError)
+				}
+			}
+		})
+	}
+}
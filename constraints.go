@@ -0,0 +1,292 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/google/cel-go/common/operators"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	schemacel "k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ConstraintType represents the kind of problem found by CheckConstraints.
+type ConstraintType int
+
+const (
+	// ConstraintTypeContradiction represents a combination of value
+	// validations that no value can satisfy.
+	ConstraintTypeContradiction ConstraintType = iota
+	// ConstraintTypeRedundantRule represents a rule that only repeats what an
+	// OpenAPI keyword on the same schema node already enforces.
+	ConstraintTypeRedundantRule
+)
+
+// ConstraintError represents a contradictory combination of value validations,
+// or a rule made redundant by the value validations on its schema node.
+type ConstraintError struct {
+	// Path represents the path to the schema node for contradictions, and to
+	// the rule for redundant rules.
+	Path *field.Path
+	// Type indicates the kind of problem found.
+	Type ConstraintType
+	// Detail describes the contradiction, or names the keyword the rule
+	// duplicates.
+	Detail string
+}
+
+func (c *ConstraintError) Error() string {
+	switch c.Type {
+	case ConstraintTypeContradiction:
+		return fmt.Sprintf("schema %q has contradictory constraints: %s", c.Path.String(), c.Detail)
+	case ConstraintTypeRedundantRule:
+		return fmt.Sprintf("rule %q duplicates %s and can be removed to save cost", c.Path.String(), c.Detail)
+	}
+	return ""
+}
+
+// CheckConstraints takes a schema and returns an error for every
+// combination of value validations that can never be satisfied, such as
+// minItems greater than maxItems or a required property that is not declared,
+// and for every rule that only duplicates an OpenAPI keyword declared on the
+// same schema node, such as size(self) <= 10 alongside maxItems: 10.
+func CheckConstraints(schema *structuralschema.Structural) []*ConstraintError {
+	return checkConstraints(schema, field.NewPath("spec", "validation", "openAPIV3Schema"))
+}
+
+func checkConstraints(schema *structuralschema.Structural, root *field.Path) []*ConstraintError {
+	var constraintErrors []*ConstraintError
+	walkFrom(schema, root, func(node *Node) bool {
+		for _, detail := range contradictions(node.Schema) {
+			constraintErrors = append(constraintErrors, &ConstraintError{node.Path, ConstraintTypeContradiction, detail})
+		}
+		for i, rule := range node.Schema.Extensions.XValidations {
+			if keyword := duplicatedKeyword(node.Schema, rule.Rule); keyword != "" {
+				constraintErrors = append(constraintErrors, &ConstraintError{
+					Path:   node.Path.Child("x-kubernetes-validations").Index(i).Child("rule"),
+					Type:   ConstraintTypeRedundantRule,
+					Detail: keyword,
+				})
+			}
+		}
+		return true
+	})
+	return constraintErrors
+}
+
+// contradictions returns a description of every pair of value validations on
+// schema that cannot be satisfied together.
+func contradictions(schema *structuralschema.Structural) []string {
+	v := schema.ValueValidation
+	if v == nil {
+		return nil
+	}
+	var details []string
+	checkRange := func(minName string, min *int64, maxName string, max *int64) {
+		if min != nil && max != nil && *min > *max {
+			details = append(details, fmt.Sprintf("%s (%d) is greater than %s (%d)", minName, *min, maxName, *max))
+		}
+	}
+	checkRange("minItems", v.MinItems, "maxItems", v.MaxItems)
+	checkRange("minLength", v.MinLength, "maxLength", v.MaxLength)
+	checkRange("minProperties", v.MinProperties, "maxProperties", v.MaxProperties)
+	if v.Minimum != nil && v.Maximum != nil {
+		if *v.Minimum > *v.Maximum {
+			details = append(details, fmt.Sprintf("minimum (%g) is greater than maximum (%g)", *v.Minimum, *v.Maximum))
+		} else if *v.Minimum == *v.Maximum && (v.ExclusiveMinimum || v.ExclusiveMaximum) {
+			details = append(details, fmt.Sprintf("minimum and maximum are both %g but one of them is exclusive", *v.Minimum))
+		}
+	}
+
+	if schema.Type == "object" && schema.AdditionalProperties == nil && !schema.XPreserveUnknownFields {
+		for _, required := range v.Required {
+			if _, ok := schema.Properties[required]; !ok {
+				details = append(details, fmt.Sprintf("required property %q is not declared in properties", required))
+			}
+		}
+	}
+
+	for i, member := range v.Enum {
+		if reason := enumViolation(v, member.Object); reason != "" {
+			details = append(details, fmt.Sprintf("enum[%d] %s", i, reason))
+		}
+	}
+	return details
+}
+
+// enumViolation describes how member violates the value validations in v, or
+// returns the empty string if it does not.
+func enumViolation(v *structuralschema.ValueValidation, member interface{}) string {
+	switch m := member.(type) {
+	case string:
+		length := int64(utf8.RuneCountInString(m))
+		if v.MinLength != nil && length < *v.MinLength {
+			return fmt.Sprintf("is shorter than minLength (%d)", *v.MinLength)
+		}
+		if v.MaxLength != nil && length > *v.MaxLength {
+			return fmt.Sprintf("is longer than maxLength (%d)", *v.MaxLength)
+		}
+	case []interface{}:
+		if v.MinItems != nil && int64(len(m)) < *v.MinItems {
+			return fmt.Sprintf("has fewer items than minItems (%d)", *v.MinItems)
+		}
+		if v.MaxItems != nil && int64(len(m)) > *v.MaxItems {
+			return fmt.Sprintf("has more items than maxItems (%d)", *v.MaxItems)
+		}
+	default:
+		number, ok := toFloat(m)
+		if !ok {
+			return ""
+		}
+		if v.Minimum != nil && (number < *v.Minimum || (v.ExclusiveMinimum && number == *v.Minimum)) {
+			return fmt.Sprintf("is below minimum (%g)", *v.Minimum)
+		}
+		if v.Maximum != nil && (number > *v.Maximum || (v.ExclusiveMaximum && number == *v.Maximum)) {
+			return fmt.Sprintf("is above maximum (%g)", *v.Maximum)
+		}
+	}
+	return ""
+}
+
+// duplicatedKeyword returns the OpenAPI keyword on schema that already
+// enforces everything rule does, or the empty string if there is none. Only
+// rules consisting of a single comparison of self or size(self) against a
+// literal, or of self.matches() with a literal pattern, are recognized.
+func duplicatedKeyword(schema *structuralschema.Structural, rule string) string {
+	v := schema.ValueValidation
+	if v == nil {
+		return ""
+	}
+	ast, err := parseRule(rule)
+	if err != nil {
+		return ""
+	}
+	call, ok := callExpr(ast.Expr())
+	if !ok {
+		return ""
+	}
+
+	if call.Function == "matches" && call.Target != nil && isIdent(call.Target, schemacel.ScopedVarName) && len(call.Args) == 1 {
+		if pattern, ok := constString(call.Args[0]); ok && v.Pattern != "" && pattern == v.Pattern {
+			return "pattern"
+		}
+		return ""
+	}
+
+	if len(call.Args) != 2 {
+		return ""
+	}
+	subject, bound, function := call.Args[0], call.Args[1], call.Function
+	if _, ok := constNumber(subject); ok {
+		// normalize to have the literal on the right-hand side
+		subject, bound = bound, subject
+		function = flipComparison(function)
+	}
+	n, ok := constNumber(bound)
+	if !ok {
+		return ""
+	}
+
+	if isSizeOf(subject, schemacel.ScopedVarName) {
+		var minName, maxName string
+		var min, max *int64
+		switch schema.Type {
+		case "array":
+			minName, min, maxName, max = "minItems", v.MinItems, "maxItems", v.MaxItems
+		case "string":
+			minName, min, maxName, max = "minLength", v.MinLength, "maxLength", v.MaxLength
+		case "object":
+			minName, min, maxName, max = "minProperties", v.MinProperties, "maxProperties", v.MaxProperties
+		default:
+			return ""
+		}
+		switch function {
+		case operators.LessEquals:
+			if max != nil && float64(*max) <= n {
+				return maxName
+			}
+		case operators.Less:
+			if max != nil && float64(*max) < n {
+				return maxName
+			}
+		case operators.GreaterEquals:
+			if min != nil && float64(*min) >= n {
+				return minName
+			}
+		case operators.Greater:
+			if min != nil && float64(*min) > n {
+				return minName
+			}
+		}
+		return ""
+	}
+
+	if isIdent(subject, schemacel.ScopedVarName) && (schema.Type == "integer" || schema.Type == "number") {
+		switch function {
+		case operators.LessEquals:
+			if v.Maximum != nil && *v.Maximum <= n {
+				return "maximum"
+			}
+		case operators.Less:
+			if v.Maximum != nil && (*v.Maximum < n || (*v.Maximum == n && v.ExclusiveMaximum)) {
+				return "maximum"
+			}
+		case operators.GreaterEquals:
+			if v.Minimum != nil && *v.Minimum >= n {
+				return "minimum"
+			}
+		case operators.Greater:
+			if v.Minimum != nil && (*v.Minimum > n || (*v.Minimum == n && v.ExclusiveMinimum)) {
+				return "minimum"
+			}
+		}
+	}
+	return ""
+}
+
+// flipComparison returns the comparison operator that gives the same result
+// when its operands are swapped.
+func flipComparison(function string) string {
+	switch function {
+	case operators.Less:
+		return operators.Greater
+	case operators.LessEquals:
+		return operators.GreaterEquals
+	case operators.Greater:
+		return operators.Less
+	case operators.GreaterEquals:
+		return operators.LessEquals
+	}
+	return function
+}
+
+// toFloat converts the numeric types produced by JSON and YAML decoding to
+// float64.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"testing"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func float64ptr(f float64) *float64 {
+	return &f
+}
+
+func TestConstraints(t *testing.T) {
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	rulePath := rootPath.Child("x-kubernetes-validations").Index(0).Child("rule")
+	tests := []struct {
+		name           string
+		schema         *structuralschema.Structural
+		expectedErrors []*ConstraintError
+	}{
+		{
+			name:           "consistent",
+			schema:         withRule(genArraySchema(int64ptr(10), genStringSchema(int64ptr(5))), `self.all(x, x != 'a')`),
+			expectedErrors: []*ConstraintError{},
+		},
+		{
+			name: "minItemsAboveMaxItems",
+			schema: &structuralschema.Structural{
+				Generic: structuralschema.Generic{Type: "array"},
+				Items:   genIntegerSchema(),
+				ValueValidation: &structuralschema.ValueValidation{
+					MinItems: int64ptr(3),
+					MaxItems: int64ptr(2),
+				},
+			},
+			expectedErrors: []*ConstraintError{
+				{Path: rootPath, Type: ConstraintTypeContradiction, Detail: "minItems (3) is greater than maxItems (2)"},
+			},
+		},
+		{
+			name: "exclusiveEqualBounds",
+			schema: &structuralschema.Structural{
+				Generic: structuralschema.Generic{Type: "number"},
+				ValueValidation: &structuralschema.ValueValidation{
+					Minimum:          float64ptr(1),
+					Maximum:          float64ptr(1),
+					ExclusiveMaximum: true,
+				},
+			},
+			expectedErrors: []*ConstraintError{
+				{Path: rootPath, Type: ConstraintTypeContradiction, Detail: "minimum and maximum are both 1 but one of them is exclusive"},
+			},
+		},
+		{
+			name: "undeclaredRequiredProperty",
+			schema: &structuralschema.Structural{
+				Generic: structuralschema.Generic{Type: "object"},
+				Properties: map[string]structuralschema.Structural{
+					"name": *genStringSchema(int64ptr(5)),
+				},
+				ValueValidation: &structuralschema.ValueValidation{
+					Required: []string{"name", "nmae"},
+				},
+			},
+			expectedErrors: []*ConstraintError{
+				{Path: rootPath, Type: ConstraintTypeContradiction, Detail: `required property "nmae" is not declared in properties`},
+			},
+		},
+		{
+			name:   "enumOutsideBounds",
+			schema: withEnum(genStringSchema(int64ptr(3)), "abc", "abcd"),
+			expectedErrors: []*ConstraintError{
+				{Path: rootPath, Type: ConstraintTypeContradiction, Detail: "enum[1] is longer than maxLength (3)"},
+			},
+		},
+		{
+			name:   "redundantMaxItems",
+			schema: withRule(genArraySchema(int64ptr(10), genIntegerSchema()), `size(self) <= 10`),
+			expectedErrors: []*ConstraintError{
+				{Path: rulePath, Type: ConstraintTypeRedundantRule, Detail: "maxItems"},
+			},
+		},
+		{
+			name:   "redundantMaxLengthReversed",
+			schema: withRule(genStringSchema(int64ptr(10)), `64 > self.size()`),
+			expectedErrors: []*ConstraintError{
+				{Path: rulePath, Type: ConstraintTypeRedundantRule, Detail: "maxLength"},
+			},
+		},
+		{
+			name:           "stricterRuleIsNotRedundant",
+			schema:         withRule(genArraySchema(int64ptr(10), genIntegerSchema()), `size(self) <= 5`),
+			expectedErrors: []*ConstraintError{},
+		},
+		{
+			name: "redundantMinimum",
+			schema: withRule(&structuralschema.Structural{
+				Generic: structuralschema.Generic{Type: "integer"},
+				ValueValidation: &structuralschema.ValueValidation{
+					Minimum: float64ptr(0),
+				},
+			}, `self >= 0`),
+			expectedErrors: []*ConstraintError{
+				{Path: rulePath, Type: ConstraintTypeRedundantRule, Detail: "minimum"},
+			},
+		},
+		{
+			name: "redundantPattern",
+			schema: withRule(&structuralschema.Structural{
+				Generic: structuralschema.Generic{Type: "string"},
+				ValueValidation: &structuralschema.ValueValidation{
+					MaxLength: int64ptr(10),
+					Pattern:   "^[a-z]+$",
+				},
+			}, `self.matches('^[a-z]+$')`),
+			expectedErrors: []*ConstraintError{
+				{Path: rulePath, Type: ConstraintTypeRedundantRule, Detail: "pattern"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors := CheckConstraints(test.schema)
+			if len(errors) != len(test.expectedErrors) {
+				t.Fatalf("Wrong number of expected errors (got %v, expected %v)", errors, test.expectedErrors)
+			}
+			for i, seenError := range errors {
+				expectedError := test.expectedErrors[i]
+				if !constraintErrorsEqual(seenError, expectedError) {
+					t.Errorf("Wrong error (expected %v, got %v)", expectedError, seenError)
+				}
+			}
+		})
+	}
+}
+
+func constraintErrorsEqual(x, y *ConstraintError) bool {
+	return x.Path.String() == y.Path.String() && x.Type == y.Type && x.Detail == y.Detail
+}
@@ -16,6 +16,8 @@ package celvet
 import (
 	"fmt"
 	"math"
+	"sort"
+	"strings"
 
 	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/validation"
 	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
@@ -30,67 +32,166 @@ type CostError struct {
 	Path *field.Path
 	// Cost represents the cost of the expression. This is a unitless value.
 	Cost uint64
+	// Limit is the cost limit the expression exceeds. If 0,
+	// validation.StaticEstimatedCostLimit is assumed.
+	Limit uint64
+}
+
+func (c *CostError) limit() uint64 {
+	if c.Limit == 0 {
+		return validation.StaticEstimatedCostLimit
+	}
+	return c.Limit
 }
 
 func (c *CostError) Error() string {
-	return fmt.Sprintf("expression at %q has cost of %d which exceeds cost limit of %d", c.Path.String(), c.Cost, validation.StaticEstimatedCostLimit)
+	return fmt.Sprintf("expression at %q has cost of %d which exceeds cost limit of %d", c.Path.String(), c.Cost, c.limit())
 }
 
 // HumanReadableError returns an error message containing the amount by which
 // the expression exceeded the cost limit as a ratio.
 func (c *CostError) HumanReadableError() string {
-	exceedFactor := float64(c.Cost) / float64(validation.StaticEstimatedCostLimit)
+	exceedFactor := float64(c.Cost) / float64(c.limit())
 	return fmt.Sprintf("expression at %q exceeded budget by factor of %.1fx", c.Path.String(), exceedFactor)
 
 }
 
+// TotalCostError represents a CRD version schema whose rules have a total
+// cost beyond the per-CRD limit.
+type TotalCostError struct {
+	// Path represents the path to the schema.
+	Path *field.Path
+	// Cost represents the total cost of the rules of the schema.
+	Cost uint64
+	// Limit is the cost limit the total exceeds.
+	Limit uint64
+	// MostExpensive are the paths to the rules contributing the most to the
+	// total, most expensive first, like the apiserver reports them: at most
+	// four rules, each contributing at least 1% of the limit.
+	MostExpensive []*field.Path
+}
+
+func (t *TotalCostError) Error() string {
+	return fmt.Sprintf("rules of schema %q have a total cost of %d which exceeds cost limit of %d%s", t.Path.String(), t.Cost, t.Limit, t.mostExpensive())
+}
+
+// HumanReadableError returns an error message containing the amount by which
+// the total cost exceeded the cost limit as a ratio.
+func (t *TotalCostError) HumanReadableError() string {
+	exceedFactor := float64(t.Cost) / float64(t.Limit)
+	return fmt.Sprintf("rules of schema %q exceeded total budget by factor of %.1fx%s", t.Path.String(), exceedFactor, t.mostExpensive())
+}
+
+// mostExpensive lists the most expensive rules for error messages.
+func (t *TotalCostError) mostExpensive() string {
+	if len(t.MostExpensive) == 0 {
+		return ""
+	}
+	var rules []string
+	for _, path := range t.MostExpensive {
+		rules = append(rules, fmt.Sprintf("%q", path.String()))
+	}
+	return ", mostly due to " + strings.Join(rules, ", ")
+}
+
+// CompileError represents a rule that failed to compile.
+type CompileError struct {
+	// Path represents the path to the rule.
+	Path *field.Path
+	Err  error
+}
+
+func (c *CompileError) Error() string {
+	return c.Err.Error()
+}
+
+func (c *CompileError) Unwrap() error {
+	return c.Err
+}
+
 // CheckExprCost checks the given schema for expressions whose estimated cost
 // is greater than the per-expression cost limit. If any compilation errors
 // are encountered during this process, then those are returned as well.
 func CheckExprCost(schema *structuralschema.Structural) ([]*CostError, []error) {
-	return checkExprCost(schema, field.NewPath("spec", "validation", "openAPIV3Schema"), rootCostInfo())
+	return CheckExprCostWithLimits(schema, DefaultCostLimits())
 }
 
-func checkExprCost(schema *structuralschema.Structural, path *field.Path, nodeCostInfo costInfo) ([]*CostError, []error) {
-	results, err := schemacel.Compile(schema, false, schemacel.PerCallLimit)
-	if err != nil {
-		return nil, []error{err}
-	}
+// CheckExprCostWithLimits is like CheckExprCost, but checks the estimated
+// cost of expressions against limits, such as those returned by
+// CostLimitsFor. If limits.PerExpression is 0, only compilation errors are
+// returned.
+func CheckExprCostWithLimits(schema *structuralschema.Structural, limits CostLimits) ([]*CostError, []error) {
+	root := field.NewPath("spec", "validation", "openAPIV3Schema")
+	costErrors, _, compileErrors := checkExprCost(newRuleCompiler(schema, root), schema, root, limits)
+	return costErrors, compileErrors
+}
+
+// CheckTotalExprCost returns an error if the total estimated cost of the
+// rules of schema, the root of a CRD version schema, is greater than
+// limits.PerCRD. Rules that fail to compile do not count towards the total.
+func CheckTotalExprCost(schema *structuralschema.Structural, limits CostLimits) *TotalCostError {
+	root := field.NewPath("spec", "validation", "openAPIV3Schema")
+	_, totalCostError, _ := checkExprCost(newRuleCompiler(schema, root), schema, root, limits)
+	return totalCostError
+}
+
+// ruleCost is the estimated cost of a rule.
+type ruleCost struct {
+	path *field.Path
+	cost uint64
+}
+
+func checkExprCost(compiler *ruleCompiler, schema *structuralschema.Structural, root *field.Path, limits CostLimits) ([]*CostError, *TotalCostError, []error) {
 	var costErrors []*CostError
 	var compileErrors []error
-	for index, result := range results {
-		exprCost := getExpressionCost(result, nodeCostInfo)
-		if result.Error != nil {
-			compileErrors = append(compileErrors, fmt.Errorf("%w", result.Error))
+	var totalCost uint64
+	var mostExpensive []ruleCost
+	walkFrom(schema, root, func(node *Node) bool {
+		results, err := compiler.compileRules(node.Schema, node.Path, node.IsResourceRoot)
+		if err != nil {
+			compileErrors = append(compileErrors, err)
+			return false
 		}
-		if exprCost > validation.StaticEstimatedCostLimit {
-			costErrors = append(costErrors, &CostError{
-				Path: path.Child("x-kubernetes-validations").Index(index).Child("rule"),
-				Cost: exprCost,
-			})
+		for index, result := range results {
+			exprCost := getExpressionCost(result, costInfo{MaxCardinality: node.MaxCardinality})
+			if result.Error != nil {
+				compileErrors = append(compileErrors, &CompileError{Path: node.Path.Child("x-kubernetes-validations").Index(index).Child("rule"), Err: result.Error})
+				continue
+			}
+			if math.MaxUint64-totalCost < exprCost {
+				totalCost = math.MaxUint64
+			} else {
+				totalCost += exprCost
+			}
+			// like the apiserver, only name the rules contributing at least
+			// 1% of the limit
+			if limits.PerCRD != 0 && exprCost >= limits.PerCRD/100 {
+				mostExpensive = append(mostExpensive, ruleCost{path: node.Path.Child("x-kubernetes-validations").Index(index).Child("rule"), cost: exprCost})
+			}
+			if limits.PerExpression != 0 && exprCost > limits.PerExpression {
+				costErrors = append(costErrors, &CostError{
+					Path:  node.Path.Child("x-kubernetes-validations").Index(index).Child("rule"),
+					Cost:  exprCost,
+					Limit: limits.PerExpression,
+				})
+			}
 		}
+		return true
+	})
+	if limits.PerCRD == 0 || totalCost <= limits.PerCRD {
+		return costErrors, nil, compileErrors
 	}
-
-	switch schema.Type {
-	case "array":
-		itemCostErrors, itemCompileErrors := checkExprCost(schema.Items, path.Child("items"), nodeCostInfo.MultiplyByElementCost(schema))
-		compileErrors = append(compileErrors, itemCompileErrors...)
-		costErrors = append(costErrors, itemCostErrors...)
-	case "object":
-		var propCompileErrors []error
-		var propCostErrors []*CostError
-		for propName, propSchema := range schema.Properties {
-			propCostErrors, propCompileErrors = checkExprCost(&propSchema, path.Child("properties").Key(propName), nodeCostInfo.MultiplyByElementCost(schema))
-			compileErrors = append(compileErrors, propCompileErrors...)
-			costErrors = append(costErrors, propCostErrors...)
-		}
-		if schema.AdditionalProperties != nil && schema.AdditionalProperties.Structural != nil {
-			propCostErrors, propCompileErrors = checkExprCost(schema.AdditionalProperties.Structural, path.Child("additionalProperties"), nodeCostInfo.MultiplyByElementCost(schema))
-			compileErrors = append(compileErrors, propCompileErrors...)
-			costErrors = append(costErrors, propCostErrors...)
-		}
+	sort.SliceStable(mostExpensive, func(i, j int) bool {
+		return mostExpensive[i].cost > mostExpensive[j].cost
+	})
+	if len(mostExpensive) > 4 {
+		mostExpensive = mostExpensive[:4]
 	}
-	return costErrors, compileErrors
+	totalCostError := &TotalCostError{Path: root, Cost: totalCost, Limit: limits.PerCRD}
+	for _, rule := range mostExpensive {
+		totalCostError.MostExpensive = append(totalCostError.MostExpensive, rule.path)
+	}
+	return costErrors, totalCostError, compileErrors
 }
 
 // code below is copied from k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/validation/validation.go
@@ -14,9 +14,11 @@ limitations under the License.
 package celvet
 
 import (
+	"fmt"
 	"testing"
 
 	apiextensions "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/validation"
 	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 )
@@ -174,6 +176,25 @@ func TestCost(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:           "embeddedResource",
+			schema:         genRootSchema("template", withRule(genEmbeddedResourceSchema(), `self.kind == 'Pod' && self.metadata.name.startsWith('x')`)),
+			expectedErrors: []*CostError{},
+		},
+		{
+			name:           "resourceRoot",
+			schema:         withRule(genRootSchema("spec", genStringSchema(int64ptr(5))), `self.apiVersion.startsWith('example.com/') && self.metadata.name != self.spec`),
+			expectedErrors: []*CostError{},
+		},
+		{
+			name: "intOrString",
+			schema: genRootSchema("port", withRule(&structuralschema.Structural{
+				Extensions: structuralschema.Extensions{
+					XIntOrString: true,
+				},
+			}, `type(self) == int || self.matches('^[a-z]+$')`)),
+			expectedErrors: []*CostError{},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -194,6 +215,157 @@ func TestCost(t *testing.T) {
 	}
 }
 
+func TestCostCardinality(t *testing.T) {
+	intOrString := func(maxLength *int64) *structuralschema.Structural {
+		schema := withRule(&structuralschema.Structural{
+			Extensions: structuralschema.Extensions{
+				XIntOrString: true,
+			},
+		}, `type(self) == int || self.matches('^[a-z]+$')`)
+		if maxLength != nil {
+			schema.ValueValidation = &structuralschema.ValueValidation{MaxLength: maxLength}
+		}
+		return schema
+	}
+	embeddedResource := withRule(genEmbeddedResourceSchema(), `self.metadata.name.startsWith('x')`)
+	itemsPath := field.NewPath("spec", "validation", "openAPIV3Schema", "properties").Key("list").Child("items")
+	tests := []struct {
+		name   string
+		schema *structuralschema.Structural
+		// expectedCardinality is the cardinality of the items, nil if
+		// unbounded
+		expectedCardinality *uint64
+		expectedCost        uint64
+		expectCostError     bool
+	}{
+		{
+			// the string form of int-or-string values is sized from the
+			// request size limit, so 11 of them exceed the limit
+			name:                "intOrStringBeyondLimit",
+			schema:              genRootSchema("list", genArraySchema(int64ptr(11), intOrString(nil))),
+			expectedCardinality: uint64ptr(11),
+			expectedCost:        10380953,
+			expectCostError:     true,
+		},
+		{
+			name:                "intOrStringWithinLimit",
+			schema:              genRootSchema("list", genArraySchema(int64ptr(10), intOrString(nil))),
+			expectedCardinality: uint64ptr(10),
+			expectedCost:        9437230,
+		},
+		{
+			// like the apiserver, the estimate ignores the maxLength of
+			// int-or-string values
+			name:                "intOrStringWithMaxLength",
+			schema:              genRootSchema("list", genArraySchema(int64ptr(11), intOrString(int64ptr(8)))),
+			expectedCardinality: uint64ptr(11),
+			expectedCost:        10380953,
+			expectCostError:     true,
+		},
+		{
+			// without maxItems, the number of embedded resources is
+			// estimated from the request size limit
+			name:         "embeddedResourcesWithoutMaxItems",
+			schema:       genRootSchema("list", genArraySchema(nil, embeddedResource)),
+			expectedCost: 4194304,
+		},
+		{
+			name:                "embeddedResourcesWithMaxItems",
+			schema:              genRootSchema("list", genArraySchema(int64ptr(10), embeddedResource)),
+			expectedCardinality: uint64ptr(10),
+			expectedCost:        40,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			compiler := newRuleCompiler(test.schema, field.NewPath("spec", "validation", "openAPIV3Schema"))
+			found := false
+			Walk(test.schema, func(node *Node) bool {
+				if node.Path.String() != itemsPath.String() {
+					return true
+				}
+				found = true
+				if (node.MaxCardinality == nil) != (test.expectedCardinality == nil) ||
+					(node.MaxCardinality != nil && *node.MaxCardinality != *test.expectedCardinality) {
+					t.Errorf("Wrong cardinality (expected %v, got %v)", test.expectedCardinality, node.MaxCardinality)
+				}
+				results, err := compiler.compileRules(node.Schema, node.Path, node.IsResourceRoot)
+				if err != nil || len(results) != 1 || results[0].Error != nil {
+					t.Fatalf("Unexpected compilation results: %v, %v", results, err)
+				}
+				if cost := getExpressionCost(results[0], costInfo{MaxCardinality: node.MaxCardinality}); cost != test.expectedCost {
+					t.Errorf("Wrong cost (expected %d, got %d)", test.expectedCost, cost)
+				}
+				return true
+			})
+			if !found {
+				t.Fatalf("No node at %s", itemsPath)
+			}
+			costErrors, compileErrors := CheckExprCost(test.schema)
+			if len(compileErrors) > 0 || (len(costErrors) > 0) != test.expectCostError {
+				t.Errorf("Unexpected errors: %v, %v", costErrors, compileErrors)
+			}
+		})
+	}
+}
+
+func TestTotalCost(t *testing.T) {
+	// each list costs 9437230, within the per-expression limit
+	lists := func(count int) *structuralschema.Structural {
+		schema := &structuralschema.Structural{
+			Generic:    structuralschema.Generic{Type: "object"},
+			Properties: map[string]structuralschema.Structural{},
+		}
+		for i := 0; i < count; i++ {
+			schema.Properties[fmt.Sprintf("list%d", i)] = *genArraySchema(int64ptr(10), withRule(&structuralschema.Structural{
+				Extensions: structuralschema.Extensions{
+					XIntOrString: true,
+				},
+			}, `type(self) == int || self.matches('^[a-z]+$')`))
+		}
+		return schema
+	}
+	tests := []struct {
+		name                  string
+		schema                *structuralschema.Structural
+		expectedCost          uint64
+		expectedMostExpensive int
+	}{
+		{
+			name:   "withinLimit",
+			schema: lists(10),
+		},
+		{
+			name:                  "beyondLimit",
+			schema:                lists(11),
+			expectedCost:          11 * 9437230,
+			expectedMostExpensive: 4,
+		},
+	}
+	limits := CostLimits{PerExpression: validation.StaticEstimatedCostLimit, PerCRD: validation.StaticEstimatedCRDCostLimit}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			costErrors, compileErrors := CheckExprCostWithLimits(test.schema, limits)
+			if len(costErrors) > 0 || len(compileErrors) > 0 {
+				t.Fatalf("Unexpected errors: %v, %v", costErrors, compileErrors)
+			}
+			totalCostError := CheckTotalExprCost(test.schema, limits)
+			if test.expectedCost == 0 {
+				if totalCostError != nil {
+					t.Fatalf("Unexpected error: %v", totalCostError)
+				}
+				return
+			}
+			if totalCostError == nil {
+				t.Fatalf("Expected a total cost error")
+			}
+			if totalCostError.Cost != test.expectedCost || len(totalCostError.MostExpensive) != test.expectedMostExpensive {
+				t.Errorf("Wrong error (expected cost %d and %d rules, got %v)", test.expectedCost, test.expectedMostExpensive, totalCostError)
+			}
+		})
+	}
+}
+
 func errorsEqual(x, y *CostError) bool {
 	return x.Path.String() == y.Path.String() && x.Cost == y.Cost
 }
@@ -0,0 +1,79 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// MaxJSONDepth is the deepest the apiserver nests the objects and arrays of
+// the JSON it decodes: requests nested more deeply are rejected.
+const MaxJSONDepth = 10000
+
+// schemaRootJSONDepth is the JSON depth of openAPIV3Schema in a v1 CRD: the
+// CRD, spec, versions, the version, schema and openAPIV3Schema.
+const schemaRootJSONDepth = 6
+
+// MaxSchemaDepth is the depth, in schema levels beneath openAPIV3Schema, of
+// the deepest schema node a CRD the apiserver decodes can declare: a node
+// nested only through items. Nested through properties, which add two JSON
+// levels each, nodes can only be half as deep.
+const MaxSchemaDepth = MaxJSONDepth - schemaRootJSONDepth
+
+// NestingDepthError represents a schema node nested so deeply that a CRD
+// declaring it is deeper than MaxJSONDepth, so the apiserver cannot decode it.
+type NestingDepthError struct {
+	// Path represents the path to the schema node.
+	Path *field.Path
+	// Depth is the JSON depth of the schema node in the CRD.
+	Depth int
+}
+
+func (n *NestingDepthError) Error() string {
+	return fmt.Sprintf("schema node %q is nested %d levels deep in the CRD, more than the %d levels the apiserver decodes", n.Path.String(), n.Depth, MaxJSONDepth)
+}
+
+// CheckNestingDepth takes a schema and returns an error for every schema node
+// nested more than MaxJSONDepth levels deep in the JSON of its CRD, where
+// every property adds two levels, properties and the property itself, and
+// items and additionalProperties add one. Nodes beneath a reported node are
+// not reported. The custom resources of a schema are never nested more deeply
+// than its CRD, so this is the deepest a schema can usefully be.
+func CheckNestingDepth(schema *structuralschema.Structural) []*NestingDepthError {
+	return checkNestingDepth(schema, field.NewPath("spec", "validation", "openAPIV3Schema"))
+}
+
+func checkNestingDepth(schema *structuralschema.Structural, root *field.Path) []*NestingDepthError {
+	var depthErrors []*NestingDepthError
+	depths := map[*Node]int{}
+	walkFrom(schema, root, func(node *Node) bool {
+		depth := schemaRootJSONDepth
+		if parent := node.Parent(); parent != nil {
+			depth = depths[parent] + 2
+			if node.Schema == parent.Schema.Items || (parent.Schema.AdditionalProperties != nil && node.Schema == parent.Schema.AdditionalProperties.Structural) {
+				depth = depths[parent] + 1
+			}
+		}
+		if depth > MaxJSONDepth {
+			depthErrors = append(depthErrors, &NestingDepthError{Path: node.Path, Depth: depth})
+			return false
+		}
+		depths[node] = depth
+		return true
+	})
+	return depthErrors
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"testing"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// genNestedSchema wraps schema n times with wrap.
+func genNestedSchema(n int, schema *structuralschema.Structural, wrap func(*structuralschema.Structural) *structuralschema.Structural) *structuralschema.Structural {
+	for i := 0; i < n; i++ {
+		schema = wrap(schema)
+	}
+	return schema
+}
+
+// nestedPath returns path with n times the elements added by add.
+func nestedPath(n int, path *field.Path, add func(*field.Path) *field.Path) *field.Path {
+	for i := 0; i < n; i++ {
+		path = add(path)
+	}
+	return path
+}
+
+func TestCheckNestingDepth(t *testing.T) {
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	wrapList := func(schema *structuralschema.Structural) *structuralschema.Structural {
+		return genArraySchema(int64ptr(10), schema)
+	}
+	wrapObject := func(schema *structuralschema.Structural) *structuralschema.Structural {
+		return genRootSchema("p", schema)
+	}
+	addItems := func(path *field.Path) *field.Path {
+		return path.Child("items")
+	}
+	addProperty := func(path *field.Path) *field.Path {
+		return path.Child("properties").Key("p")
+	}
+	tests := []struct {
+		name           string
+		schema         *structuralschema.Structural
+		expectedErrors []*NestingDepthError
+	}{
+		{
+			name:           "shallow",
+			schema:         genRootSchema("list", genArraySchema(int64ptr(10), genStringSchema(nil))),
+			expectedErrors: []*NestingDepthError{},
+		},
+		{
+			// openAPIV3Schema is 6 levels deep, list 8 and each items one more
+			name:           "lists at the limit",
+			schema:         genRootSchema("list", genNestedSchema(MaxJSONDepth-8, genStringSchema(nil), wrapList)),
+			expectedErrors: []*NestingDepthError{},
+		},
+		{
+			name:   "lists beyond the limit",
+			schema: genRootSchema("list", genNestedSchema(MaxJSONDepth-6, genStringSchema(nil), wrapList)),
+			expectedErrors: []*NestingDepthError{
+				{Path: nestedPath(MaxJSONDepth-7, rootPath.Child("properties").Key("list"), addItems), Depth: MaxJSONDepth + 1},
+			},
+		},
+		{
+			name:           "properties at the default depth limit",
+			schema:         genNestedSchema(DefaultMaxDepth, genStringSchema(nil), wrapObject),
+			expectedErrors: []*NestingDepthError{},
+		},
+		{
+			// every property is two levels deeper than its object
+			name:   "properties beyond the limit",
+			schema: genNestedSchema((MaxJSONDepth-6)/2+1, genStringSchema(nil), wrapObject),
+			expectedErrors: []*NestingDepthError{
+				{Path: nestedPath((MaxJSONDepth-6)/2+1, rootPath, addProperty), Depth: MaxJSONDepth + 2},
+			},
+		},
+		{
+			name:   "map beyond the limit",
+			schema: genRootSchema("map", genMapSchema(int64ptr(10), genNestedSchema(MaxJSONDepth-8, genStringSchema(nil), wrapList))),
+			expectedErrors: []*NestingDepthError{
+				{Path: nestedPath(MaxJSONDepth-8, rootPath.Child("properties").Key("map").Child("additionalProperties"), addItems), Depth: MaxJSONDepth + 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			depthErrors := CheckNestingDepth(tt.schema)
+			if len(depthErrors) != len(tt.expectedErrors) {
+				t.Fatalf("Wrong number of errors (got %d, expected %d)", len(depthErrors), len(tt.expectedErrors))
+			}
+			for i, depthError := range depthErrors {
+				expected := tt.expectedErrors[i]
+				if depthError.Path.String() != expected.Path.String() || depthError.Depth != expected.Depth {
+					t.Errorf("Wrong error (expected depth %d at %s, got %d at %s)", expected.Depth, expected.Path, depthError.Depth, depthError.Path)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/google/cel-go/common/types"
+	api "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	schemacel "k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel"
+	celmodel "k8s.io/apiextensions-apiserver/third_party/forked/celopenapi/model"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ValueSource indicates where a value checked by CheckEnumExamples came from.
+type ValueSource int
+
+const (
+	// ValueSourceEnum represents a member of an enum list.
+	ValueSourceEnum ValueSource = iota
+	// ValueSourceExample represents an example value.
+	ValueSourceExample
+)
+
+// ValueRuleError represents an enum member or example value that can never
+// satisfy a validation rule declared on the same schema node.
+type ValueRuleError struct {
+	// Path represents the path to the enum member or example.
+	Path *field.Path
+	// RulePath represents the path to the rule the value does not satisfy.
+	RulePath *field.Path
+	// Source indicates whether the value is an enum member or an example.
+	Source ValueSource
+	// Value is the offending value.
+	Value interface{}
+	// EvalError is set if evaluating the rule against the value failed
+	// instead of returning false.
+	EvalError error
+}
+
+func (v *ValueRuleError) Error() string {
+	kind := "enum value"
+	if v.Source == ValueSourceExample {
+		kind = "example"
+	}
+	value, err := json.Marshal(v.Value)
+	if err != nil {
+		value = []byte(fmt.Sprintf("%v", v.Value))
+	}
+	if v.EvalError != nil {
+		return fmt.Sprintf("%s %s at %q cannot be evaluated by rule %q: %s", kind, value, v.Path.String(), v.RulePath.String(), v.EvalError)
+	}
+	return fmt.Sprintf("%s %s at %q never satisfies rule %q", kind, value, v.Path.String(), v.RulePath.String())
+}
+
+// CheckEnumExamples evaluates the validation rules of every schema node
+// against the enum members and example value declared on that node, and
+// returns an error for each value that fails a rule. Since such values can
+// never pass validation, they are either dead enum members or misleading
+// documentation. Examples are not part of structural schemas, so they are read
+// from props, which should be the schema the structural schema was built from;
+// if props is nil, only enum members are checked. Transition rules are
+// skipped, as they cannot be evaluated without an old value.
+func CheckEnumExamples(schema *structuralschema.Structural, props *api.JSONSchemaProps) []*ValueRuleError {
+	root := field.NewPath("spec", "validation", "openAPIV3Schema")
+	return checkEnumExamples(newRuleCompiler(schema, root), schema, props, root)
+}
+
+func checkEnumExamples(compiler *ruleCompiler, schema *structuralschema.Structural, props *api.JSONSchemaProps, root *field.Path) []*ValueRuleError {
+	var valueErrors []*ValueRuleError
+	// the props of the nodes visited, as the props of a node are found
+	// from the props of its parent
+	propsByNode := map[*Node]*api.JSONSchemaProps{}
+	walkFrom(schema, root, func(node *Node) bool {
+		nodeProps := props
+		if node.Parent() != nil {
+			nodeProps = childProps(propsByNode[node.Parent()], node)
+		}
+		propsByNode[node] = nodeProps
+		if len(node.Schema.Extensions.XValidations) == 0 {
+			return true
+		}
+		var values []interface{}
+		var valuePaths []*field.Path
+		var sources []ValueSource
+		if node.Schema.ValueValidation != nil {
+			for i, member := range node.Schema.ValueValidation.Enum {
+				values = append(values, member.Object)
+				valuePaths = append(valuePaths, node.Path.Child("enum").Index(i))
+				sources = append(sources, ValueSourceEnum)
+			}
+		}
+		if nodeProps != nil && nodeProps.Example != nil && *nodeProps.Example != nil {
+			values = append(values, *nodeProps.Example)
+			valuePaths = append(valuePaths, node.Path.Child("example"))
+			sources = append(sources, ValueSourceExample)
+		}
+		if len(values) > 0 {
+			// compilation errors are reported by CheckExprCost, so they
+			// are ignored here
+			results, err := compiler.compileRules(node.Schema, node.Path, node.IsResourceRoot)
+			if err == nil {
+				evalSchema := node.Schema
+				if node.IsResourceRoot {
+					evalSchema = celmodel.WithTypeAndObjectMeta(node.Schema)
+				}
+				for i, value := range values {
+					for ruleIndex, result := range results {
+						if result.Program == nil || result.TransitionRule {
+							continue
+						}
+						ok, evalErr := evalRule(result, evalSchema, normalizeJSONValue(value))
+						if ok {
+							continue
+						}
+						valueErrors = append(valueErrors, &ValueRuleError{
+							Path:      valuePaths[i],
+							RulePath:  node.Path.Child("x-kubernetes-validations").Index(ruleIndex).Child("rule"),
+							Source:    sources[i],
+							Value:     value,
+							EvalError: evalErr,
+						})
+					}
+				}
+			}
+		}
+		return true
+	})
+	return valueErrors
+}
+
+// childProps returns the props of node, a child of the node whose props are
+// parentProps, or nil if they are not known.
+func childProps(parentProps *api.JSONSchemaProps, node *Node) *api.JSONSchemaProps {
+	switch {
+	case parentProps == nil:
+		return nil
+	case node.property != nil:
+		if p, ok := parentProps.Properties[*node.property]; ok {
+			return &p
+		}
+	case node.Parent().Schema.Type == "array":
+		if parentProps.Items != nil {
+			return parentProps.Items.Schema
+		}
+	case parentProps.AdditionalProperties != nil:
+		return parentProps.AdditionalProperties.Schema
+	}
+	return nil
+}
+
+// evalRule evaluates a compiled rule against value, returning whether the
+// rule passed and any error encountered during evaluation.
+func evalRule(result schemacel.CompilationResult, schema *structuralschema.Structural, value interface{}) (bool, error) {
+	activation := schemacel.NewValidationActivation(value, nil, schema)
+	evalResult, _, err := result.Program.ContextEval(context.Background(), activation)
+	if err != nil {
+		return false, err
+	}
+	return evalResult == types.True, nil
+}
+
+// normalizeJSONValue converts whole float64 values produced by encoding/json
+// into int64 values, matching how the apiserver decodes custom resources.
+func normalizeJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float64:
+		// math.MaxInt64 rounds up to 2^63 as a float64, which overflows
+		// int64, while math.MinInt64 is exact
+		if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+			return int64(v)
+		}
+		return v
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, item := range v {
+			normalized[i] = normalizeJSONValue(item)
+		}
+		return normalized
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized[key] = normalizeJSONValue(item)
+		}
+		return normalized
+	}
+	return value
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	api "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func withEnum(schema *structuralschema.Structural, members ...interface{}) *structuralschema.Structural {
+	if schema.ValueValidation == nil {
+		schema.ValueValidation = &structuralschema.ValueValidation{}
+	}
+	for _, member := range members {
+		schema.ValueValidation.Enum = append(schema.ValueValidation.Enum, structuralschema.JSON{Object: member})
+	}
+	return schema
+}
+
+func genIntegerSchema() *structuralschema.Structural {
+	return &structuralschema.Structural{
+		Generic: structuralschema.Generic{
+			Type: "integer",
+		},
+	}
+}
+
+func exampleProps(example interface{}) *api.JSONSchemaProps {
+	json := api.JSON(example)
+	return &api.JSONSchemaProps{
+		Example: &json,
+	}
+}
+
+func TestEnumExamples(t *testing.T) {
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	tests := []struct {
+		name           string
+		schema         *structuralschema.Structural
+		props          *api.JSONSchemaProps
+		expectedErrors []*ValueRuleError
+	}{
+		{
+			name:           "allEnumMembersPass",
+			schema:         withRule(withEnum(genStringSchema(nil), "alpha", "apple"), `self.startsWith('a')`),
+			expectedErrors: []*ValueRuleError{},
+		},
+		{
+			name:   "deadEnumMember",
+			schema: withRule(withEnum(genStringSchema(nil), "alpha", "beta"), `self.startsWith('a')`),
+			expectedErrors: []*ValueRuleError{
+				{
+					Path:     rootPath.Child("enum").Index(1),
+					RulePath: rootPath.Child("x-kubernetes-validations").Index(0).Child("rule"),
+					Source:   ValueSourceEnum,
+					Value:    "beta",
+				},
+			},
+		},
+		{
+			name:   "integerEnumFromJSON",
+			schema: withRule(withEnum(genIntegerSchema(), float64(2), float64(20)), `self < 10`),
+			expectedErrors: []*ValueRuleError{
+				{
+					Path:     rootPath.Child("enum").Index(1),
+					RulePath: rootPath.Child("x-kubernetes-validations").Index(0).Child("rule"),
+					Source:   ValueSourceEnum,
+					Value:    float64(20),
+				},
+			},
+		},
+		{
+			name:   "misleadingExample",
+			schema: withRule(genStringSchema(nil), `self.size() <= 3`),
+			props:  exampleProps("too long"),
+			expectedErrors: []*ValueRuleError{
+				{
+					Path:     rootPath.Child("example"),
+					RulePath: rootPath.Child("x-kubernetes-validations").Index(0).Child("rule"),
+					Source:   ValueSourceExample,
+					Value:    "too long",
+				},
+			},
+		},
+		{
+			name:   "nestedExample",
+			schema: genRootSchema("name", withRule(genStringSchema(nil), `self == 'ok'`)),
+			props: &api.JSONSchemaProps{
+				Properties: map[string]api.JSONSchemaProps{
+					"name": *exampleProps("not ok"),
+				},
+			},
+			expectedErrors: []*ValueRuleError{
+				{
+					Path:     rootPath.Child("properties").Key("name").Child("example"),
+					RulePath: rootPath.Child("properties").Key("name").Child("x-kubernetes-validations").Index(0).Child("rule"),
+					Source:   ValueSourceExample,
+					Value:    "not ok",
+				},
+			},
+		},
+		{
+			name:           "transitionRuleSkipped",
+			schema:         withRule(withEnum(genStringSchema(nil), "a", "b"), `self == oldSelf`),
+			expectedErrors: []*ValueRuleError{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors := CheckEnumExamples(test.schema, test.props)
+			if len(errors) != len(test.expectedErrors) {
+				t.Fatalf("Wrong number of expected errors (got %v, expected %v)", errors, test.expectedErrors)
+			}
+			for i, seenError := range errors {
+				expectedError := test.expectedErrors[i]
+				if !valueRuleErrorsEqual(seenError, expectedError) {
+					t.Errorf("Wrong error (expected %v, got %v)", expectedError, seenError)
+				}
+			}
+		})
+	}
+}
+
+func valueRuleErrorsEqual(x, y *ValueRuleError) bool {
+	return x.Path.String() == y.Path.String() && x.RulePath.String() == y.RulePath.String() && x.Source == y.Source && x.Value == y.Value
+}
+
+func TestNormalizeJSONValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected interface{}
+	}{
+		{name: "whole", value: float64(3), expected: int64(3)},
+		{name: "fraction", value: 3.5, expected: 3.5},
+		{name: "minInt64", value: float64(math.MinInt64), expected: int64(math.MinInt64)},
+		// float64(math.MaxInt64) is 2^63
+		{name: "beyondMaxInt64", value: float64(math.MaxInt64), expected: float64(math.MaxInt64)},
+		{name: "largestBelowMaxInt64", value: math.Nextafter(float64(math.MaxInt64), 0), expected: int64(math.Nextafter(float64(math.MaxInt64), 0))},
+		{name: "nested", value: map[string]interface{}{"list": []interface{}{float64(1), "a"}}, expected: map[string]interface{}{"list": []interface{}{int64(1), "a"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if normalized := normalizeJSONValue(tt.value); !reflect.DeepEqual(normalized, tt.expected) {
+				t.Errorf("Wrong value (expected %#v, got %#v)", tt.expected, normalized)
+			}
+		})
+	}
+}
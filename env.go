@@ -0,0 +1,239 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker"
+	"github.com/google/cel-go/checker/decls"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/protobuf/proto"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	schemacel "k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel/library"
+	celmodel "k8s.io/apiextensions-apiserver/third_party/forked/celopenapi/model"
+)
+
+// code below is adapted from k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel/compilation.go
+// Compile there builds the CEL environment of a schema node and compiles its
+// rules in one go, and only accepts expressions returning bool; it is split
+// here so that expressions other than rules, such as messageExpression, can
+// be compiled in the same environment.
+
+// scopedTypeName is the type name of self. The apiserver generates a unique
+// name to keep rules from depending on it; a fixed one is fine for linting.
+const scopedTypeName = "selfType"
+
+// checkFrequency is the number of comprehension iterations between checks
+// for interruption, matching the apiserver.
+const checkFrequency = 100
+
+// ruleEnv is the CEL environment of the rules declared on a schema node.
+type ruleEnv struct {
+	env            *cel.Env
+	estimator      *library.CostEstimator
+	maxCardinality uint64
+}
+
+// newRuleEnv returns the CEL environment of the rules declared on schema,
+// declaring self and oldSelf the same way the apiserver does.
+func newRuleEnv(schema *structuralschema.Structural, isResourceRoot bool) (*ruleEnv, error) {
+	env, err := cel.NewEnv(
+		cel.HomogeneousAggregateLiterals(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	reg := celmodel.NewRegistry(env)
+	rt, err := celmodel.NewRuleTypes(scopedTypeName, schema, isResourceRoot, reg)
+	if err != nil {
+		return nil, err
+	}
+	if rt == nil {
+		return nil, fmt.Errorf("rule declared on schema that does not support validation rules type: '%s' x-kubernetes-preserve-unknown-fields: '%t'", schema.Type, schema.XPreserveUnknownFields)
+	}
+	opts, err := rt.EnvOptions(env.TypeProvider())
+	if err != nil {
+		return nil, err
+	}
+	root, ok := rt.FindDeclType(scopedTypeName)
+	if !ok {
+		rootDecl := celmodel.SchemaDeclType(schema, isResourceRoot)
+		if rootDecl == nil {
+			return nil, fmt.Errorf("rule declared on schema that does not support validation rules type: '%s' x-kubernetes-preserve-unknown-fields: '%t'", schema.Type, schema.XPreserveUnknownFields)
+		}
+		root = rootDecl.MaybeAssignTypeName(scopedTypeName)
+	}
+	opts = append(opts, cel.HomogeneousAggregateLiterals())
+	opts = append(opts, library.ExtensionLibs...)
+	env, err = env.Extend(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return extendRuleEnv(env, root, schema)
+}
+
+// extendRuleEnv returns the CEL environment of the rules declared on schema,
+// whose type is selfType, from env, an environment that knows selfType and
+// declares the extension libraries.
+func extendRuleEnv(env *cel.Env, selfType *celmodel.DeclType, schema *structuralschema.Structural) (*ruleEnv, error) {
+	env, err := env.Extend(cel.Declarations(
+		decls.NewVar(schemacel.ScopedVarName, selfType.ExprType()),
+		decls.NewVar(schemacel.OldScopedVarName, selfType.ExprType()),
+	))
+	if err != nil {
+		return nil, err
+	}
+	return &ruleEnv{
+		env:            env,
+		estimator:      &library.CostEstimator{SizeEstimator: &sizeEstimator{roots: map[string]*celmodel.DeclType{schemacel.ScopedVarName: selfType, schemacel.OldScopedVarName: selfType}, fallback: selfType}},
+		maxCardinality: celmodel.MaxCardinality(schema),
+	}, nil
+}
+
+// compile compiles source, which must evaluate to one of resultTypes (or to
+// anything if none are given), and estimates its cost. The result has the same
+// semantics as the results of schemacel.Compile.
+func (r *ruleEnv) compile(source string, resultTypes ...*expr.Type) (result schemacel.CompilationResult) {
+	if len(strings.TrimSpace(source)) == 0 {
+		return
+	}
+	ast, issues := r.env.Compile(source)
+	if issues != nil {
+		result.Error = &schemacel.Error{Type: schemacel.ErrorTypeInvalid, Detail: "compilation failed: " + issues.String()}
+		return
+	}
+	if len(resultTypes) > 0 && !hasType(ast.ResultType(), resultTypes) {
+		var names []string
+		for _, resultType := range resultTypes {
+			names = append(names, typeName(resultType))
+		}
+		result.Error = &schemacel.Error{Type: schemacel.ErrorTypeInvalid, Detail: fmt.Sprintf("cel expression must evaluate to a %s", strings.Join(names, " or "))}
+		return
+	}
+	checkedExpr, err := cel.AstToCheckedExpr(ast)
+	if err != nil {
+		// should be impossible since env.Compile returned no issues
+		result.Error = &schemacel.Error{Type: schemacel.ErrorTypeInternal, Detail: "unexpected compilation error: " + err.Error()}
+		return
+	}
+	for _, ref := range checkedExpr.ReferenceMap {
+		if ref.Name == schemacel.OldScopedVarName {
+			result.TransitionRule = true
+			break
+		}
+	}
+	prog, err := r.env.Program(ast,
+		cel.EvalOptions(cel.OptOptimize, cel.OptTrackCost),
+		cel.CostLimit(schemacel.PerCallLimit),
+		cel.CostTracking(r.estimator),
+		cel.OptimizeRegex(library.ExtensionLibRegexOptimizations...),
+		cel.InterruptCheckFrequency(checkFrequency),
+	)
+	if err != nil {
+		result.Error = &schemacel.Error{Type: schemacel.ErrorTypeInvalid, Detail: "program instantiation failed: " + err.Error()}
+		return
+	}
+	costEst, err := r.env.EstimateCost(ast, r.estimator)
+	if err != nil {
+		result.Error = &schemacel.Error{Type: schemacel.ErrorTypeInternal, Detail: "cost estimation failed: " + err.Error()}
+		return
+	}
+	result.MaxCost = costEst.Max
+	result.MaxCardinality = r.maxCardinality
+	result.Program = prog
+	return
+}
+
+// hasType returns true if t is one of types.
+func hasType(t *expr.Type, types []*expr.Type) bool {
+	for _, candidate := range types {
+		if proto.Equal(t, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// typeName returns the CEL name of the primitive type t.
+func typeName(t *expr.Type) string {
+	switch {
+	case proto.Equal(t, decls.Bool):
+		return "bool"
+	case proto.Equal(t, decls.String):
+		return "string"
+	case proto.Equal(t, decls.Null):
+		return "null"
+	}
+	return t.String()
+}
+
+// sizeEstimator estimates the size of the values of the variables in roots.
+// Unlike the apiserver's, which only knows about self, it supports several
+// variables, as admission expressions have object, oldObject, params and so
+// on.
+type sizeEstimator struct {
+	roots map[string]*celmodel.DeclType
+	// fallback, if set, is the type of the variables not in roots. The
+	// apiserver estimates the size of every variable of a rule, including
+	// comprehension variables, as if it were self, and rule costs must match
+	// its estimates.
+	fallback *celmodel.DeclType
+}
+
+func (c *sizeEstimator) EstimateSize(element checker.AstNode) *checker.SizeEstimate {
+	if len(element.Path()) == 0 {
+		// Path() can return an empty list, early exit if it does since we can't
+		// provide size estimates when that happens
+		return nil
+	}
+	currentNode, ok := c.roots[element.Path()[0]]
+	if !ok {
+		if c.fallback == nil {
+			return nil
+		}
+		currentNode = c.fallback
+	}
+	for _, name := range element.Path()[1:] {
+		switch name {
+		case "@items", "@values":
+			if currentNode.ElemType == nil {
+				return nil
+			}
+			currentNode = currentNode.ElemType
+		case "@keys":
+			if currentNode.KeyType == nil {
+				return nil
+			}
+			currentNode = currentNode.KeyType
+		default:
+			field, ok := currentNode.Fields[name]
+			if !ok {
+				return nil
+			}
+			if field.Type == nil {
+				return nil
+			}
+			currentNode = field.Type
+		}
+	}
+	return &checker.SizeEstimate{Min: 0, Max: uint64(currentNode.MaxElements)}
+}
+
+func (c *sizeEstimator) EstimateCallCost(function, overloadID string, target *checker.AstNode, args []checker.AstNode) *checker.CallEstimate {
+	return nil
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	schemacel "k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// FreeFormReferenceError represents a rule that references a free-form schema
+// node: a map declared with additionalProperties: true, or an object with
+// x-kubernetes-preserve-unknown-fields and no declared properties. The
+// contents of such nodes are neither typed nor bounded by the schema, so the
+// cost of rules reaching into them cannot be estimated meaningfully.
+type FreeFormReferenceError struct {
+	// Path represents the path to the rule.
+	Path *field.Path
+	// TargetPath represents the path to the free-form schema node.
+	TargetPath *field.Path
+}
+
+func (f *FreeFormReferenceError) Error() string {
+	return fmt.Sprintf("rule %q references free-form schema %q whose contents are untyped and unbounded; declare the properties it relies on, with maxLength/maxItems/maxProperties limits", f.Path.String(), f.TargetPath.String())
+}
+
+// CheckFreeFormReferences takes a schema and returns an error for every
+// rule that references a free-form map or an object preserving unknown
+// fields, either directly or through fields selected from it.
+func CheckFreeFormReferences(schema *structuralschema.Structural) []*FreeFormReferenceError {
+	return checkFreeFormReferences(schema, field.NewPath("spec", "validation", "openAPIV3Schema"))
+}
+
+func checkFreeFormReferences(schema *structuralschema.Structural, root *field.Path) []*FreeFormReferenceError {
+	var referenceErrors []*FreeFormReferenceError
+	walkFrom(schema, root, func(node *Node) bool {
+		for i, rule := range node.Schema.Extensions.XValidations {
+			ast, err := parseRule(rule.Rule)
+			if err != nil {
+				// reported by CheckExprCost as a compilation error
+				continue
+			}
+			scope := map[string]schemaRef{
+				schemacel.ScopedVarName:    {Schema: node.Schema, Path: node.Path},
+				schemacel.OldScopedVarName: {Schema: node.Schema, Path: node.Path},
+			}
+			reported := map[string]bool{}
+			visitSchemaRefs(ast.Expr(), scope, func(e *expr.Expr, ref schemaRef) {
+				if !isFreeForm(ref.Schema) || reported[ref.Path.String()] {
+					return
+				}
+				reported[ref.Path.String()] = true
+				referenceErrors = append(referenceErrors, &FreeFormReferenceError{
+					Path:       node.Path.Child("x-kubernetes-validations").Index(i).Child("rule"),
+					TargetPath: ref.Path,
+				})
+			})
+		}
+		return true
+	})
+	return referenceErrors
+}
+
+// isFreeForm returns true if schema is a map declared with
+// additionalProperties: true, or an object with
+// x-kubernetes-preserve-unknown-fields and no declared properties.
+func isFreeForm(schema *structuralschema.Structural) bool {
+	if schema.Type != "object" && schema.Type != "" {
+		return false
+	}
+	if schema.AdditionalProperties != nil {
+		return schema.AdditionalProperties.Structural == nil && schema.AdditionalProperties.Bool
+	}
+	return schema.XPreserveUnknownFields && !schema.XEmbeddedResource && len(schema.Properties) == 0
+}
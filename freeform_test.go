@@ -0,0 +1,105 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"testing"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func genFreeFormMapSchema() *structuralschema.Structural {
+	return &structuralschema.Structural{
+		Generic: structuralschema.Generic{
+			Type: "object",
+			AdditionalProperties: &structuralschema.StructuralOrBool{
+				Bool: true,
+			},
+		},
+	}
+}
+
+func genUnknownFieldsSchema() *structuralschema.Structural {
+	return &structuralschema.Structural{
+		Generic: structuralschema.Generic{
+			Type: "object",
+		},
+		Extensions: structuralschema.Extensions{
+			XPreserveUnknownFields: true,
+		},
+	}
+}
+
+func TestFreeFormReferences(t *testing.T) {
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	rulePath := rootPath.Child("x-kubernetes-validations").Index(0).Child("rule")
+	tests := []struct {
+		name           string
+		schema         *structuralschema.Structural
+		expectedErrors []*FreeFormReferenceError
+	}{
+		{
+			name:           "typedReference",
+			schema:         withRule(genRootSchema("name", genStringSchema(int64ptr(10))), `self.name == 'a'`),
+			expectedErrors: []*FreeFormReferenceError{},
+		},
+		{
+			name:   "selectIntoUnknownFields",
+			schema: withRule(genRootSchema("config", genUnknownFieldsSchema()), `self.config.foo.bar == 'a'`),
+			expectedErrors: []*FreeFormReferenceError{
+				{Path: rulePath, TargetPath: rootPath.Child("properties").Key("config")},
+			},
+		},
+		{
+			name:   "indexIntoFreeFormMap",
+			schema: withRule(genRootSchema("labels", genFreeFormMapSchema()), `self.labels['a'] == 'b'`),
+			expectedErrors: []*FreeFormReferenceError{
+				{Path: rulePath, TargetPath: rootPath.Child("properties").Key("labels")},
+			},
+		},
+		{
+			name: "macroVariableIntoUnknownFields",
+			schema: withRule(genRootSchema("list", genArraySchema(int64ptr(5), genRootSchema("config", genUnknownFieldsSchema()))),
+				`self.list.all(x, has(x.config.foo))`),
+			expectedErrors: []*FreeFormReferenceError{
+				{Path: rulePath, TargetPath: rootPath.Child("properties").Key("list").Child("items", "properties").Key("config")},
+			},
+		},
+		{
+			name:   "ruleOnFreeFormNode",
+			schema: genRootSchema("config", withRule(genUnknownFieldsSchema(), `has(self.foo)`)),
+			expectedErrors: []*FreeFormReferenceError{
+				{
+					Path:       rootPath.Child("properties").Key("config").Child("x-kubernetes-validations").Index(0).Child("rule"),
+					TargetPath: rootPath.Child("properties").Key("config"),
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors := CheckFreeFormReferences(test.schema)
+			if len(errors) != len(test.expectedErrors) {
+				t.Fatalf("Wrong number of expected errors (got %v, expected %v)", errors, test.expectedErrors)
+			}
+			for i, seenError := range errors {
+				expectedError := test.expectedErrors[i]
+				if seenError.Path.String() != expectedError.Path.String() || seenError.TargetPath.String() != expectedError.TargetPath.String() {
+					t.Errorf("Wrong error (expected %v, got %v)", expectedError, seenError)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command snapshot generates the OpenAPI v3 snapshot of built-in Kubernetes
+// types that celvet uses to type-check admission expressions offline. Schemas
+// are derived by reflection from the k8s.io/api types celvet is built
+// against, so they carry types and structure but no descriptions or
+// validations.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// resource is a built-in resource included in the snapshot.
+type resource struct {
+	Group    string `json:"group"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	Kind     string `json:"kind"`
+	Schema   string `json:"schema"`
+	obj      interface{}
+}
+
+var resources = []resource{
+	{Version: "v1", Resource: "pods", Kind: "Pod", obj: corev1.Pod{}},
+	{Version: "v1", Resource: "services", Kind: "Service", obj: corev1.Service{}},
+	{Version: "v1", Resource: "configmaps", Kind: "ConfigMap", obj: corev1.ConfigMap{}},
+	{Version: "v1", Resource: "secrets", Kind: "Secret", obj: corev1.Secret{}},
+	{Version: "v1", Resource: "namespaces", Kind: "Namespace", obj: corev1.Namespace{}},
+	{Version: "v1", Resource: "serviceaccounts", Kind: "ServiceAccount", obj: corev1.ServiceAccount{}},
+	{Version: "v1", Resource: "persistentvolumeclaims", Kind: "PersistentVolumeClaim", obj: corev1.PersistentVolumeClaim{}},
+	{Group: "apps", Version: "v1", Resource: "deployments", Kind: "Deployment", obj: appsv1.Deployment{}},
+	{Group: "apps", Version: "v1", Resource: "statefulsets", Kind: "StatefulSet", obj: appsv1.StatefulSet{}},
+	{Group: "apps", Version: "v1", Resource: "daemonsets", Kind: "DaemonSet", obj: appsv1.DaemonSet{}},
+	{Group: "apps", Version: "v1", Resource: "replicasets", Kind: "ReplicaSet", obj: appsv1.ReplicaSet{}},
+	{Group: "batch", Version: "v1", Resource: "jobs", Kind: "Job", obj: batchv1.Job{}},
+	{Group: "batch", Version: "v1", Resource: "cronjobs", Kind: "CronJob", obj: batchv1.CronJob{}},
+	{Group: "networking.k8s.io", Version: "v1", Resource: "ingresses", Kind: "Ingress", obj: networkingv1.Ingress{}},
+	{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies", Kind: "NetworkPolicy", obj: networkingv1.NetworkPolicy{}},
+	{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "roles", Kind: "Role", obj: rbacv1.Role{}},
+	{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "rolebindings", Kind: "RoleBinding", obj: rbacv1.RoleBinding{}},
+	{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles", Kind: "ClusterRole", obj: rbacv1.ClusterRole{}},
+	{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterrolebindings", Kind: "ClusterRoleBinding", obj: rbacv1.ClusterRoleBinding{}},
+	{Group: "policy", Version: "v1", Resource: "poddisruptionbudgets", Kind: "PodDisruptionBudget", obj: policyv1.PodDisruptionBudget{}},
+	{Group: "autoscaling", Version: "v2", Resource: "horizontalpodautoscalers", Kind: "HorizontalPodAutoscaler", obj: autoscalingv2.HorizontalPodAutoscaler{}},
+}
+
+// extraTypes are included in the snapshot without being resources.
+var extraTypes = []interface{}{
+	admissionv1.AdmissionRequest{},
+}
+
+// specialSchemas maps types with custom JSON encodings to their schemas.
+var specialSchemas = map[string]map[string]interface{}{
+	"k8s.io/apimachinery/pkg/apis/meta/v1.Time":       {"type": "string", "format": "date-time"},
+	"k8s.io/apimachinery/pkg/apis/meta/v1.MicroTime":  {"type": "string", "format": "date-time"},
+	"k8s.io/apimachinery/pkg/apis/meta/v1.Duration":   {"type": "string"},
+	"k8s.io/apimachinery/pkg/apis/meta/v1.FieldsV1":   {"type": "object", "x-kubernetes-preserve-unknown-fields": true},
+	"k8s.io/apimachinery/pkg/api/resource.Quantity":   {"x-kubernetes-int-or-string": true},
+	"k8s.io/apimachinery/pkg/util/intstr.IntOrString": {"x-kubernetes-int-or-string": true},
+	"k8s.io/apimachinery/pkg/runtime.RawExtension":    {"type": "object", "x-kubernetes-preserve-unknown-fields": true, "x-kubernetes-embedded-resource": true},
+}
+
+type generator struct {
+	schemas map[string]map[string]interface{}
+}
+
+// schemaName returns the OpenAPI name of t, e.g. io.k8s.api.core.v1.Pod for
+// the Pod type of k8s.io/api/core/v1.
+func schemaName(t reflect.Type) string {
+	return "io.k8s." + strings.ReplaceAll(strings.TrimPrefix(t.PkgPath(), "k8s.io/"), "/", ".") + "." + t.Name()
+}
+
+func (g *generator) schemaFor(t reflect.Type) map[string]interface{} {
+	if t.Name() != "" && t.PkgPath() != "" {
+		if special, ok := specialSchemas[t.PkgPath()+"."+t.Name()]; ok {
+			return special
+		}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schemaFor(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schemaFor(t.Elem())}
+	case reflect.Interface:
+		return map[string]interface{}{"x-kubernetes-preserve-unknown-fields": true}
+	case reflect.Struct:
+		name := schemaName(t)
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+		if _, ok := g.schemas[name]; ok {
+			return ref
+		}
+		schema := map[string]interface{}{"type": "object"}
+		// register before walking the fields, so recursive types refer to
+		// themselves
+		g.schemas[name] = schema
+		properties := map[string]interface{}{}
+		g.addFields(t, properties)
+		if len(properties) > 0 {
+			schema["properties"] = properties
+		}
+		return ref
+	}
+	panic(fmt.Sprintf("unsupported type %s", t))
+}
+
+// addFields adds the JSON fields of the struct t to properties.
+func (g *generator) addFields(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		inline := false
+		for _, option := range tag[1:] {
+			inline = inline || option == "inline"
+		}
+		if inline || (f.Anonymous && name == "") {
+			g.addFields(f.Type, properties)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = g.schemaFor(f.Type)
+	}
+}
+
+func main() {
+	output := flag.StringP("output", "o", "", "file to write the snapshot to")
+	flag.Parse()
+
+	g := &generator{schemas: map[string]map[string]interface{}{}}
+	var snapshotResources []resource
+	for _, r := range resources {
+		t := reflect.TypeOf(r.obj)
+		g.schemaFor(t)
+		r.Schema = schemaName(t)
+		g.schemas[r.Schema]["x-kubernetes-group-version-kind"] = []map[string]string{{"group": r.Group, "version": r.Version, "kind": r.Kind}}
+		snapshotResources = append(snapshotResources, r)
+	}
+	for _, obj := range extraTypes {
+		g.schemaFor(reflect.TypeOf(obj))
+	}
+	sort.Slice(snapshotResources, func(i, j int) bool { return snapshotResources[i].Schema < snapshotResources[j].Schema })
+
+	document := map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "Kubernetes built-in types",
+			"version": "v1.24",
+		},
+		"x-celvet-resources": snapshotResources,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+		},
+	}
+	data, err := json.MarshalIndent(document, "", " ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error encoding snapshot: %s\n", err)
+		os.Exit(1)
+	}
+	data = append(data, '\n')
+	if *output == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing snapshot: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// JunctorLimitError represents a maxItems, maxProperties or maxLength limit
+// that is only declared inside an allOf, anyOf or oneOf junctor. Cost
+// estimation only considers limits declared directly on a schema node, so
+// such limits do not reduce the estimated cost of any rule. Limits inside not
+// are lower bounds rather than limits, and are not reported.
+type JunctorLimitError struct {
+	// Path represents the path to the limit inside the junctor. For anyOf and
+	// oneOf, it is the path to the largest of the limits of their branches.
+	Path *field.Path
+	// TargetPath represents the path to the schema node the limit should be
+	// declared on instead.
+	TargetPath *field.Path
+	// Junctor is the outermost junctor containing the limit: "allOf",
+	// "anyOf" or "oneOf".
+	Junctor string
+	// Keyword is the limit: "maxItems", "maxProperties" or "maxLength".
+	Keyword string
+	// Value is the value of the limit. For anyOf and oneOf, every branch
+	// declares a limit, and Value is the largest, so that declaring it on the
+	// target does not reject values any branch allows.
+	Value int64
+}
+
+func (j *JunctorLimitError) Error() string {
+	if j.Junctor == "allOf" {
+		return fmt.Sprintf("%s at %q is only declared inside allOf and does not bound cost estimation; move it to %q as %s: %d", j.Keyword, j.Path.String(), j.TargetPath.String(), j.Keyword, j.Value)
+	}
+	return fmt.Sprintf("%s at %q is only declared inside every branch of %s and does not bound cost estimation; declare %s: %d, the largest of the branches, on %q", j.Keyword, j.Path.String(), j.Junctor, j.Keyword, j.Value, j.TargetPath.String())
+}
+
+// CheckJunctorLimits takes a schema and returns an error for every
+// maxItems, maxProperties and maxLength limit that is declared inside a
+// junctor without also being declared directly on the schema node it
+// applies to. Limits declared in anyOf and oneOf are only reported if every
+// branch declares one.
+func CheckJunctorLimits(schema *structuralschema.Structural) []*JunctorLimitError {
+	return checkJunctorLimits(schema, field.NewPath("spec", "validation", "openAPIV3Schema"))
+}
+
+func checkJunctorLimits(schema *structuralschema.Structural, root *field.Path) []*JunctorLimitError {
+	var limitErrors []*JunctorLimitError
+	walkFrom(schema, root, func(node *Node) bool {
+		if node.Schema.ValueValidation == nil {
+			return true
+		}
+		report := func(junctor string, limits []junctorLimit) {
+			for _, limit := range limits {
+				if limit.declaredOnTarget() {
+					continue
+				}
+				limitErrors = append(limitErrors, &JunctorLimitError{
+					Path:       limit.path,
+					TargetPath: limit.targetPath,
+					Junctor:    junctor,
+					Keyword:    limit.keyword,
+					Value:      limit.value,
+				})
+			}
+		}
+		report("allOf", junctorLimits("allOf", node.Schema.ValueValidation.AllOf, node.Path.Child("allOf"), node.Schema, node.Path))
+		report("anyOf", junctorLimits("anyOf", node.Schema.ValueValidation.AnyOf, node.Path.Child("anyOf"), node.Schema, node.Path))
+		report("oneOf", junctorLimits("oneOf", node.Schema.ValueValidation.OneOf, node.Path.Child("oneOf"), node.Schema, node.Path))
+		return true
+	})
+	return limitErrors
+}
+
+// junctorLimit is a limit that a junctor imposes on a schema node.
+type junctorLimit struct {
+	// path is the path to the limit inside the junctor
+	path *field.Path
+	// target is the schema node the limit applies to, at targetPath
+	target     *structuralschema.Structural
+	targetPath *field.Path
+	keyword    string
+	value      int64
+}
+
+// declaredOnTarget returns true if the target of l declares a limit with the
+// keyword of l.
+func (l junctorLimit) declaredOnTarget() bool {
+	if l.target.ValueValidation == nil {
+		return false
+	}
+	switch l.keyword {
+	case "maxItems":
+		return l.target.ValueValidation.MaxItems != nil
+	case "maxProperties":
+		return l.target.ValueValidation.MaxProperties != nil
+	default:
+		return l.target.ValueValidation.MaxLength != nil
+	}
+}
+
+// key identifies the target and keyword of l.
+func (l junctorLimit) key() string {
+	return l.targetPath.String() + "/" + l.keyword
+}
+
+// junctorLimits returns the limits imposed on target, the node at targetPath,
+// by the branches of junctor ("allOf", "anyOf" or "oneOf") at path. Values
+// must satisfy every branch of allOf, so all their limits apply. Values need
+// only satisfy one branch of anyOf or oneOf, so a node is only bounded if
+// every branch bounds it, and then by the largest of their limits.
+// junctorLimits does not recurse, so it handles junctors and schemas nested to
+// any depth.
+func junctorLimits(junctor string, branches []structuralschema.NestedValueValidation, path *field.Path, target *structuralschema.Structural, targetPath *field.Path) []junctorLimit {
+	root := &limitsFrame{junctor: junctor, branches: branches, path: path, target: target, targetPath: targetPath}
+	// frames are created after their parents, so going through them in
+	// reverse sets the limits of children before those of their parents
+	frames := []*limitsFrame{root}
+	for i := 0; i < len(frames); i++ {
+		frames[i].children = frames[i].childFrames()
+		frames = append(frames, frames[i].children...)
+	}
+	for i := len(frames) - 1; i >= 0; i-- {
+		frames[i].setLimits()
+	}
+	return root.limits
+}
+
+// limitsFrame is a junctor, or a branch of one or a value validation nested
+// in a branch, whose limits are set by junctorLimits.
+type limitsFrame struct {
+	// junctor is "allOf", "anyOf" or "oneOf" for junctors, whose branches
+	// are their children, and empty for the value validation nested.
+	junctor  string
+	branches []structuralschema.NestedValueValidation
+	nested   *structuralschema.NestedValueValidation
+	// path is the path to the frame; target is the schema node it applies
+	// to, at targetPath.
+	path       *field.Path
+	target     *structuralschema.Structural
+	targetPath *field.Path
+
+	children []*limitsFrame
+	limits   []junctorLimit
+}
+
+// childFrames returns the branches of a junctor, or the junctors, items and
+// properties of a nested value validation. not junctors are skipped: the
+// limits inside them are lower bounds.
+func (f *limitsFrame) childFrames() []*limitsFrame {
+	if f.target == nil {
+		return nil
+	}
+	var children []*limitsFrame
+	if f.junctor != "" {
+		for i := range f.branches {
+			children = append(children, &limitsFrame{nested: &f.branches[i], path: f.path.Index(i), target: f.target, targetPath: f.targetPath})
+		}
+		return children
+	}
+	children = append(children,
+		&limitsFrame{junctor: "allOf", branches: f.nested.AllOf, path: f.path.Child("allOf"), target: f.target, targetPath: f.targetPath},
+		&limitsFrame{junctor: "anyOf", branches: f.nested.AnyOf, path: f.path.Child("anyOf"), target: f.target, targetPath: f.targetPath},
+		&limitsFrame{junctor: "oneOf", branches: f.nested.OneOf, path: f.path.Child("oneOf"), target: f.target, targetPath: f.targetPath},
+	)
+	if f.nested.Items != nil {
+		children = append(children, &limitsFrame{nested: f.nested.Items, path: f.path.Child("items"), target: f.target.Items, targetPath: f.targetPath.Child("items")})
+	}
+	for _, propName := range sortedKeys(f.nested.Properties) {
+		n := f.nested.Properties[propName]
+		if propSchema, ok := f.target.Properties[propName]; ok {
+			children = append(children, &limitsFrame{nested: &n, path: f.path.Child("properties").Key(propName), target: &propSchema, targetPath: f.targetPath.Child("properties").Key(propName)})
+		}
+	}
+	return children
+}
+
+// setLimits sets the limits of f from those of its children, which must
+// already be set.
+func (f *limitsFrame) setLimits() {
+	if f.target == nil {
+		return
+	}
+	switch f.junctor {
+	case "anyOf", "oneOf":
+		var branchLimits [][]junctorLimit
+		for _, child := range f.children {
+			branchLimits = append(branchLimits, child.limits)
+		}
+		f.limits = anyOfBounds(branchLimits)
+	case "":
+		addLimit := func(keyword string, limit *int64) {
+			if limit != nil {
+				f.limits = append(f.limits, junctorLimit{path: f.path.Child(keyword), target: f.target, targetPath: f.targetPath, keyword: keyword, value: *limit})
+			}
+		}
+		addLimit("maxItems", f.nested.MaxItems)
+		addLimit("maxProperties", f.nested.MaxProperties)
+		addLimit("maxLength", f.nested.MaxLength)
+		fallthrough
+	default:
+		for _, child := range f.children {
+			f.limits = append(f.limits, child.limits...)
+		}
+	}
+	// the limits of the children are no longer needed
+	f.children = nil
+}
+
+// anyOfBounds returns the limits imposed by anyOf or oneOf branches with
+// branchLimits: those bounding a node in every branch, by the largest of
+// their values.
+func anyOfBounds(branchLimits [][]junctorLimit) []junctorLimit {
+	if len(branchLimits) == 0 {
+		return nil
+	}
+	var keys []string
+	var bounds []map[string]junctorLimit
+	for i, limits := range branchLimits {
+		// a branch is bounded by the smallest of its own limits
+		branchBounds := map[string]junctorLimit{}
+		for _, limit := range limits {
+			bound, ok := branchBounds[limit.key()]
+			if !ok && i == 0 {
+				keys = append(keys, limit.key())
+			}
+			if !ok || limit.value < bound.value {
+				branchBounds[limit.key()] = limit
+			}
+		}
+		bounds = append(bounds, branchBounds)
+	}
+	var limits []junctorLimit
+	for _, key := range keys {
+		limit := bounds[0][key]
+		bounded := true
+		for _, branchBounds := range bounds[1:] {
+			bound, ok := branchBounds[key]
+			if !ok {
+				bounded = false
+				break
+			}
+			if bound.value > limit.value {
+				limit = bound
+			}
+		}
+		if bounded {
+			limits = append(limits, limit)
+		}
+	}
+	return limits
+}
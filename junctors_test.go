@@ -0,0 +1,196 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"testing"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func withJunctor(schema *structuralschema.Structural, junctor string, nested structuralschema.NestedValueValidation) *structuralschema.Structural {
+	if schema.ValueValidation == nil {
+		schema.ValueValidation = &structuralschema.ValueValidation{}
+	}
+	switch junctor {
+	case "allOf":
+		schema.ValueValidation.AllOf = append(schema.ValueValidation.AllOf, nested)
+	case "anyOf":
+		schema.ValueValidation.AnyOf = append(schema.ValueValidation.AnyOf, nested)
+	case "oneOf":
+		schema.ValueValidation.OneOf = append(schema.ValueValidation.OneOf, nested)
+	case "not":
+		schema.ValueValidation.Not = &nested
+	}
+	return schema
+}
+
+// nestedAllOf wraps nested n times in an allOf.
+func nestedAllOf(n int, nested structuralschema.NestedValueValidation) structuralschema.NestedValueValidation {
+	for i := 0; i < n; i++ {
+		nested = structuralschema.NestedValueValidation{ValueValidation: structuralschema.ValueValidation{AllOf: []structuralschema.NestedValueValidation{nested}}}
+	}
+	return nested
+}
+
+func TestJunctorLimits(t *testing.T) {
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	addAllOf := func(path *field.Path) *field.Path {
+		return path.Child("allOf").Index(0)
+	}
+	tests := []struct {
+		name           string
+		schema         *structuralschema.Structural
+		expectedErrors []*JunctorLimitError
+	}{
+		{
+			name: "limitAlsoDeclaredAtTopLevel",
+			schema: withJunctor(genArraySchema(int64ptr(5), genIntegerSchema()), "anyOf", structuralschema.NestedValueValidation{
+				ValueValidation: structuralschema.ValueValidation{MaxItems: int64ptr(3)},
+			}),
+			expectedErrors: []*JunctorLimitError{},
+		},
+		{
+			name: "maxItemsInAnyOf",
+			schema: withJunctor(genArraySchema(nil, genIntegerSchema()), "anyOf", structuralschema.NestedValueValidation{
+				ValueValidation: structuralschema.ValueValidation{MaxItems: int64ptr(3)},
+			}),
+			expectedErrors: []*JunctorLimitError{
+				{
+					Path:       rootPath.Child("anyOf").Index(0).Child("maxItems"),
+					TargetPath: rootPath,
+					Junctor:    "anyOf",
+					Keyword:    "maxItems",
+					Value:      3,
+				},
+			},
+		},
+		{
+			name: "maxLengthOnNestedProperty",
+			schema: withJunctor(genRootSchema("name", genStringSchema(nil)), "allOf", structuralschema.NestedValueValidation{
+				Properties: map[string]structuralschema.NestedValueValidation{
+					"name": {ValueValidation: structuralschema.ValueValidation{MaxLength: int64ptr(63)}},
+				},
+			}),
+			expectedErrors: []*JunctorLimitError{
+				{
+					Path:       rootPath.Child("allOf").Index(0).Child("properties").Key("name").Child("maxLength"),
+					TargetPath: rootPath.Child("properties").Key("name"),
+					Junctor:    "allOf",
+					Keyword:    "maxLength",
+					Value:      63,
+				},
+			},
+		},
+		{
+			name: "maxLengthOnItemsInsideNot",
+			schema: withJunctor(genArraySchema(int64ptr(5), genStringSchema(nil)), "not", structuralschema.NestedValueValidation{
+				Items: &structuralschema.NestedValueValidation{
+					ValueValidation: structuralschema.ValueValidation{MaxLength: int64ptr(2)},
+				},
+			}),
+			expectedErrors: []*JunctorLimitError{},
+		},
+		{
+			name: "maxItemsInEveryBranchOfOneOf",
+			schema: withJunctor(withJunctor(genArraySchema(nil, genIntegerSchema()), "oneOf", structuralschema.NestedValueValidation{
+				ValueValidation: structuralschema.ValueValidation{MaxItems: int64ptr(3)},
+			}), "oneOf", structuralschema.NestedValueValidation{
+				ValueValidation: structuralschema.ValueValidation{MaxItems: int64ptr(10)},
+			}),
+			expectedErrors: []*JunctorLimitError{
+				{
+					Path:       rootPath.Child("oneOf").Index(1).Child("maxItems"),
+					TargetPath: rootPath,
+					Junctor:    "oneOf",
+					Keyword:    "maxItems",
+					Value:      10,
+				},
+			},
+		},
+		{
+			name: "maxItemsInSomeBranchesOfAnyOf",
+			schema: withJunctor(withJunctor(genArraySchema(nil, genIntegerSchema()), "anyOf", structuralschema.NestedValueValidation{
+				ValueValidation: structuralschema.ValueValidation{MaxItems: int64ptr(3)},
+			}), "anyOf", structuralschema.NestedValueValidation{
+				ValueValidation: structuralschema.ValueValidation{MinItems: int64ptr(10)},
+			}),
+			expectedErrors: []*JunctorLimitError{},
+		},
+		{
+			name: "maxLengthInAllOfInsideAnyOf",
+			schema: withJunctor(withJunctor(genRootSchema("name", genStringSchema(nil)), "anyOf", structuralschema.NestedValueValidation{
+				ValueValidation: structuralschema.ValueValidation{
+					AllOf: []structuralschema.NestedValueValidation{
+						{Properties: map[string]structuralschema.NestedValueValidation{
+							"name": {ValueValidation: structuralschema.ValueValidation{MaxLength: int64ptr(63)}},
+						}},
+						{Properties: map[string]structuralschema.NestedValueValidation{
+							"name": {ValueValidation: structuralschema.ValueValidation{MaxLength: int64ptr(20)}},
+						}},
+					},
+				},
+			}), "anyOf", structuralschema.NestedValueValidation{
+				Properties: map[string]structuralschema.NestedValueValidation{
+					"name": {ValueValidation: structuralschema.ValueValidation{MaxLength: int64ptr(32)}},
+				},
+			}),
+			expectedErrors: []*JunctorLimitError{
+				{
+					// the first branch bounds name to 20 characters
+					Path:       rootPath.Child("anyOf").Index(1).Child("properties").Key("name").Child("maxLength"),
+					TargetPath: rootPath.Child("properties").Key("name"),
+					Junctor:    "anyOf",
+					Keyword:    "maxLength",
+					Value:      32,
+				},
+			},
+		},
+		{
+			name: "maxLengthInDeeplyNestedAllOf",
+			schema: withJunctor(genStringSchema(nil), "allOf", nestedAllOf(MaxJSONDepth, structuralschema.NestedValueValidation{
+				ValueValidation: structuralschema.ValueValidation{MaxLength: int64ptr(5)},
+			})),
+			expectedErrors: []*JunctorLimitError{
+				{
+					Path:       nestedPath(MaxJSONDepth+1, rootPath, addAllOf).Child("maxLength"),
+					TargetPath: rootPath,
+					Junctor:    "allOf",
+					Keyword:    "maxLength",
+					Value:      5,
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors := CheckJunctorLimits(test.schema)
+			if len(errors) != len(test.expectedErrors) {
+				t.Fatalf("Wrong number of expected errors (got %v, expected %v)", errors, test.expectedErrors)
+			}
+			for i, seenError := range errors {
+				expectedError := test.expectedErrors[i]
+				if !junctorLimitErrorsEqual(seenError, expectedError) {
+					t.Errorf("Wrong error (expected %v, got %v)", expectedError, seenError)
+				}
+			}
+		})
+	}
+}
+
+func junctorLimitErrorsEqual(x, y *JunctorLimitError) bool {
+	return x.Path.String() == y.Path.String() && x.TargetPath.String() == y.TargetPath.String() &&
+		x.Junctor == y.Junctor && x.Keyword == y.Keyword && x.Value == y.Value
+}
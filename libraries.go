@@ -0,0 +1,231 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/google/cel-go/cel"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// celLibrary is a CEL library made available to CRD validation rules by the
+// apiserver, along with the first release whose apiserver accepts new rules
+// using it.
+type celLibrary struct {
+	name  string
+	since KubeVersion
+	// functions lists the functions declared by the library. Functions
+	// declared in a namespace, such as sets.contains, are qualified by it.
+	functions []string
+	// receiver is the kind of value the member functions of the library are
+	// called on, "string" or "list", if they overload the functions of
+	// another library.
+	receiver string
+}
+
+// celLibraries lists the libraries available to validation rules, oldest
+// first. Functions declared by more than one library are told apart by the
+// type of the value they are called on, and attributed to the oldest library
+// declaring them if that type is unknown.
+var celLibraries = []celLibrary{
+	{
+		name:      "strings",
+		since:     KubeVersion{Major: 1, Minor: 23},
+		functions: []string{"charAt", "indexOf", "lastIndexOf", "lowerAscii", "replace", "split", "substring", "trim", "upperAscii", "join"},
+		receiver:  "string",
+	},
+	{
+		name:      "lists",
+		since:     KubeVersion{Major: 1, Minor: 24},
+		functions: []string{"isSorted", "sum", "min", "max", "indexOf", "lastIndexOf"},
+		receiver:  "list",
+	},
+	{
+		name:      "regex",
+		since:     KubeVersion{Major: 1, Minor: 24},
+		functions: []string{"find", "findAll"},
+	},
+	{
+		name:      "urls",
+		since:     KubeVersion{Major: 1, Minor: 24},
+		functions: []string{"url", "isURL", "getScheme", "getHost", "getHostname", "getPort", "getEscapedPath", "getQuery"},
+	},
+	{
+		name:      "quantity",
+		since:     KubeVersion{Major: 1, Minor: 29},
+		functions: []string{"quantity", "isQuantity", "sign", "isInteger", "asInteger", "asApproximateFloat", "add", "sub", "isGreaterThan", "isLessThan", "compareTo"},
+	},
+	{
+		name:      "optional types",
+		since:     KubeVersion{Major: 1, Minor: 29},
+		functions: []string{"optional.of", "optional.ofNonZeroValue", "optional.none", "hasValue", "value", "orValue"},
+	},
+	{
+		name:      "sets",
+		since:     KubeVersion{Major: 1, Minor: 30},
+		functions: []string{"sets.contains", "sets.equivalent", "sets.intersects"},
+	},
+	{
+		name:      "strings (version 2)",
+		since:     KubeVersion{Major: 1, Minor: 30},
+		functions: []string{"format", "strings.quote"},
+	},
+	{
+		name:      "ip and cidr",
+		since:     KubeVersion{Major: 1, Minor: 31},
+		functions: []string{"ip", "isIP", "ip.isCanonical", "cidr", "isCIDR", "family", "isUnspecified", "isLoopback", "isLinkLocalMulticast", "isLinkLocalUnicast", "isGlobalUnicast", "containsIP", "containsCIDR", "masked", "prefixLength"},
+	},
+	{
+		name:      "format",
+		since:     KubeVersion{Major: 1, Minor: 32},
+		functions: []string{"format.named", "format.dns1123Label", "format.dns1123Subdomain", "format.dns1035Label", "format.qualifiedName", "format.dns1123LabelPrefix", "format.dns1123SubdomainPrefix", "format.dns1035LabelPrefix", "format.labelValue", "format.uri", "format.uuid", "format.byte", "format.date", "format.datetime"},
+	},
+}
+
+// libraryFunctions maps every function in celLibraries to the libraries
+// declaring it, oldest first.
+var libraryFunctions = func() map[string][]*celLibrary {
+	functions := map[string][]*celLibrary{}
+	for i := range celLibraries {
+		for _, function := range celLibraries[i].functions {
+			functions[function] = append(functions[function], &celLibraries[i])
+		}
+	}
+	return functions
+}()
+
+// functionLibrary returns the library declaring function, called on a value
+// of type receiver, which is nil if unknown.
+func functionLibrary(function string, receiver *expr.Type) (*celLibrary, bool) {
+	libraries, ok := libraryFunctions[function]
+	if !ok {
+		return nil, false
+	}
+	for _, library := range libraries {
+		switch {
+		case library.receiver == "string" && receiver.GetPrimitive() == expr.Type_STRING,
+			library.receiver == "list" && receiver.GetListType() != nil:
+			return library, true
+		}
+	}
+	return libraries[0], true
+}
+
+// libraryNamespaces lists the identifiers used as namespaces by library
+// functions.
+var libraryNamespaces = map[string]bool{
+	"optional": true,
+	"sets":     true,
+	"strings":  true,
+	"format":   true,
+	"ip":       true,
+}
+
+// optionalSyntax matches the optional field selection and index syntax
+// (self.?field, self[?key]) introduced along with optional types.
+var optionalSyntax = regexp.MustCompile(`\.\?[a-zA-Z_]|\[\?`)
+
+// LibraryError represents a rule using a CEL function that is not available
+// in the oldest Kubernetes release targeted.
+type LibraryError struct {
+	// Path represents the path to the rule.
+	Path *field.Path
+	// Function is the unavailable function, qualified by its namespace if it
+	// has one.
+	Function string
+	// Library is the name of the library declaring the function.
+	Library string
+	// Since is the first release accepting rules using the library.
+	Since KubeVersion
+	// Target is the oldest release targeted.
+	Target KubeVersion
+	// Position is the position of the first use of the function in the rule,
+	// if known.
+	Position *Position
+}
+
+func (l *LibraryError) Error() string {
+	return fmt.Sprintf("rule %q uses %s from the %s library, which is only available from Kubernetes %s, but %s is targeted", l.Path.String(), l.Function, l.Library, l.Since, l.Target)
+}
+
+// CheckLibraryAvailability takes a schema and the releases the CRD must work
+// on, and returns an error for every rule using a function (or syntax) that
+// the oldest of those releases does not support.
+func CheckLibraryAvailability(schema *structuralschema.Structural, versions VersionRange) []*LibraryError {
+	root := field.NewPath("spec", "validation", "openAPIV3Schema")
+	return checkLibraryAvailability(newRuleCompiler(schema, root), schema, root, versions.Oldest())
+}
+
+func checkLibraryAvailability(compiler *ruleCompiler, schema *structuralschema.Structural, root *field.Path, target KubeVersion) []*LibraryError {
+	var libraryErrors []*LibraryError
+	walkFrom(schema, root, func(node *Node) bool {
+		for i, rule := range node.Schema.Extensions.XValidations {
+			rulePath := node.Path.Child("x-kubernetes-validations").Index(i).Child("rule")
+			reported := map[string]bool{}
+			report := func(function string, library *celLibrary, position *Position) {
+				if reported[function] || !target.Less(library.since) {
+					return
+				}
+				reported[function] = true
+				libraryErrors = append(libraryErrors, &LibraryError{Path: rulePath, Function: function, Library: library.name, Since: library.since, Target: target, Position: position})
+			}
+			// the checked AST tells the overloads of functions declared by
+			// more than one library apart, but rules using functions
+			// celvet does not declare only parse
+			var types map[int64]*expr.Type
+			ast := compiler.check(node.Schema, node.Path, node.IsResourceRoot, rule.Rule)
+			if ast != nil {
+				if checked, err := cel.AstToCheckedExpr(ast); err == nil {
+					types = checked.TypeMap
+				}
+			} else {
+				var err error
+				if ast, err = parseRule(rule.Rule); err != nil {
+					// the parser celvet is built with predates the optional
+					// syntax, so recognize it in the source
+					if optionalSyntax.MatchString(rule.Rule) {
+						report("optional syntax", libraryFunctions["optional.of"][0], nil)
+					}
+					continue
+				}
+			}
+			visitExpr(ast.Expr(), func(e *expr.Expr) bool {
+				call, ok := callExpr(e)
+				if !ok {
+					return true
+				}
+				function := call.Function
+				var receiver *expr.Type
+				if call.Target != nil {
+					receiver = types[call.Target.GetId()]
+					if namespace, ok := call.Target.ExprKind.(*expr.Expr_IdentExpr); ok && libraryNamespaces[namespace.IdentExpr.Name] {
+						if _, ok := libraryFunctions[namespace.IdentExpr.Name+"."+function]; ok {
+							function = namespace.IdentExpr.Name + "." + function
+						}
+					}
+				}
+				if library, ok := functionLibrary(function, receiver); ok {
+					report(function, library, exprPosition(ast, e))
+				}
+				return true
+			})
+		}
+		return true
+	})
+	return libraryErrors
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"testing"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestLibraryAvailability(t *testing.T) {
+	rulePath := field.NewPath("spec", "validation", "openAPIV3Schema").Child("x-kubernetes-validations").Index(0).Child("rule")
+	listRulePath := field.NewPath("spec", "validation", "openAPIV3Schema").Child("properties").Key("list").Child("x-kubernetes-validations").Index(0).Child("rule")
+	tests := []struct {
+		name           string
+		schema         *structuralschema.Structural
+		versions       string
+		expectedErrors []*LibraryError
+	}{
+		{
+			name:           "standardOnly",
+			schema:         withRule(genStringSchema(nil), `self.startsWith('a')`),
+			versions:       "1.23",
+			expectedErrors: []*LibraryError{},
+		},
+		{
+			name:     "regexBeforeLibraries",
+			schema:   withRule(genStringSchema(nil), `self.find('[0-9]+') != ''`),
+			versions: ">=1.23",
+			expectedErrors: []*LibraryError{
+				{Path: rulePath, Function: "find", Library: "regex"},
+			},
+		},
+		{
+			name:           "regexAvailable",
+			schema:         withRule(genStringSchema(nil), `self.find('[0-9]+') != ''`),
+			versions:       ">=1.24",
+			expectedErrors: []*LibraryError{},
+		},
+		{
+			name:           "stringIndexOf",
+			schema:         withRule(genStringSchema(nil), `self.indexOf('a') != 0`),
+			versions:       "1.23",
+			expectedErrors: []*LibraryError{},
+		},
+		{
+			name:     "listIndexOf",
+			schema:   genRootSchema("list", withRule(genArraySchema(nil, genStringSchema(nil)), `self.indexOf('a') != 0`)),
+			versions: "1.23",
+			expectedErrors: []*LibraryError{
+				{Path: listRulePath, Function: "indexOf", Library: "lists"},
+			},
+		},
+		{
+			name:     "listLastIndexOfInMacro",
+			schema:   genRootSchema("list", withRule(genArraySchema(nil, genArraySchema(nil, genStringSchema(nil))), `self.all(x, x.lastIndexOf('a') < 1 && 'abc'.indexOf('b') == 1)`)),
+			versions: "1.23",
+			expectedErrors: []*LibraryError{
+				{Path: listRulePath, Function: "lastIndexOf", Library: "lists"},
+			},
+		},
+		{
+			name:     "quantity",
+			schema:   withRule(genStringSchema(nil), `quantity(self).isLessThan(quantity('1Gi'))`),
+			versions: "1.28",
+			expectedErrors: []*LibraryError{
+				{Path: rulePath, Function: "isLessThan", Library: "quantity"},
+				{Path: rulePath, Function: "quantity", Library: "quantity"},
+			},
+		},
+		{
+			name:     "namespaced",
+			schema:   withRule(genArraySchema(nil, genStringSchema(nil)), `sets.contains(self, ['a'])`),
+			versions: ">=1.25,<1.30",
+			expectedErrors: []*LibraryError{
+				{Path: rulePath, Function: "sets.contains", Library: "sets"},
+			},
+		},
+		{
+			name:     "optionalSyntax",
+			schema:   withRule(genRootSchema("spec", genStringSchema(nil)), `self.?spec.orValue('') != 'a'`),
+			versions: "1.28",
+			expectedErrors: []*LibraryError{
+				{Path: rulePath, Function: "optional syntax", Library: "optional types"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			versions, err := ParseVersionRange(test.versions)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			errors := CheckLibraryAvailability(test.schema, versions)
+			if len(errors) != len(test.expectedErrors) {
+				t.Fatalf("Wrong number of expected errors (got %v, expected %v)", errors, test.expectedErrors)
+			}
+			for i, seenError := range errors {
+				expectedError := test.expectedErrors[i]
+				if seenError.Path.String() != expectedError.Path.String() || seenError.Function != expectedError.Function || seenError.Library != expectedError.Library {
+					t.Errorf("Wrong error (expected %v, got %v)", expectedError, seenError)
+				}
+			}
+		})
+	}
+}
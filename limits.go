@@ -15,6 +15,8 @@ package celvet
 
 import (
 	"fmt"
+	"regexp/syntax"
+	"unicode/utf8"
 
 	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
 	"k8s.io/apimachinery/pkg/util/validation/field"
@@ -30,17 +32,38 @@ const (
 	SchemaTypeMap
 	// SchemaTypeString represents a string as used by LimitError.
 	SchemaTypeString
+	// SchemaTypeFreeFormMap represents a map declared with
+	// additionalProperties: true as used by LimitError.
+	SchemaTypeFreeFormMap
+	// SchemaTypeUnknownFields represents an object with
+	// x-kubernetes-preserve-unknown-fields and no declared properties as used
+	// by LimitError.
+	SchemaTypeUnknownFields
+	// SchemaTypeIntOrString represents an x-kubernetes-int-or-string value as
+	// used by LimitError.
+	SchemaTypeIntOrString
+	// SchemaTypeEmbeddedResource represents an object with
+	// x-kubernetes-embedded-resource and no declared properties as used by
+	// LimitError.
+	SchemaTypeEmbeddedResource
 )
 
 // LimitError represents a list, map, or string that lacks a user-set limit.
 // For lists, this means maxItems has not been set. For maps, this means
 // maxProperties has not been set. And for strings this means maxLength has not
-// been set.
+// been set. Free-form maps and objects preserving unknown fields are reported
+// as well, since the size of their contents cannot be bounded by the schema.
 type LimitError struct {
 	// Path represents the path to the list, map or string without the limit.
 	Path *field.Path
 	// Type indicates the type of the schema node that caused the error.
 	Type SchemaType
+	// InferredMaxLength is set for strings whose length is already bounded by
+	// an enum, a format or an anchored pattern. Such errors are informational:
+	// they suggest a maxLength value rather than reporting an unbounded string.
+	InferredMaxLength *int64
+	// InferredFrom describes what InferredMaxLength was inferred from.
+	InferredFrom string
 }
 
 func (l *LimitError) Error() string {
@@ -50,11 +73,28 @@ func (l *LimitError) Error() string {
 	case SchemaTypeMap:
 		return fmt.Sprintf("map %q missing maxProperties", l.Path.String())
 	case SchemaTypeString:
+		if l.InferredMaxLength != nil {
+			return fmt.Sprintf("string %q missing maxLength, but is bounded to %d characters by its %s; consider setting maxLength: %d", l.Path.String(), *l.InferredMaxLength, l.InferredFrom, *l.InferredMaxLength)
+		}
 		return fmt.Sprintf("string %q missing maxLength", l.Path.String())
+	case SchemaTypeFreeFormMap:
+		return fmt.Sprintf("map %q allows arbitrary values (additionalProperties: true) and is missing maxProperties; declare an additionalProperties schema with limits and set maxProperties", l.Path.String())
+	case SchemaTypeUnknownFields:
+		return fmt.Sprintf("object %q preserves unknown fields of unbounded size; declare its properties with limits, or set maxProperties", l.Path.String())
+	case SchemaTypeIntOrString:
+		return fmt.Sprintf("int-or-string %q missing maxLength; its string form is unbounded (cost estimation ignores maxLength on int-or-string values, so setting it bounds the values accepted but not the estimated cost of rules)", l.Path.String())
+	case SchemaTypeEmbeddedResource:
+		return fmt.Sprintf("embedded resource %q declares no properties, so everything but its apiVersion, kind and metadata is unbounded; declare the properties rules rely on, with limits", l.Path.String())
 	}
 	return ""
 }
 
+// Informational returns true if the error is only a suggestion, as the
+// schema node is bounded even though the limit is not set.
+func (l *LimitError) Informational() bool {
+	return l.InferredMaxLength != nil
+}
+
 // CheckMaxLimits takes a schema and returns a list of linter errors
 // for every missing limit that could be set on a list/map/string belonging
 // to that schema or any level beneath it.
@@ -62,34 +102,218 @@ func CheckMaxLimits(schema *structuralschema.Structural) []*LimitError {
 	return checkMaxLimits(schema, field.NewPath("spec", "validation", "openAPIV3Schema"))
 }
 
-func checkMaxLimits(schema *structuralschema.Structural, path *field.Path) []*LimitError {
+func checkMaxLimits(schema *structuralschema.Structural, root *field.Path) []*LimitError {
 	limitErrors := make([]*LimitError, 0)
+	walkFrom(schema, root, func(node *Node) bool {
+		limitErrors = append(limitErrors, missingLimits(node.Schema, node.Path)...)
+		return true
+	})
+	return limitErrors
+}
+
+// missingLimits returns the missing limits of schema itself.
+func missingLimits(schema *structuralschema.Structural, path *field.Path) []*LimitError {
+	var limitErrors []*LimitError
+	if schema.XIntOrString {
+		// int-or-string values usually have no type, and are strings of
+		// arbitrary length unless bounded. Cost estimation ignores their
+		// maxLength, so those already bounded by an enum, a format or a
+		// pattern are not worth a suggestion.
+		if limitError := checkMaxLength(schema, path, SchemaTypeIntOrString); limitError != nil && limitError.InferredMaxLength == nil {
+			limitErrors = append(limitErrors, limitError)
+		}
+		return limitErrors
+	}
 	switch schema.Type {
 	case "array":
 		if schema.ValueValidation == nil {
-			limitErrors = append(limitErrors, &LimitError{path, SchemaTypeList})
+			limitErrors = append(limitErrors, &LimitError{Path: path, Type: SchemaTypeList})
 		} else if schema.ValueValidation.MaxItems == nil {
-			limitErrors = append(limitErrors, &LimitError{path, SchemaTypeList})
+			limitErrors = append(limitErrors, &LimitError{Path: path, Type: SchemaTypeList})
 		}
-		limitErrors = append(limitErrors, checkMaxLimits(schema.Items, path.Child("items"))...)
 	case "string":
-		if schema.ValueValidation == nil {
-			limitErrors = append(limitErrors, &LimitError{path, SchemaTypeString})
-		} else if schema.ValueValidation.MaxLength == nil {
-			limitErrors = append(limitErrors, &LimitError{path, SchemaTypeString})
+		if limitError := checkMaxLength(schema, path, SchemaTypeString); limitError != nil {
+			limitErrors = append(limitErrors, limitError)
+		}
+	case "":
+		// untyped nodes preserving unknown fields hold arbitrary values
+		if isFreeForm(schema) && (schema.ValueValidation == nil || schema.ValueValidation.MaxProperties == nil) {
+			limitErrors = append(limitErrors, &LimitError{Path: path, Type: SchemaTypeUnknownFields})
 		}
 	case "object":
 		if schema.AdditionalProperties != nil && schema.AdditionalProperties.Structural != nil {
 			if schema.ValueValidation == nil {
-				limitErrors = append(limitErrors, &LimitError{path, SchemaTypeMap})
+				limitErrors = append(limitErrors, &LimitError{Path: path, Type: SchemaTypeMap})
 			} else if schema.ValueValidation.MaxProperties == nil {
-				limitErrors = append(limitErrors, &LimitError{path, SchemaTypeMap})
+				limitErrors = append(limitErrors, &LimitError{Path: path, Type: SchemaTypeMap})
+			}
+		} else if schema.XEmbeddedResource && schema.XPreserveUnknownFields && len(schema.Properties) == 0 {
+			limitErrors = append(limitErrors, &LimitError{Path: path, Type: SchemaTypeEmbeddedResource})
+		} else if isFreeForm(schema) && (schema.ValueValidation == nil || schema.ValueValidation.MaxProperties == nil) {
+			if schema.AdditionalProperties != nil {
+				limitErrors = append(limitErrors, &LimitError{Path: path, Type: SchemaTypeFreeFormMap})
+			} else {
+				limitErrors = append(limitErrors, &LimitError{Path: path, Type: SchemaTypeUnknownFields})
 			}
-			limitErrors = append(limitErrors, checkMaxLimits(schema.AdditionalProperties.Structural, path.Child("additionalProperties"))...)
-		}
-		for propName, propSchema := range schema.Properties {
-			limitErrors = append(limitErrors, checkMaxLimits(&propSchema, path.Child("properties").Key(propName))...)
 		}
 	}
 	return limitErrors
 }
+
+// checkMaxLength returns an error of type schemaType if schema does not set
+// maxLength, or nil if it does.
+func checkMaxLength(schema *structuralschema.Structural, path *field.Path, schemaType SchemaType) *LimitError {
+	if schema.ValueValidation == nil {
+		return &LimitError{Path: path, Type: schemaType}
+	}
+	if schema.ValueValidation.MaxLength != nil {
+		return nil
+	}
+	maxLength, inferredFrom := inferMaxLength(schema.ValueValidation)
+	return &LimitError{
+		Path:              path,
+		Type:              schemaType,
+		InferredMaxLength: maxLength,
+		InferredFrom:      inferredFrom,
+	}
+}
+
+// formatMaxLengths contains the maximum length of strings with formats whose
+// values have an inherent upper bound.
+var formatMaxLengths = map[string]int64{
+	"uuid":  36,
+	"uuid3": 36,
+	"uuid4": 36,
+	"uuid5": 36,
+	// 2006-01-02
+	"date": 10,
+	// date-time is not listed: RFC 3339 does not limit the number of digits
+	// of fractional seconds, and the apiserver accepts any
+	// 255.255.255.255
+	"ipv4": 15,
+	// ffff:ffff:ffff:ffff:ffff:ffff:255.255.255.255
+	"ipv6":     45,
+	"hostname": 255,
+}
+
+// inferMaxLength returns the smallest upper bound on the length of a string
+// implied by the enum, format or pattern of v, along with a description of
+// its source. If none of these bound the string, nil is returned.
+func inferMaxLength(v *structuralschema.ValueValidation) (*int64, string) {
+	var bound *int64
+	var source string
+	consider := func(maxLength int64, from string) {
+		if bound == nil || maxLength < *bound {
+			bound = &maxLength
+			source = from
+		}
+	}
+	if len(v.Enum) > 0 {
+		enumMax := int64(0)
+		allStrings := true
+		for _, member := range v.Enum {
+			str, ok := member.Object.(string)
+			if !ok {
+				allStrings = false
+				break
+			}
+			if length := int64(utf8.RuneCountInString(str)); length > enumMax {
+				enumMax = length
+			}
+		}
+		if allStrings {
+			consider(enumMax, "enum")
+		}
+	}
+	if maxLength, ok := formatMaxLengths[v.Format]; ok {
+		consider(maxLength, fmt.Sprintf("format %q", v.Format))
+	}
+	if v.Pattern != "" {
+		if maxLength, ok := patternMaxLength(v.Pattern); ok {
+			consider(maxLength, "pattern")
+		}
+	}
+	return bound, source
+}
+
+// patternMaxLength returns the maximum number of characters in a string
+// matching pattern. Patterns are matched anywhere in the string, so only
+// patterns anchored with ^ and $ and without unbounded quantifiers have a
+// maximum length.
+func patternMaxLength(pattern string) (int64, bool) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return 0, false
+	}
+	return anchoredMaxLength(re.Simplify())
+}
+
+func anchoredMaxLength(re *syntax.Regexp) (int64, bool) {
+	switch re.Op {
+	case syntax.OpAlternate:
+		var max int64
+		for _, sub := range re.Sub {
+			length, ok := anchoredMaxLength(sub)
+			if !ok {
+				return 0, false
+			}
+			if length > max {
+				max = length
+			}
+		}
+		return max, true
+	case syntax.OpCapture:
+		return anchoredMaxLength(re.Sub[0])
+	case syntax.OpConcat:
+		if len(re.Sub) < 2 || re.Sub[0].Op != syntax.OpBeginText || re.Sub[len(re.Sub)-1].Op != syntax.OpEndText {
+			return 0, false
+		}
+		return regexpMaxLength(re)
+	}
+	return 0, false
+}
+
+// regexpMaxLength returns the maximum number of characters matched by re, or
+// false if re can match an unbounded number of characters.
+func regexpMaxLength(re *syntax.Regexp) (int64, bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return int64(len(re.Rune)), true
+	case syntax.OpCharClass, syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return 1, true
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText, syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return 0, true
+	case syntax.OpCapture, syntax.OpQuest:
+		return regexpMaxLength(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Max < 0 {
+			return 0, false
+		}
+		length, ok := regexpMaxLength(re.Sub[0])
+		return length * int64(re.Max), ok
+	case syntax.OpConcat:
+		var total int64
+		for _, sub := range re.Sub {
+			length, ok := regexpMaxLength(sub)
+			if !ok {
+				return 0, false
+			}
+			total += length
+		}
+		return total, true
+	case syntax.OpAlternate:
+		var max int64
+		for _, sub := range re.Sub {
+			length, ok := regexpMaxLength(sub)
+			if !ok {
+				return 0, false
+			}
+			if length > max {
+				max = length
+			}
+		}
+		return max, true
+	}
+	// OpStar, OpPlus and anything unrecognized are unbounded
+	return 0, false
+}
@@ -114,6 +114,183 @@ func TestMaxLimits(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:   "string bounded by enum",
+			schema: withEnum(genStringSchema(nil), "Always", "IfNotPresent", "Never"),
+			expectedErrors: []*LimitError{
+				{
+					Path:              field.NewPath("spec", "validation", "openAPIV3Schema"),
+					Type:              SchemaTypeString,
+					InferredMaxLength: int64ptr(12),
+				},
+			},
+		},
+		{
+			name: "string bounded by format",
+			schema: &structuralschema.Structural{
+				Generic: structuralschema.Generic{
+					Type: "string",
+				},
+				ValueValidation: &structuralschema.ValueValidation{
+					Format: "uuid",
+				},
+			},
+			expectedErrors: []*LimitError{
+				{
+					Path:              field.NewPath("spec", "validation", "openAPIV3Schema"),
+					Type:              SchemaTypeString,
+					InferredMaxLength: int64ptr(36),
+				},
+			},
+		},
+		{
+			// fractional seconds can have any number of digits
+			name: "date-time string",
+			schema: &structuralschema.Structural{
+				Generic: structuralschema.Generic{
+					Type: "string",
+				},
+				ValueValidation: &structuralschema.ValueValidation{
+					Format: "date-time",
+				},
+			},
+			expectedErrors: []*LimitError{
+				{
+					Path: field.NewPath("spec", "validation", "openAPIV3Schema"),
+					Type: SchemaTypeString,
+				},
+			},
+		},
+		{
+			name: "string bounded by anchored pattern",
+			schema: &structuralschema.Structural{
+				Generic: structuralschema.Generic{
+					Type: "string",
+				},
+				ValueValidation: &structuralschema.ValueValidation{
+					Pattern: `^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`,
+				},
+			},
+			expectedErrors: []*LimitError{
+				{
+					Path:              field.NewPath("spec", "validation", "openAPIV3Schema"),
+					Type:              SchemaTypeString,
+					InferredMaxLength: int64ptr(63),
+				},
+			},
+		},
+		{
+			name: "string with unanchored pattern",
+			schema: &structuralschema.Structural{
+				Generic: structuralschema.Generic{
+					Type: "string",
+				},
+				ValueValidation: &structuralschema.ValueValidation{
+					Pattern: `[a-z]{1,10}`,
+				},
+			},
+			expectedErrors: []*LimitError{
+				{
+					Path: field.NewPath("spec", "validation", "openAPIV3Schema"),
+					Type: SchemaTypeString,
+				},
+			},
+		},
+		{
+			name: "string with unbounded pattern",
+			schema: &structuralschema.Structural{
+				Generic: structuralschema.Generic{
+					Type: "string",
+				},
+				ValueValidation: &structuralschema.ValueValidation{
+					Pattern: `^[a-z]+$`,
+				},
+			},
+			expectedErrors: []*LimitError{
+				{
+					Path: field.NewPath("spec", "validation", "openAPIV3Schema"),
+					Type: SchemaTypeString,
+				},
+			},
+		},
+		{
+			name:   "free-form map",
+			schema: genFreeFormMapSchema(),
+			expectedErrors: []*LimitError{
+				{
+					Path: field.NewPath("spec", "validation", "openAPIV3Schema"),
+					Type: SchemaTypeFreeFormMap,
+				},
+			},
+		},
+		{
+			name:   "preserved unknown fields",
+			schema: genRootSchema("config", genUnknownFieldsSchema()),
+			expectedErrors: []*LimitError{
+				{
+					Path: field.NewPath("spec", "validation", "openAPIV3Schema", "properties").Key("config"),
+					Type: SchemaTypeUnknownFields,
+				},
+			},
+		},
+		{
+			name: "untyped preserved unknown fields",
+			schema: genRootSchema("value", &structuralschema.Structural{
+				Extensions: structuralschema.Extensions{
+					XPreserveUnknownFields: true,
+				},
+			}),
+			expectedErrors: []*LimitError{
+				{
+					Path: field.NewPath("spec", "validation", "openAPIV3Schema", "properties").Key("value"),
+					Type: SchemaTypeUnknownFields,
+				},
+			},
+		},
+		{
+			name: "int-or-string without type",
+			schema: genRootSchema("port", &structuralschema.Structural{
+				Extensions: structuralschema.Extensions{
+					XIntOrString: true,
+				},
+			}),
+			expectedErrors: []*LimitError{
+				{
+					Path: field.NewPath("spec", "validation", "openAPIV3Schema", "properties").Key("port"),
+					Type: SchemaTypeIntOrString,
+				},
+			},
+		},
+		{
+			name: "int-or-string bounded by enum",
+			schema: genRootSchema("port", &structuralschema.Structural{
+				Extensions: structuralschema.Extensions{
+					XIntOrString: true,
+				},
+				ValueValidation: &structuralschema.ValueValidation{
+					Enum: []structuralschema.JSON{{Object: "http"}, {Object: "https"}},
+				},
+			}),
+			expectedErrors: []*LimitError{},
+		},
+		{
+			name: "embedded resource without properties",
+			schema: genRootSchema("template", &structuralschema.Structural{
+				Generic: structuralschema.Generic{
+					Type: "object",
+				},
+				Extensions: structuralschema.Extensions{
+					XEmbeddedResource:      true,
+					XPreserveUnknownFields: true,
+				},
+			}),
+			expectedErrors: []*LimitError{
+				{
+					Path: field.NewPath("spec", "validation", "openAPIV3Schema", "properties").Key("template"),
+					Type: SchemaTypeEmbeddedResource,
+				},
+			},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -132,5 +309,11 @@ func TestMaxLimits(t *testing.T) {
 }
 
 func limitErrorsEqual(x, y *LimitError) bool {
+	if (x.InferredMaxLength == nil) != (y.InferredMaxLength == nil) {
+		return false
+	}
+	if x.InferredMaxLength != nil && *x.InferredMaxLength != *y.InferredMaxLength {
+		return false
+	}
 	return x.Path.String() == y.Path.String() && x.Type == y.Type
 }
@@ -0,0 +1,921 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	goruntime "runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	api "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Severity indicates how serious a finding is.
+type Severity int
+
+const (
+	// SeverityInfo findings are suggestions, such as rules that only repeat
+	// an OpenAPI keyword.
+	SeverityInfo Severity = iota
+	// SeverityWarning findings are likely, but not certain, problems found by
+	// heuristics, such as rules whose cost grows quadratically or references
+	// to free-form maps. They do not make celvet exit with a non-zero code
+	// unless --fail-on-warning is set.
+	SeverityWarning
+	// SeverityError findings are problems the CRD must fix, such as rules the
+	// apiserver rejects because they fail to compile or exceed a cost limit.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// Position is a position in the source of a rule. Line and Column start at 1.
+type Position struct {
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Finding is a problem or suggestion reported by a check.
+type Finding struct {
+	// CheckID is the ID of the check that reported the finding.
+	CheckID  string
+	Severity Severity
+	// Version is the name of the CRD version whose schema the finding is
+	// about.
+	Version string
+	// Path represents the path to the schema node or rule the finding is
+	// about.
+	Path    *field.Path
+	Message string
+	// SuggestedFix describes how to address the finding, if the check knows
+	// of a specific change.
+	SuggestedFix string
+	// Position is the position in the rule at Path the finding is about, if
+	// known.
+	Position *Position
+}
+
+// String formats f as "[check-id] message", followed by the position in the
+// rule and the suggested fix if known.
+func (f Finding) String() string {
+	s := fmt.Sprintf("[%s] %s", f.CheckID, f.Message)
+	if f.Position != nil {
+		s += fmt.Sprintf(" (at %s in the rule)", f.Position)
+	}
+	if f.SuggestedFix != "" {
+		s += "; suggested fix: " + f.SuggestedFix
+	}
+	return s
+}
+
+// Target is one version of a CRD, as seen by checks.
+type Target struct {
+	// CRD is nil for schemas linted with Linter.LintSchema.
+	CRD     *apiv1.CustomResourceDefinition
+	Version string
+	// Schema is the structural schema of the version.
+	Schema *structuralschema.Structural
+	// Path is the path to Schema in the document declaring it, which the
+	// paths of findings start with, e.g. spec.versions[0].schema.openAPIV3Schema
+	// for a v1beta1 CRD version declaring its own schema. If nil, it is
+	// spec.validation.openAPIV3Schema, the path the apiserver reports.
+	Path *field.Path
+	// Props is the schema Schema was built from. It holds value validations
+	// that structural schemas drop, such as enum.
+	Props *api.JSONSchemaProps
+	// RuleExtensions are the messageExpression, reason and fieldPath fields
+	// of the rules of the version, if known.
+	RuleExtensions RuleExtensions
+	// KubeVersions are the releases the CRD must work on.
+	KubeVersions VersionRange
+	// CostLimits are the cost limits of KubeVersions.
+	CostLimits CostLimits
+	// HumanReadable is true if messages should favour readability over
+	// exact values.
+	HumanReadable bool
+
+	// rules compiles the rules of Schema for the checks that compile them,
+	// so that they are compiled once per target.
+	rules *ruleCompiler
+}
+
+// Walk is like the Walk function, but the path of the root node of t.Schema
+// is t.Path, so that custom checks report paths into the document declaring
+// the schema.
+func (t *Target) Walk(visitor Visitor) {
+	walkFrom(t.Schema, t.path(), visitor)
+}
+
+// path returns the path to the schema of t.
+func (t *Target) path() *field.Path {
+	if t.Path == nil {
+		return field.NewPath("spec", "validation", "openAPIV3Schema")
+	}
+	return t.Path
+}
+
+// compiler returns the rule compiler of t, or a new one if t was not created
+// by a Linter.
+func (t *Target) compiler() *ruleCompiler {
+	if t.rules == nil {
+		return newRuleCompiler(t.Schema, t.path())
+	}
+	return t.rules
+}
+
+// Check is a check run by a Linter on every version of a CRD.
+type Check interface {
+	// ID identifies the check in findings and Options.Disabled.
+	ID() string
+	// Run returns the findings of the check for target.
+	Run(ctx context.Context, target *Target) ([]Finding, error)
+}
+
+// IDs of the checks returned by DefaultChecks.
+const (
+	CheckIDLimits              = "limits"
+	CheckIDCost                = "cost"
+	CheckIDEnumExamples        = "enum-examples"
+	CheckIDConstraints         = "constraints"
+	CheckIDJunctorLimits       = "junctor-limits"
+	CheckIDFreeFormReferences  = "free-form-references"
+	CheckIDMetadataAccess      = "metadata-access"
+	CheckIDPropertyNames       = "property-names"
+	CheckIDComplexity          = "complexity"
+	CheckIDStringOps           = "string-ops"
+	CheckIDRuleRelocation      = "rule-relocation"
+	CheckIDLibraryAvailability = "library-availability"
+	CheckIDRuleExtensions      = "rule-extensions"
+	CheckIDNestingDepth        = "nesting-depth"
+)
+
+// CheckIDSchemaLimits identifies the finding reported instead of running the
+// checks on a version whose schema exceeds Options.MaxDepth or
+// Options.MaxNodes.
+const CheckIDSchemaLimits = "schema-limits"
+
+// checkFunc adapts a function to the Check interface.
+type checkFunc struct {
+	id  string
+	run func(target *Target) []Finding
+}
+
+func (c *checkFunc) ID() string {
+	return c.id
+}
+
+func (c *checkFunc) Run(ctx context.Context, target *Target) ([]Finding, error) {
+	return c.run(target), nil
+}
+
+// severity returns the severity of a finding that is informational or not.
+func severity(informational bool) Severity {
+	if informational {
+		return SeverityInfo
+	}
+	return SeverityError
+}
+
+// DefaultChecks returns the checks celvet runs by default, in the order they
+// are run.
+func DefaultChecks() []Check {
+	return []Check{
+		&checkFunc{id: CheckIDLimits, run: func(target *Target) []Finding {
+			var findings []Finding
+			for _, e := range checkMaxLimits(target.Schema, target.path()) {
+				finding := Finding{CheckID: CheckIDLimits, Severity: severity(e.Informational()), Path: e.Path, Message: e.Error()}
+				if e.InferredMaxLength != nil {
+					finding.SuggestedFix = fmt.Sprintf("set maxLength: %d", *e.InferredMaxLength)
+				}
+				findings = append(findings, finding)
+			}
+			return findings
+		}},
+		&checkFunc{id: CheckIDCost, run: func(target *Target) []Finding {
+			var findings []Finding
+			costErrors, totalCostError, compileErrors := checkExprCost(target.compiler(), target.Schema, target.path(), target.CostLimits)
+			for _, e := range costErrors {
+				message := e.Error()
+				if target.HumanReadable {
+					message = e.HumanReadableError()
+				}
+				findings = append(findings, Finding{CheckID: CheckIDCost, Severity: SeverityError, Path: e.Path, Message: message})
+			}
+			if totalCostError != nil {
+				message := totalCostError.Error()
+				if target.HumanReadable {
+					message = totalCostError.HumanReadableError()
+				}
+				findings = append(findings, Finding{CheckID: CheckIDCost, Severity: SeverityError, Path: totalCostError.Path, Message: message})
+			}
+			for _, e := range compileErrors {
+				finding := Finding{CheckID: CheckIDCost, Severity: SeverityError, Message: e.Error()}
+				if compileError, ok := e.(*CompileError); ok {
+					finding.Path = compileError.Path
+				}
+				findings = append(findings, finding)
+			}
+			return findings
+		}},
+		&checkFunc{id: CheckIDEnumExamples, run: func(target *Target) []Finding {
+			var findings []Finding
+			for _, e := range checkEnumExamples(target.compiler(), target.Schema, target.Props, target.path()) {
+				findings = append(findings, Finding{CheckID: CheckIDEnumExamples, Severity: SeverityError, Path: e.Path, Message: e.Error()})
+			}
+			return findings
+		}},
+		&checkFunc{id: CheckIDConstraints, run: func(target *Target) []Finding {
+			var findings []Finding
+			for _, e := range checkConstraints(target.Schema, target.path()) {
+				finding := Finding{CheckID: CheckIDConstraints, Severity: SeverityError, Path: e.Path, Message: e.Error()}
+				if e.Type == ConstraintTypeRedundantRule {
+					finding.Severity = SeverityInfo
+					finding.SuggestedFix = "remove the rule"
+				}
+				findings = append(findings, finding)
+			}
+			return findings
+		}},
+		&checkFunc{id: CheckIDJunctorLimits, run: func(target *Target) []Finding {
+			var findings []Finding
+			for _, e := range checkJunctorLimits(target.Schema, target.path()) {
+				findings = append(findings, Finding{CheckID: CheckIDJunctorLimits, Severity: SeverityWarning, Path: e.Path, Message: e.Error(),
+					SuggestedFix: fmt.Sprintf("declare %s: %d on %q", e.Keyword, e.Value, e.TargetPath.String())})
+			}
+			return findings
+		}},
+		&checkFunc{id: CheckIDFreeFormReferences, run: func(target *Target) []Finding {
+			var findings []Finding
+			for _, e := range checkFreeFormReferences(target.Schema, target.path()) {
+				findings = append(findings, Finding{CheckID: CheckIDFreeFormReferences, Severity: SeverityWarning, Path: e.Path, Message: e.Error()})
+			}
+			return findings
+		}},
+		&checkFunc{id: CheckIDMetadataAccess, run: func(target *Target) []Finding {
+			var findings []Finding
+			for _, e := range checkMetadataAccess(target.Schema, target.path()) {
+				findings = append(findings, Finding{CheckID: CheckIDMetadataAccess, Severity: SeverityError, Path: e.Path, Message: e.Error()})
+			}
+			return findings
+		}},
+		&checkFunc{id: CheckIDPropertyNames, run: func(target *Target) []Finding {
+			var findings []Finding
+			for _, e := range checkPropertyNames(target.compiler(), target.Schema, target.path()) {
+				finding := Finding{CheckID: CheckIDPropertyNames, Severity: severity(e.Informational()), Path: e.Path, Message: e.Error()}
+				if e.Type == PropertyNameTypeUnescapedReference {
+					finding.SuggestedFix = fmt.Sprintf("replace %s with %s", e.Name, e.Escaped)
+				}
+				findings = append(findings, finding)
+			}
+			return findings
+		}},
+		&checkFunc{id: CheckIDComplexity, run: func(target *Target) []Finding {
+			var findings []Finding
+			for _, e := range checkComplexity(target.Schema, target.path()) {
+				finding := Finding{CheckID: CheckIDComplexity, Severity: SeverityWarning, Path: e.Path, Message: e.Error()}
+				switch e.ListType {
+				case "set":
+					finding.SuggestedFix = fmt.Sprintf("set x-kubernetes-list-type: set on %q", e.CollectionPath.String())
+				case "map":
+					finding.SuggestedFix = fmt.Sprintf("set x-kubernetes-list-type: map with x-kubernetes-list-map-keys: [%s] on %q", strings.Join(e.ListMapKeys, ", "), e.CollectionPath.String())
+				}
+				findings = append(findings, finding)
+			}
+			return findings
+		}},
+		&checkFunc{id: CheckIDStringOps, run: func(target *Target) []Finding {
+			var findings []Finding
+			for _, e := range checkStringOps(target.compiler(), target.Schema, target.path()) {
+				findings = append(findings, Finding{CheckID: CheckIDStringOps, Severity: SeverityWarning, Path: e.Path, Message: e.Error(), Position: e.Position})
+			}
+			return findings
+		}},
+		&checkFunc{id: CheckIDRuleRelocation, run: func(target *Target) []Finding {
+			var findings []Finding
+			for _, e := range checkRuleRelocation(target.compiler(), target.Schema, target.path()) {
+				findings = append(findings, Finding{CheckID: CheckIDRuleRelocation, Severity: severity(e.Informational()), Path: e.Path, Message: e.Error(),
+					SuggestedFix: fmt.Sprintf("replace the rule with %q on %q", e.Rule, e.TargetPath.String())})
+			}
+			return findings
+		}},
+		&checkFunc{id: CheckIDLibraryAvailability, run: func(target *Target) []Finding {
+			var findings []Finding
+			for _, e := range checkLibraryAvailability(target.compiler(), target.Schema, target.path(), target.KubeVersions.Oldest()) {
+				findings = append(findings, Finding{CheckID: CheckIDLibraryAvailability, Severity: SeverityError, Path: e.Path, Message: e.Error(), Position: e.Position})
+			}
+			return findings
+		}},
+		&checkFunc{id: CheckIDRuleExtensions, run: func(target *Target) []Finding {
+			var findings []Finding
+			for _, e := range checkRuleExtensions(target.compiler(), target.Schema, target.RuleExtensions, target.path(), target.CostLimits) {
+				findings = append(findings, Finding{CheckID: CheckIDRuleExtensions, Severity: SeverityError, Path: e.Path, Message: e.Error()})
+			}
+			return findings
+		}},
+		&checkFunc{id: CheckIDNestingDepth, run: func(target *Target) []Finding {
+			var findings []Finding
+			for _, e := range checkNestingDepth(target.Schema, target.path()) {
+				findings = append(findings, Finding{CheckID: CheckIDNestingDepth, Severity: SeverityError, Path: e.Path, Message: e.Error()})
+			}
+			return findings
+		}},
+	}
+}
+
+// Options configure a Linter.
+type Options struct {
+	// KubeVersions are the releases CRDs must work on. If nil, CRDs are
+	// checked against DefaultKubeVersion.
+	KubeVersions *VersionRange
+	// Checks are the checks to run. If nil, DefaultChecks are run.
+	Checks []Check
+	// Disabled lists the IDs of checks not to run.
+	Disabled []string
+	// HumanReadable is true if messages should favour readability over
+	// exact values, e.g. reporting by how much a cost limit is exceeded.
+	HumanReadable bool
+	// Jobs is the maximum number of CRD versions linted at the same time,
+	// across all the CRDs a Linter is linting. If 0, it is the number of CPUs
+	// usable by the process.
+	Jobs int
+	// Timeout is the time allowed to lint each CRD, from when its first
+	// version starts being linted. If 0, there is no limit.
+	Timeout time.Duration
+	// MaxDepth and MaxNodes bound the schemas checked: a version whose schema
+	// nests nodes more than MaxDepth levels deep, or has more than MaxNodes
+	// nodes, is not checked, and a CheckIDSchemaLimits finding is reported
+	// instead, as checks may take too long or too much memory on it. Only
+	// CheckIDNestingDepth, which reports the nodes beyond the deepest the
+	// apiserver decodes, still runs on it. If 0,
+	// they are DefaultMaxDepth and DefaultMaxNodes; if negative, there is no
+	// limit.
+	MaxDepth int
+	MaxNodes int
+}
+
+const (
+	// DefaultMaxDepth is the default Options.MaxDepth, in schema levels: the
+	// depth of the deepest property a CRD can declare, so that schemas
+	// CheckNestingDepth would report for their properties are not checked.
+	DefaultMaxDepth = MaxSchemaDepth / 2
+	// DefaultMaxNodes is the default Options.MaxNodes.
+	DefaultMaxNodes = 100000
+)
+
+// Linter runs checks on CRDs. It is safe for concurrent use.
+type Linter struct {
+	options Options
+	checks  []Check
+	// jobs holds a token for every version being linted.
+	jobs chan struct{}
+}
+
+// NewLinter returns a Linter configured by options.
+func NewLinter(options Options) *Linter {
+	if options.KubeVersions == nil {
+		options.KubeVersions = &VersionRange{Min: &DefaultKubeVersion, Max: &DefaultKubeVersion}
+	}
+	checks := options.Checks
+	if checks == nil {
+		checks = DefaultChecks()
+	}
+	disabled := map[string]bool{}
+	for _, id := range options.Disabled {
+		disabled[id] = true
+	}
+	if options.Jobs <= 0 {
+		options.Jobs = goruntime.GOMAXPROCS(0)
+	}
+	if options.MaxDepth == 0 {
+		options.MaxDepth = DefaultMaxDepth
+	}
+	if options.MaxNodes == 0 {
+		options.MaxNodes = DefaultMaxNodes
+	}
+	linter := &Linter{options: options, jobs: make(chan struct{}, options.Jobs)}
+	for _, check := range checks {
+		if !disabled[check.ID()] {
+			linter.checks = append(linter.checks, check)
+		}
+	}
+	return linter
+}
+
+// IncompleteError is returned when linting a CRD is canceled or times out
+// before all of its versions are linted. The findings returned along with it
+// are those of the versions in Linted. For OpenAPI documents, the versions are
+// the component schemas.
+type IncompleteError struct {
+	// CRD is the name of the CRD, empty for OpenAPI documents.
+	CRD string
+	// Linted are the names of the versions that were linted, and Skipped
+	// those that were not.
+	Linted  []string
+	Skipped []string
+	// Timeout is set if the error is due to Options.Timeout elapsing.
+	Timeout time.Duration
+	// Err is the error of the context, context.Canceled or
+	// context.DeadlineExceeded.
+	Err error
+}
+
+func (i *IncompleteError) Error() string {
+	reason := "was canceled"
+	if i.Timeout > 0 {
+		reason = fmt.Sprintf("timed out after %s", i.Timeout)
+	} else if errors.Is(i.Err, context.DeadlineExceeded) {
+		reason = "exceeded its deadline"
+	}
+	if i.CRD == "" {
+		return fmt.Sprintf("linting the OpenAPI document %s; schemas not linted: %s", reason, strings.Join(i.Skipped, ", "))
+	}
+	return fmt.Sprintf("linting %s %s; versions not linted: %s", i.CRD, reason, strings.Join(i.Skipped, ", "))
+}
+
+func (i *IncompleteError) Unwrap() error {
+	return i.Err
+}
+
+// Lint runs the checks of l on every version of crd that has a schema, and
+// returns their findings. Findings are ordered by version, in the order the
+// CRD declares them, then by path, comparing indexes such as rule indexes
+// numerically, then by check in the order they are run, and finally in the
+// order each check reported them. Schemas that are not structural are
+// reported as CheckIDStructuralSchema findings and not checked. Since
+// crd cannot hold the messageExpression, reason and fieldPath fields of
+// rules, use LintManifest to check those.
+//
+// Versions are linted concurrently, up to Options.Jobs at a time. If ctx is
+// canceled or Options.Timeout elapses first, Lint returns the findings of the
+// versions linted so far along with an *IncompleteError. The timeout starts
+// once the first version starts being linted, so that time spent waiting for
+// other CRDs does not count against it. Checks are not
+// interrupted, but no check is started once ctx is done.
+func (l *Linter) Lint(ctx context.Context, crd *apiv1.CustomResourceDefinition) ([]Finding, error) {
+	return l.lint(ctx, crd, nil, nil)
+}
+
+// LintManifest decodes a CRD from YAML or JSON like DecodeCRD and lints it
+// like Lint, including the messageExpression, reason and fieldPath fields of
+// its rules. The paths of the findings of Crossplane
+// CompositeResourceDefinitions point into their
+// spec.versions[i].schema.openAPIV3Schema, and those of v1beta1 CRDs into the
+// v1beta1 layout: spec.versions[i].schema.openAPIV3Schema for versions declaring
+// their own schema, and spec.validation.openAPIV3Schema for the top-level
+// schema, whose findings are reported once, under the first version using it.
+func (l *Linter) LintManifest(ctx context.Context, data []byte) ([]Finding, error) {
+	return l.lintManifest(ctx, data, false)
+}
+
+// lintManifest is like LintManifest, but the findings of v1 CRDs point into
+// their spec.versions[i].schema.openAPIV3Schema if versionPaths is true.
+func (l *Linter) lintManifest(ctx context.Context, data []byte, versionPaths bool) ([]Finding, error) {
+	crd, schemaPaths, err := decodeCRD(data)
+	if err != nil {
+		return nil, err
+	}
+	if schemaPaths == nil && versionPaths {
+		schemaPaths = make([]*field.Path, len(crd.Spec.Versions))
+		for i := range schemaPaths {
+			schemaPaths[i] = field.NewPath("spec", "versions").Index(i).Child("schema", "openAPIV3Schema")
+		}
+	}
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	if schemaPaths != nil {
+		sharedLinted := false
+		for i, schemaPath := range schemaPaths {
+			if schemaPath.String() != rootPath.String() {
+				continue
+			}
+			if sharedLinted {
+				// the conversion copied the top-level schema into every
+				// version
+				crd.Spec.Versions[i].Schema = nil
+			}
+			sharedLinted = true
+		}
+	}
+	extensions := make([]RuleExtensions, len(crd.Spec.Versions))
+	for i := range crd.Spec.Versions {
+		schemaPath := rootPath
+		if schemaPaths != nil {
+			schemaPath = schemaPaths[i]
+		}
+		if extensions[i], err = extractVersionRuleExtensions(data, i, schemaPath); err != nil {
+			return nil, fmt.Errorf("error reading validation rules: %w", err)
+		}
+	}
+	return l.lint(ctx, crd, extensions, schemaPaths)
+}
+
+// ManifestResult is the result of linting one of the manifests passed to
+// LintManifests.
+type ManifestResult struct {
+	Findings []Finding
+	// Err is the error LintManifest returned for the manifest, if any.
+	Err error
+}
+
+// LintManifests lints manifests concurrently like LintManifest, sharing
+// Options.Jobs between them and allowing Options.Timeout for each of them,
+// and returns their results in the same order. At most Options.Jobs manifests
+// are decoded and linted at the same time.
+func (l *Linter) LintManifests(ctx context.Context, manifests [][]byte) []ManifestResult {
+	return l.lintManifests(ctx, len(manifests), func(ctx context.Context, i int) ([]Finding, error) {
+		return l.LintManifest(ctx, manifests[i])
+	})
+}
+
+// LintBundleManifests lints the CRD manifests of OLM bundles, as returned by
+// BundleCRDs, like LintManifests, except that the findings of v1 CRDs point
+// into their spec.versions[i].schema.openAPIV3Schema.
+func (l *Linter) LintBundleManifests(ctx context.Context, manifests []BundleManifest) []ManifestResult {
+	return l.lintManifests(ctx, len(manifests), func(ctx context.Context, i int) ([]Finding, error) {
+		return l.lintManifest(ctx, manifests[i].Data, true)
+	})
+}
+
+// lintManifests runs lint on the indexes of n manifests concurrently for
+// LintManifests and LintBundleManifests, and returns their results in order.
+func (l *Linter) lintManifests(ctx context.Context, n int, lint func(ctx context.Context, i int) ([]Finding, error)) []ManifestResult {
+	results := make([]ManifestResult, n)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < l.options.Jobs && worker < n; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i].Findings, results[i].Err = lint(ctx, i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// LintOpenAPIDocument lints the schemas LoadOpenAPIDocument loads from data,
+// an OpenAPI v3 document, including the messageExpression, reason and
+// fieldPath fields of their rules. The Version of their findings is the name
+// of the component schema, and their paths point into it, e.g.
+// components.schemas[com.example.v1.Widget].properties[spec]; paths beneath
+// references point into the schema the reference was inlined into. Schemas
+// are linted concurrently and the document is subject to Options.Timeout,
+// like the versions of a CRD passed to Lint.
+func (l *Linter) LintOpenAPIDocument(ctx context.Context, data []byte) ([]Finding, error) {
+	schemas, err := LoadOpenAPIDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	units := make([]lintUnit, len(schemas))
+	for i, schema := range schemas {
+		schema := schema
+		units[i] = lintUnit{name: schema.Name, lint: func(ctx context.Context) ([]Finding, error) {
+			return l.lintSchema(ctx, nil, schema.Schema, schema.RuleExtensions)
+		}}
+	}
+	return l.lintUnits(ctx, "", units)
+}
+
+// lintUnit is a schema linted by lintUnits, such as a version of a CRD.
+type lintUnit struct {
+	name string
+	lint func(ctx context.Context) ([]Finding, error)
+}
+
+// unitResult is the result of linting the unit at index.
+type unitResult struct {
+	index    int
+	findings []Finding
+	err      error
+}
+
+// lint lints the versions of crd, whose schemas are at schemaPaths if not
+// nil, and at spec.validation.openAPIV3Schema otherwise.
+func (l *Linter) lint(ctx context.Context, crd *apiv1.CustomResourceDefinition, extensions []RuleExtensions, schemaPaths []*field.Path) ([]Finding, error) {
+	var units []lintUnit
+	for i, version := range crd.Spec.Versions {
+		if version.Schema == nil || version.Schema.OpenAPIV3Schema == nil {
+			continue
+		}
+		var versionExtensions RuleExtensions
+		if extensions != nil {
+			versionExtensions = extensions[i]
+		}
+		schemaPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+		if schemaPaths != nil {
+			schemaPath = schemaPaths[i]
+		}
+		i := i
+		units = append(units, lintUnit{name: version.Name, lint: func(ctx context.Context) ([]Finding, error) {
+			return l.lintVersion(ctx, crd, i, versionExtensions, schemaPath)
+		}})
+	}
+	return l.lintUnits(ctx, crd.Name, units)
+}
+
+// lintUnits lints units concurrently, up to Options.Jobs at a time across
+// the Linter, and returns their findings in order. name names them in the
+// IncompleteError returned if ctx is done or Options.Timeout elapses first.
+// The timeout starts once the first unit gets a job, so that the time spent
+// waiting for the jobs of other CRDs does not count against it.
+func (l *Linter) lintUnits(ctx context.Context, name string, units []lintUnit) ([]Finding, error) {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timeout := &unitsTimeout{timeout: l.options.Timeout, cancel: cancel}
+	defer timeout.stop()
+
+	// buffered so that units still being linted once ctx is done do not
+	// block
+	results := make(chan unitResult, len(units))
+	for i, unit := range units {
+		go func(i int, unit lintUnit) {
+			select {
+			case l.jobs <- struct{}{}:
+				defer func() { <-l.jobs }()
+			case <-ctx.Done():
+				results <- unitResult{index: i, err: ctx.Err()}
+				return
+			}
+			timeout.start()
+			findings, err := unit.lint(ctx)
+			results <- unitResult{index: i, findings: findings, err: err}
+		}(i, unit)
+	}
+
+	linted := make([]*unitResult, len(units))
+wait:
+	for pending := len(units); pending > 0; pending-- {
+		select {
+		case result := <-results:
+			linted[result.index] = &result
+		case <-ctx.Done():
+			break wait
+		}
+	}
+	// units linted by the time ctx was done are still reported
+	for len(results) > 0 {
+		result := <-results
+		linted[result.index] = &result
+	}
+
+	ctxErr := ctx.Err()
+	var findings []Finding
+	incomplete := &IncompleteError{CRD: name, Err: ctxErr}
+	if timeout.elapsed() && parent.Err() == nil {
+		incomplete.Timeout = l.options.Timeout
+		incomplete.Err = context.DeadlineExceeded
+	}
+	for i, unit := range units {
+		result := linted[i]
+		if result == nil || (ctxErr != nil && errors.Is(result.err, ctxErr)) {
+			incomplete.Skipped = append(incomplete.Skipped, unit.name)
+			continue
+		}
+		if result.err != nil {
+			return nil, result.err
+		}
+		incomplete.Linted = append(incomplete.Linted, unit.name)
+		findings = append(findings, result.findings...)
+	}
+	if len(incomplete.Skipped) > 0 {
+		return findings, incomplete
+	}
+	return findings, nil
+}
+
+// unitsTimeout cancels the context of the units linted by lintUnits once
+// Options.Timeout has elapsed since the first of them got a job.
+type unitsTimeout struct {
+	timeout time.Duration
+	cancel  context.CancelFunc
+
+	once    sync.Once
+	timer   *time.Timer
+	expired int32
+}
+
+// start starts the timeout, unless it has already been started or stopped.
+func (t *unitsTimeout) start() {
+	if t.timeout <= 0 {
+		return
+	}
+	t.once.Do(func() {
+		t.timer = time.AfterFunc(t.timeout, func() {
+			atomic.StoreInt32(&t.expired, 1)
+			t.cancel()
+		})
+	})
+}
+
+// stop stops the timeout, or keeps it from starting.
+func (t *unitsTimeout) stop() {
+	t.once.Do(func() {})
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// elapsed returns true if the timeout elapsed.
+func (t *unitsTimeout) elapsed() bool {
+	return atomic.LoadInt32(&t.expired) == 1
+}
+
+// LintSchema runs the checks of l on schema and returns its findings along
+// with theirs, ordered like those of Lint. Checks see a Target without a CRD
+// or rule extensions.
+func (l *Linter) LintSchema(ctx context.Context, schema *LoadedSchema) ([]Finding, error) {
+	return l.lintSchema(ctx, nil, schema, nil)
+}
+
+// lintVersion runs the checks of l on the version of crd at index i, whose
+// schema is at schemaPath.
+func (l *Linter) lintVersion(ctx context.Context, crd *apiv1.CustomResourceDefinition, i int, extensions RuleExtensions, schemaPath *field.Path) ([]Finding, error) {
+	version := crd.Spec.Versions[i]
+	return l.lintSchema(ctx, crd, loadSchema(version.Name, version.Schema.OpenAPIV3Schema, schemaPath), extensions)
+}
+
+// lintSchema runs the checks of l on schema, a version of crd if crd is not
+// nil.
+func (l *Linter) lintSchema(ctx context.Context, crd *apiv1.CustomResourceDefinition, schema *LoadedSchema, extensions RuleExtensions) ([]Finding, error) {
+	findings := append([]Finding(nil), schema.Findings...)
+	if schema.Structural != nil {
+		checkFindings, err := l.runChecks(ctx, crd, schema, extensions)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, checkFindings...)
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		return comparePaths(findings[i].Path, findings[j].Path) < 0
+	})
+	return findings, nil
+}
+
+// runChecks runs the checks of l on schema, which must be structural, unless
+// it exceeds Options.MaxDepth or Options.MaxNodes.
+func (l *Linter) runChecks(ctx context.Context, crd *apiv1.CustomResourceDefinition, schema *LoadedSchema, extensions RuleExtensions) ([]Finding, error) {
+	errorPrefix := ""
+	if schema.Version != "" {
+		errorPrefix = fmt.Sprintf("version %s: ", schema.Version)
+	}
+	if err := l.options.KubeVersions.Validate(); err != nil {
+		return nil, err
+	}
+	// negative limits are no limits to WalkWithLimits
+	target := &Target{
+		CRD:            crd,
+		Version:        schema.Version,
+		Schema:         schema.Structural,
+		Path:           schema.Path,
+		Props:          schema.Props,
+		RuleExtensions: extensions,
+		KubeVersions:   *l.options.KubeVersions,
+		CostLimits:     CostLimitsFor(*l.options.KubeVersions),
+		HumanReadable:  l.options.HumanReadable,
+	}
+	var findings []Finding
+	runCheck := func(check Check) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		checkFindings, err := check.Run(ctx, target)
+		if err != nil {
+			return fmt.Errorf("%scheck %s: %w", errorPrefix, check.ID(), err)
+		}
+		for _, finding := range checkFindings {
+			if finding.CheckID == "" {
+				finding.CheckID = check.ID()
+			}
+			finding.Version = schema.Version
+			findings = append(findings, finding)
+		}
+		return nil
+	}
+	// the nesting depth is checked before the schema limits, which cut off
+	// the schemas it reports on; its walk stops MaxJSONDepth deep on its own
+	for _, check := range l.checks {
+		if check.ID() == CheckIDNestingDepth {
+			if err := runCheck(check); err != nil {
+				return nil, err
+			}
+		}
+	}
+	limits := WalkLimits{MaxDepth: l.options.MaxDepth, MaxNodes: l.options.MaxNodes}
+	if err := walk(target.Schema, target.path(), limits, func(*Node) bool { return true }); err != nil {
+		limitErr := err.(*WalkLimitError)
+		return append(findings, Finding{CheckID: CheckIDSchemaLimits, Severity: SeverityError, Version: schema.Version, Path: limitErr.Path,
+			Message: fmt.Sprintf("%s; the schema was not checked", limitErr.Error())}), nil
+	}
+	target.rules = newRuleCompiler(target.Schema, target.path())
+	for _, check := range l.checks {
+		if check.ID() == CheckIDNestingDepth {
+			continue
+		}
+		if err := runCheck(check); err != nil {
+			return nil, err
+		}
+	}
+	return findings, nil
+}
+
+// comparePaths compares a and b element by element, comparing indexes
+// numerically so that x-kubernetes-validations[2] sorts before
+// x-kubernetes-validations[10]. A nil path sorts first.
+func comparePaths(a, b *field.Path) int {
+	var aElems, bElems []string
+	if a != nil {
+		aElems = pathElements(a)
+	}
+	if b != nil {
+		bElems = pathElements(b)
+	}
+	for i := 0; i < len(aElems) && i < len(bElems); i++ {
+		if aElems[i] == bElems[i] {
+			continue
+		}
+		aIndex, aErr := strconv.Atoi(aElems[i])
+		bIndex, bErr := strconv.Atoi(bElems[i])
+		if aErr == nil && bErr == nil {
+			if aIndex < bIndex {
+				return -1
+			}
+			return 1
+		}
+		if aElems[i] < bElems[i] {
+			return -1
+		}
+		return 1
+	}
+	return len(aElems) - len(bElems)
+}
+
+// pathElements returns the elements of path, root first: the names of its
+// children and its indexes and keys, e.g. a, b, c.d, e and 0 for
+// a.b[c.d].e[0]. field.Path does not export its elements, or its parent, so
+// they are read with reflection rather than parsed back from its String,
+// which is ambiguous for keys holding '.', '[' or ']'.
+func pathElements(path *field.Path) []string {
+	var elems []string
+	for p := reflect.ValueOf(path); !p.IsNil(); p = p.Elem().FieldByName("parent") {
+		elem := p.Elem().FieldByName("name").String()
+		if elem == "" {
+			elem = p.Elem().FieldByName("index").String()
+		}
+		elems = append(elems, elem)
+	}
+	for i, j := 0, len(elems)-1; i < j; i, j = i+1, j-1 {
+		elems[i], elems[j] = elems[j], elems[i]
+	}
+	return elems
+}
+
+// DecodeCRD decodes a v1 or v1beta1 CustomResourceDefinition, or a Crossplane
+// CompositeResourceDefinition, from YAML or JSON. v1beta1 CRDs are converted
+// to v1 with ConvertV1beta1CRD, and CompositeResourceDefinitions to the CRD of
+// their composite resources.
+func DecodeCRD(data []byte) (*apiv1.CustomResourceDefinition, error) {
+	crd, _, err := decodeCRD(data)
+	return crd, err
+}
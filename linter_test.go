@@ -0,0 +1,669 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const linterCRD = `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Widget
+    plural: widgets
+  scope: Namespaced
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            x-kubernetes-validations:
+            - rule: self.name.matches(self.pattern)
+              reason: Bogus
+            properties:
+              name:
+                type: string
+                maxLength: 64
+              pattern:
+                type: string
+                enum: ["^a", "^b"]
+  - name: v2
+    served: true
+    storage: false
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            x-kubernetes-validations:
+            - rule: self.nope
+`
+
+// ruleCounter is a custom check counting the rules of the root schema node.
+type ruleCounter struct{}
+
+func (ruleCounter) ID() string {
+	return "rule-counter"
+}
+
+func (ruleCounter) Run(ctx context.Context, target *Target) ([]Finding, error) {
+	if len(target.Schema.Properties["spec"].Extensions.XValidations) == 0 {
+		return nil, nil
+	}
+	return []Finding{{Severity: SeverityWarning, Message: "spec has rules"}}, nil
+}
+
+func TestLintManifest(t *testing.T) {
+	specPath := field.NewPath("spec", "validation", "openAPIV3Schema").Child("properties").Key("spec")
+	rulePath := specPath.Child("x-kubernetes-validations").Index(0)
+	cases := []struct {
+		name             string
+		options          Options
+		expectedFindings []Finding
+	}{
+		{
+			name:    "default",
+			options: Options{},
+			expectedFindings: []Finding{
+				{CheckID: CheckIDLimits, Severity: SeverityInfo, Version: "v1", Path: specPath.Child("properties").Key("pattern"), SuggestedFix: "set maxLength: 2"},
+				{CheckID: CheckIDRuleExtensions, Severity: SeverityError, Version: "v1", Path: rulePath.Child("reason")},
+				{CheckID: CheckIDCost, Severity: SeverityError, Version: "v1", Path: rulePath.Child("rule")},
+				{CheckID: CheckIDStringOps, Severity: SeverityWarning, Version: "v1", Path: rulePath.Child("rule"), Position: &Position{Line: 1, Column: 18}},
+				{CheckID: CheckIDCost, Severity: SeverityError, Version: "v2", Path: rulePath.Child("rule")},
+			},
+		},
+		{
+			name:    "disabled",
+			options: Options{Disabled: []string{CheckIDLimits, CheckIDStringOps}},
+			expectedFindings: []Finding{
+				{CheckID: CheckIDRuleExtensions, Severity: SeverityError, Version: "v1", Path: rulePath.Child("reason")},
+				{CheckID: CheckIDCost, Severity: SeverityError, Version: "v1", Path: rulePath.Child("rule")},
+				{CheckID: CheckIDCost, Severity: SeverityError, Version: "v2", Path: rulePath.Child("rule")},
+			},
+		},
+		{
+			name:    "custom",
+			options: Options{Checks: []Check{ruleCounter{}}},
+			expectedFindings: []Finding{
+				{CheckID: "rule-counter", Severity: SeverityWarning, Version: "v1"},
+				{CheckID: "rule-counter", Severity: SeverityWarning, Version: "v2"},
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			findings, err := NewLinter(tt.options).LintManifest(context.Background(), []byte(linterCRD))
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if len(findings) != len(tt.expectedFindings) {
+				t.Fatalf("Wrong number of findings (got %v, expected %v)", findings, tt.expectedFindings)
+			}
+			for i, finding := range findings {
+				expected := tt.expectedFindings[i]
+				if finding.CheckID != expected.CheckID || finding.Severity != expected.Severity || finding.Version != expected.Version || finding.SuggestedFix != expected.SuggestedFix {
+					t.Errorf("Wrong finding (expected %+v, got %+v)", expected, finding)
+				}
+				if (finding.Path == nil) != (expected.Path == nil) || (expected.Path != nil && finding.Path.String() != expected.Path.String()) {
+					t.Errorf("Wrong path (expected %v, got %v)", expected.Path, finding.Path)
+				}
+				if (finding.Position == nil) != (expected.Position == nil) || (expected.Position != nil && *finding.Position != *expected.Position) {
+					t.Errorf("Wrong position (expected %v, got %v)", expected.Position, finding.Position)
+				}
+				if finding.Message == "" {
+					t.Errorf("Finding has no message: %+v", finding)
+				}
+			}
+		})
+	}
+}
+
+const severityCRD = `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Widget
+    plural: widgets
+  scope: Namespaced
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            x-kubernetes-validations:
+            - rule: self.config.foo == 'a'
+            - rule: self.tags.all(x, self.tags.exists_one(y, x == y))
+            - rule: self.tags.all(x, x + 'a' != 'b')
+            properties:
+              name:
+                type: string
+                maxLength: 10
+                x-kubernetes-validations:
+                - rule: self.size() <= 10
+              config:
+                type: object
+                x-kubernetes-preserve-unknown-fields: true
+              tags:
+                type: array
+                maxItems: 10
+                items:
+                  type: string
+                  maxLength: 10
+              label:
+                type: string
+                anyOf:
+                - maxLength: 5
+                - maxLength: 10
+`
+
+func TestDefaultCheckSeverities(t *testing.T) {
+	expectedSeverities := map[string]Severity{
+		CheckIDConstraints:        SeverityInfo,
+		CheckIDJunctorLimits:      SeverityWarning,
+		CheckIDFreeFormReferences: SeverityWarning,
+		CheckIDComplexity:         SeverityWarning,
+		CheckIDStringOps:          SeverityWarning,
+	}
+	findings, err := NewLinter(Options{}).LintManifest(context.Background(), []byte(severityCRD))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	found := map[string]bool{}
+	for _, finding := range findings {
+		expected, ok := expectedSeverities[finding.CheckID]
+		if !ok {
+			continue
+		}
+		found[finding.CheckID] = true
+		if finding.Severity != expected {
+			t.Errorf("Wrong severity for %s (expected %s, got %s)", finding, expected, finding.Severity)
+		}
+	}
+	for checkID := range expectedSeverities {
+		if !found[checkID] {
+			t.Errorf("No %s finding in %v", checkID, findings)
+		}
+	}
+}
+
+func TestLintCanceled(t *testing.T) {
+	crd, err := DecodeCRD([]byte(linterCRD))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewLinter(Options{}).Lint(ctx, crd); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestComparePaths(t *testing.T) {
+	rulesPath := field.NewPath("spec", "validation", "openAPIV3Schema").Child("x-kubernetes-validations")
+	sorted := []*field.Path{
+		nil,
+		field.NewPath("spec", "validation", "openAPIV3Schema"),
+		field.NewPath("spec", "validation", "openAPIV3Schema").Child("properties").Key("a.z"),
+		field.NewPath("spec", "validation", "openAPIV3Schema").Child("properties").Key("b"),
+		field.NewPath("spec", "validation", "openAPIV3Schema").Child("properties").Key("b").Child("properties").Key("a"),
+		// prints as properties[b]], which does not split into b and ]
+		field.NewPath("spec", "validation", "openAPIV3Schema").Child("properties").Key("b]"),
+		rulesPath.Index(2).Child("rule"),
+		rulesPath.Index(10).Child("reason"),
+		rulesPath.Index(10).Child("rule"),
+	}
+	for i := range sorted {
+		for j := range sorted {
+			result := comparePaths(sorted[i], sorted[j])
+			if (i < j && result >= 0) || (i == j && result != 0) || (i > j && result <= 0) {
+				t.Errorf("comparePaths(%v, %v) = %d", sorted[i], sorted[j], result)
+			}
+		}
+	}
+}
+
+func TestFindingString(t *testing.T) {
+	tests := []struct {
+		name     string
+		finding  Finding
+		expected string
+	}{
+		{
+			name:     "messageOnly",
+			finding:  Finding{CheckID: CheckIDCost, Message: "too expensive"},
+			expected: "[cost] too expensive",
+		},
+		{
+			name:     "position",
+			finding:  Finding{CheckID: CheckIDStringOps, Message: "unbounded", Position: &Position{Line: 1, Column: 5}},
+			expected: "[string-ops] unbounded (at 1:5 in the rule)",
+		},
+		{
+			name:     "suggestedFix",
+			finding:  Finding{CheckID: CheckIDLimits, Message: "missing maxLength", SuggestedFix: "set maxLength: 36"},
+			expected: "[limits] missing maxLength; suggested fix: set maxLength: 36",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if s := test.finding.String(); s != test.expected {
+				t.Errorf("Wrong string (expected %q, got %q)", test.expected, s)
+			}
+		})
+	}
+}
+
+func TestLintDeterministic(t *testing.T) {
+	// enough properties for map iteration order to vary between runs
+	var props strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&props, "              p%d:\n                type: string\n", i)
+	}
+	crd := strings.Replace(linterCRD, "              name:\n", props.String()+"              name:\n", 1)
+	var expected []string
+	for run := 0; run < 5; run++ {
+		findings, err := NewLinter(Options{}).LintManifest(context.Background(), []byte(crd))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		var messages []string
+		for _, finding := range findings {
+			messages = append(messages, finding.Message)
+		}
+		if run == 0 {
+			expected = messages
+		} else if !reflect.DeepEqual(messages, expected) {
+			t.Fatalf("Findings differ between runs (got %v, expected %v)", messages, expected)
+		}
+	}
+}
+
+// blockingCheck blocks on the versions in block until ctx is done, and
+// records how many versions it runs on at the same time.
+type blockingCheck struct {
+	block   map[string]bool
+	running int32
+	max     int32
+}
+
+func (*blockingCheck) ID() string {
+	return "blocking"
+}
+
+func (b *blockingCheck) Run(ctx context.Context, target *Target) ([]Finding, error) {
+	running := atomic.AddInt32(&b.running, 1)
+	defer atomic.AddInt32(&b.running, -1)
+	for {
+		max := atomic.LoadInt32(&b.max)
+		if running <= max || atomic.CompareAndSwapInt32(&b.max, max, running) {
+			break
+		}
+	}
+	if b.block[target.Version] {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	time.Sleep(time.Millisecond)
+	return []Finding{{Severity: SeverityWarning, Message: "linted"}}, nil
+}
+
+func TestLintTimeout(t *testing.T) {
+	check := &blockingCheck{block: map[string]bool{"v2": true}}
+	linter := NewLinter(Options{Checks: []Check{check}, Jobs: 2, Timeout: 50 * time.Millisecond})
+	findings, err := linter.LintManifest(context.Background(), []byte(linterCRD))
+	var incomplete *IncompleteError
+	if !errors.As(err, &incomplete) {
+		t.Fatalf("Expected an IncompleteError, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) || incomplete.Timeout != 50*time.Millisecond {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if !reflect.DeepEqual(incomplete.Linted, []string{"v1"}) || !reflect.DeepEqual(incomplete.Skipped, []string{"v2"}) {
+		t.Errorf("Wrong versions (expected v1 linted and v2 skipped, got %v and %v)", incomplete.Linted, incomplete.Skipped)
+	}
+	if len(findings) != 1 || findings[0].Version != "v1" {
+		t.Errorf("Expected the findings of v1, got %v", findings)
+	}
+}
+
+// sleepingCheck sleeps on every version.
+type sleepingCheck struct {
+	sleep time.Duration
+}
+
+func (*sleepingCheck) ID() string {
+	return "sleeping"
+}
+
+func (s *sleepingCheck) Run(ctx context.Context, target *Target) ([]Finding, error) {
+	time.Sleep(s.sleep)
+	return nil, nil
+}
+
+func TestLintTimeoutExcludesQueueing(t *testing.T) {
+	// each CRD takes about 40ms with one job, but they take 160ms together
+	linter := NewLinter(Options{Checks: []Check{&sleepingCheck{sleep: 20 * time.Millisecond}}, Jobs: 1, Timeout: 100 * time.Millisecond})
+	manifests := [][]byte{[]byte(linterCRD), []byte(linterCRD), []byte(linterCRD), []byte(linterCRD)}
+	for i, result := range linter.LintManifests(context.Background(), manifests) {
+		if result.Err != nil {
+			t.Errorf("Unexpected error for manifest %d: %s", i, result.Err)
+		}
+	}
+}
+
+func TestLintManifests(t *testing.T) {
+	check := &blockingCheck{}
+	linter := NewLinter(Options{Checks: []Check{check}, Jobs: 2})
+	manifests := [][]byte{[]byte("kind: Nope")}
+	for i := 0; i < 8; i++ {
+		manifests = append(manifests, []byte(linterCRD))
+	}
+	results := linter.LintManifests(context.Background(), manifests)
+	if len(results) != len(manifests) {
+		t.Fatalf("Wrong number of results (got %d, expected %d)", len(results), len(manifests))
+	}
+	if results[0].Err == nil {
+		t.Errorf("Expected an error for an invalid manifest")
+	}
+	for _, result := range results[1:] {
+		if result.Err != nil {
+			t.Errorf("Unexpected error: %s", result.Err)
+		}
+		if len(result.Findings) != 2 || result.Findings[0].Version != "v1" || result.Findings[1].Version != "v2" {
+			t.Errorf("Wrong findings: %v", result.Findings)
+		}
+	}
+	if check.max > 2 {
+		t.Errorf("Linted %d versions at the same time with 2 jobs", check.max)
+	}
+}
+
+func TestLintBundleManifests(t *testing.T) {
+	manifests := []BundleManifest{
+		{Path: "manifests/widgets.crd.yaml", Data: []byte(linterCRD)},
+		{Path: "manifests/legacy.crd.yaml", Data: []byte(v1beta1CRD)},
+	}
+	results := NewLinter(Options{}).LintBundleManifests(context.Background(), manifests)
+	if len(results) != len(manifests) {
+		t.Fatalf("Wrong number of results (got %d, expected %d)", len(results), len(manifests))
+	}
+	expectedRoots := []map[string]string{
+		{
+			"v1": "spec.versions[0].schema.openAPIV3Schema",
+			"v2": "spec.versions[1].schema.openAPIV3Schema",
+		},
+		// v1beta1 CRDs keep pointing into their own layout
+		{"v1": "spec.validation.openAPIV3Schema"},
+	}
+	for i, result := range results {
+		if result.Err != nil {
+			t.Fatalf("Unexpected error for %s: %s", manifests[i].Path, result.Err)
+		}
+		if len(result.Findings) == 0 {
+			t.Errorf("No findings for %s", manifests[i].Path)
+		}
+		for _, finding := range result.Findings {
+			if root := expectedRoots[i][finding.Version]; !strings.HasPrefix(finding.Path.String(), root+".") {
+				t.Errorf("Wrong path for %s (expected it beneath %q, got %s)", manifests[i].Path, root, finding)
+			}
+		}
+	}
+}
+
+func TestLintSchemaLimits(t *testing.T) {
+	specPath := field.NewPath("spec", "validation", "openAPIV3Schema").Child("properties").Key("spec")
+	cases := []struct {
+		name          string
+		options       Options
+		expectedPath  *field.Path
+		expectedCount int
+	}{
+		{
+			name:          "too many nodes",
+			options:       Options{MaxNodes: 3},
+			expectedPath:  specPath.Child("properties").Key("pattern"),
+			expectedCount: 2,
+		},
+		{
+			name:          "too deep",
+			options:       Options{MaxDepth: 1},
+			expectedPath:  specPath.Child("properties").Key("name"),
+			expectedCount: 2,
+		},
+		{
+			name:          "no limits",
+			options:       Options{MaxDepth: -1, MaxNodes: -1},
+			expectedCount: 5,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			findings, err := NewLinter(tt.options).LintManifest(context.Background(), []byte(linterCRD))
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if len(findings) != tt.expectedCount {
+				t.Fatalf("Wrong number of findings (got %v, expected %d)", findings, tt.expectedCount)
+			}
+			var limitFindings []Finding
+			for _, finding := range findings {
+				if finding.CheckID == CheckIDSchemaLimits {
+					limitFindings = append(limitFindings, finding)
+				}
+			}
+			if tt.expectedPath == nil {
+				if len(limitFindings) > 0 {
+					t.Errorf("Unexpected findings: %v", limitFindings)
+				}
+				return
+			}
+			if len(limitFindings) != 1 || limitFindings[0].Version != "v1" || limitFindings[0].Severity != SeverityError || limitFindings[0].Path.String() != tt.expectedPath.String() {
+				t.Errorf("Wrong findings (expected one for v1 at %s, got %v)", tt.expectedPath, limitFindings)
+			}
+		})
+	}
+}
+
+func TestLintNestingDepthBeyondSchemaLimits(t *testing.T) {
+	// openAPIV3Schema is 6 levels deep, list 8 and each items one more, so
+	// the innermost items is one level beyond MaxJSONDepth
+	listPath := field.NewPath("spec", "validation", "openAPIV3Schema").Child("properties").Key("list")
+	list := apiv1.JSONSchemaProps{Type: "string"}
+	for i := 0; i < MaxJSONDepth-6; i++ {
+		items := list
+		list = apiv1.JSONSchemaProps{Type: "array", MaxItems: int64ptr(10), Items: &apiv1.JSONSchemaPropsOrArray{Schema: &items}}
+	}
+	crd := &apiv1.CustomResourceDefinition{
+		Spec: apiv1.CustomResourceDefinitionSpec{
+			Group: "example.com",
+			Names: apiv1.CustomResourceDefinitionNames{Plural: "widgets", Kind: "Widget"},
+			Versions: []apiv1.CustomResourceDefinitionVersion{{
+				Name: "v1",
+				Schema: &apiv1.CustomResourceValidation{OpenAPIV3Schema: &apiv1.JSONSchemaProps{
+					Type:       "object",
+					Properties: map[string]apiv1.JSONSchemaProps{"list": list},
+				}},
+			}},
+		},
+	}
+	findings, err := NewLinter(Options{}).Lint(context.Background(), crd)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expectedPaths := map[string]*field.Path{
+		CheckIDNestingDepth: nestedPath(MaxJSONDepth-7, listPath, func(path *field.Path) *field.Path { return path.Child("items") }),
+		CheckIDSchemaLimits: nestedPath(DefaultMaxDepth, listPath, func(path *field.Path) *field.Path { return path.Child("items") }),
+	}
+	if len(findings) != len(expectedPaths) {
+		t.Fatalf("Wrong number of findings (got %v, expected %d)", findings, len(expectedPaths))
+	}
+	for _, finding := range findings {
+		expected, ok := expectedPaths[finding.CheckID]
+		if !ok || finding.Path.String() != expected.String() {
+			t.Errorf("Unexpected finding %s", finding)
+		}
+	}
+}
+
+func TestLintManifestV1beta1(t *testing.T) {
+	sharedCRD := `
+apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Widget
+    plural: widgets
+  scope: Namespaced
+  versions:
+  - name: v1
+    served: true
+    storage: true
+  - name: v2
+    served: true
+    storage: false
+  validation:
+    openAPIV3Schema:
+      type: object
+      properties:
+        spec:
+          type: object
+          x-kubernetes-validations:
+          - rule: self.nope
+            reason: Bogus
+`
+	perVersionCRD := strings.Replace(linterCRD, "apiextensions.k8s.io/v1\n", "apiextensions.k8s.io/v1beta1\n", 1)
+	sharedPath := field.NewPath("spec", "validation", "openAPIV3Schema").Child("properties").Key("spec").Child("x-kubernetes-validations").Index(0)
+	v1Path := field.NewPath("spec", "versions").Index(0).Child("schema", "openAPIV3Schema").Child("properties").Key("spec").Child("x-kubernetes-validations").Index(0)
+	bracketProperty := field.NewPath("spec", "versions").Index(0).Child("schema", "openAPIV3Schema").Child("properties").Key("spec]x")
+	bracketPath := bracketProperty.Child("x-kubernetes-validations").Index(0)
+	cases := []struct {
+		name             string
+		manifest         string
+		expectedFindings []Finding
+	}{
+		{
+			name:     "top-level schema",
+			manifest: sharedCRD,
+			expectedFindings: []Finding{
+				{CheckID: CheckIDRuleExtensions, Version: "v1", Path: sharedPath.Child("reason")},
+				{CheckID: CheckIDCost, Version: "v1", Path: sharedPath.Child("rule")},
+			},
+		},
+		{
+			name:     "version schemas",
+			manifest: perVersionCRD,
+			expectedFindings: []Finding{
+				{CheckID: CheckIDRuleExtensions, Version: "v1", Path: v1Path.Child("reason")},
+				{CheckID: CheckIDCost, Version: "v1", Path: v1Path.Child("rule")},
+			},
+		},
+		{
+			name:     "property name with brackets",
+			manifest: strings.ReplaceAll(perVersionCRD, "          spec:\n", "          spec]x:\n"),
+			expectedFindings: []Finding{
+				{CheckID: CheckIDPropertyNames, Version: "v1", Path: bracketProperty},
+				{CheckID: CheckIDRuleExtensions, Version: "v1", Path: bracketPath.Child("reason")},
+				{CheckID: CheckIDCost, Version: "v1", Path: bracketPath.Child("rule")},
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			findings, err := NewLinter(Options{Disabled: []string{CheckIDLimits, CheckIDStringOps}}).LintManifest(context.Background(), []byte(tt.manifest))
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			var versionFindings []Finding
+			for _, finding := range findings {
+				if finding.Version == tt.expectedFindings[0].Version {
+					versionFindings = append(versionFindings, finding)
+				} else if finding.Path != nil && strings.HasPrefix(finding.Path.String(), "spec.validation") {
+					t.Errorf("Finding of %s points into the top-level schema: %+v", finding.Version, finding)
+				}
+			}
+			if len(versionFindings) != len(tt.expectedFindings) {
+				t.Fatalf("Wrong findings (got %v, expected %v)", versionFindings, tt.expectedFindings)
+			}
+			for i, finding := range versionFindings {
+				expected := tt.expectedFindings[i]
+				if finding.CheckID != expected.CheckID || finding.Path.String() != expected.Path.String() {
+					t.Errorf("Wrong finding (expected %s at %s, got %s at %s)", expected.CheckID, expected.Path, finding.CheckID, finding.Path)
+				}
+				if expected.CheckID == CheckIDRuleExtensions && !strings.Contains(finding.Message, expected.Path.String()) {
+					t.Errorf("Message does not quote %s: %s", expected.Path, finding.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestLintManifestTargetPath(t *testing.T) {
+	// messages are reported as is, even if they quote the default root path
+	message := "spec.validation.openAPIV3Schema declares no rule"
+	check := &checkFunc{id: "root", run: func(target *Target) []Finding {
+		var findings []Finding
+		target.Walk(func(node *Node) bool {
+			findings = append(findings, Finding{Severity: SeverityInfo, Path: node.Path, Message: message})
+			return false
+		})
+		return findings
+	}}
+	perVersionCRD := strings.Replace(linterCRD, "apiextensions.k8s.io/v1\n", "apiextensions.k8s.io/v1beta1\n", 1)
+	findings, err := NewLinter(Options{Checks: []Check{check}}).LintManifest(context.Background(), []byte(perVersionCRD))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(findings) != 2 {
+		t.Fatalf("Wrong number of findings (expected 2, got %v)", findings)
+	}
+	for i, finding := range findings {
+		expectedPath := field.NewPath("spec", "versions").Index(i).Child("schema", "openAPIV3Schema")
+		if finding.Path.String() != expectedPath.String() || finding.Message != message {
+			t.Errorf("Wrong finding (expected %q at %s, got %q at %s)", message, expectedPath, finding.Message, finding.Path)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+	"strings"
+
+	api "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiinstall "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/install"
+	apiv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/runtime"
+	runtimeserializer "k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// CheckIDStructuralSchema identifies the findings reported for schemas that
+// cannot be converted to structural schemas, or that the apiserver rejects as
+// not structural, e.g. because a property has no type. Checks are not run on
+// such schemas.
+const CheckIDStructuralSchema = "structural-schema"
+
+// LoadedSchema is a schema loaded by LoadSchema, LoadCRD or LoadManifest,
+// ready to be linted by Linter.LintSchema.
+type LoadedSchema struct {
+	// Version is the name of the CRD version declaring the schema, if any.
+	Version string
+	// Path is the path to the schema in the document declaring it, which the
+	// paths of its findings start with. LoadSchema and LoadCRD use
+	// spec.validation.openAPIV3Schema, the path the apiserver reports.
+	Path *field.Path
+	// Props is the schema in the internal representation of the apiserver.
+	Props *api.JSONSchemaProps
+	// Structural is the structural schema of Props, or nil if Props could not
+	// be converted or is not structural, in which case Findings say why.
+	Structural *structuralschema.Structural
+	// Findings are the CheckIDStructuralSchema findings of the schema.
+	Findings []Finding
+}
+
+// LoadSchema converts props, the openAPIV3Schema of a CRD version, to a
+// structural schema, and reports what prevents it as findings.
+func LoadSchema(props *apiv1.JSONSchemaProps) *LoadedSchema {
+	return loadSchema("", props, field.NewPath("spec", "validation", "openAPIV3Schema"))
+}
+
+// loadSchema loads v1Props, the schema at rootPath, like LoadSchema.
+func loadSchema(version string, v1Props *apiv1.JSONSchemaProps, rootPath *field.Path) *LoadedSchema {
+	loaded := &LoadedSchema{Version: version, Path: rootPath, Props: &api.JSONSchemaProps{}}
+	report := func(path *field.Path, message string) {
+		loaded.Findings = append(loaded.Findings, Finding{CheckID: CheckIDStructuralSchema, Severity: SeverityError, Version: version, Path: path, Message: message})
+	}
+	if err := apiv1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(v1Props, loaded.Props, nil); err != nil {
+		report(rootPath, fmt.Sprintf("error during schema conversion: %s", err))
+		return loaded
+	}
+	structural, err := structuralschema.NewStructural(loaded.Props)
+	if err != nil {
+		report(rootPath, fmt.Sprintf("error converting to structural schema: %s", err))
+		return loaded
+	}
+	structuralErrors := structuralschema.ValidateStructural(rootPath, structural)
+	for _, e := range structuralErrors {
+		report(structuralErrorPath(structural, rootPath, e.Field), fmt.Sprintf("schema is not structural: %s", e.Error()))
+	}
+	if len(structuralErrors) == 0 {
+		loaded.Structural = structural
+	}
+	return loaded
+}
+
+// LoadCRD loads the schema of every version of crd that has one, in the order
+// the CRD declares them.
+func LoadCRD(crd *apiv1.CustomResourceDefinition) []*LoadedSchema {
+	var schemas []*LoadedSchema
+	for _, version := range crd.Spec.Versions {
+		if version.Schema == nil || version.Schema.OpenAPIV3Schema == nil {
+			continue
+		}
+		schemas = append(schemas, loadSchema(version.Name, version.Schema.OpenAPIV3Schema, field.NewPath("spec", "validation", "openAPIV3Schema")))
+	}
+	return schemas
+}
+
+// LoadManifest decodes a CRD from YAML or JSON like DecodeCRD, and loads the
+// schemas of its versions like LoadCRD.
+func LoadManifest(data []byte) (*apiv1.CustomResourceDefinition, []*LoadedSchema, error) {
+	crd, err := DecodeCRD(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return crd, LoadCRD(crd), nil
+}
+
+// decodeCRD decodes a CRD like DecodeCRD, and returns the paths of the
+// schemas of its versions in data if it is not a v1 CRD: for v1beta1 CRDs, the
+// top-level spec.validation.openAPIV3Schema, or
+// spec.versions[i].schema.openAPIV3Schema for versions declaring their own.
+func decodeCRD(data []byte) (*apiv1.CustomResourceDefinition, []*field.Path, error) {
+	if isCompositeResourceDefinition(data) {
+		return decodeCompositeResourceDefinition(data)
+	}
+	obj, err := decodeManifest(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch obj := obj.(type) {
+	case *apiv1.CustomResourceDefinition:
+		return obj, nil, nil
+	case *apiv1beta1.CustomResourceDefinition:
+		crd, err := ConvertV1beta1CRD(obj)
+		if err != nil {
+			return nil, nil, err
+		}
+		schemaPaths := make([]*field.Path, len(crd.Spec.Versions))
+		for i := range schemaPaths {
+			schemaPaths[i] = field.NewPath("spec", "validation", "openAPIV3Schema")
+			if i < len(obj.Spec.Versions) && obj.Spec.Versions[i].Schema != nil && obj.Spec.Versions[i].Schema.OpenAPIV3Schema != nil {
+				schemaPaths[i] = field.NewPath("spec", "versions").Index(i).Child("schema", "openAPIV3Schema")
+			}
+		}
+		return crd, schemaPaths, nil
+	}
+	return nil, nil, fmt.Errorf("unexpected decoded object (expected CustomResourceDefinition), got %T", obj)
+}
+
+// ConvertV1beta1CRD converts crd to v1 the way the apiserver does, applying
+// v1beta1 defaults first: the top-level validation schema, if any, becomes
+// the schema of every version.
+func ConvertV1beta1CRD(crd *apiv1beta1.CustomResourceDefinition) (*apiv1.CustomResourceDefinition, error) {
+	scheme := newCRDScheme()
+	defaulted := crd.DeepCopy()
+	scheme.Default(defaulted)
+	internal := &api.CustomResourceDefinition{}
+	if err := scheme.Convert(defaulted, internal, nil); err != nil {
+		return nil, fmt.Errorf("error converting v1beta1 CRD: %w", err)
+	}
+	converted := &apiv1.CustomResourceDefinition{}
+	if err := scheme.Convert(internal, converted, nil); err != nil {
+		return nil, fmt.Errorf("error converting v1beta1 CRD: %w", err)
+	}
+	converted.APIVersion = apiv1.SchemeGroupVersion.String()
+	converted.Kind = "CustomResourceDefinition"
+	return converted, nil
+}
+
+// newCRDScheme returns a scheme holding the apiextensions types and their
+// conversions.
+func newCRDScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	apiinstall.Install(scheme)
+	return scheme
+}
+
+// decodeManifest decodes an apiextensions object from YAML or JSON.
+func decodeManifest(data []byte) (runtime.Object, error) {
+	codecs := runtimeserializer.NewCodecFactory(newCRDScheme())
+	obj, _, err := codecs.UniversalDeserializer().Decode(data, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding: %w", err)
+	}
+	return obj, nil
+}
+
+// structuralErrorPath returns the path of errorField, the field of an error
+// ValidateStructural reported for schema, the schema at root: the path to the
+// schema node or nested value validation the error is reported on, followed by
+// the keyword it is reported for, if any. Elements are matched against the
+// properties and junctors of the schema rather than parsed, as property names
+// may contain dots and brackets.
+func structuralErrorPath(schema *structuralschema.Structural, root *field.Path, errorField string) *field.Path {
+	// element is a node beneath the node at path, which formats as name
+	// after the path of its parent
+	type element struct {
+		name   string
+		path   *field.Path
+		schema *structuralschema.Structural
+		nested *structuralschema.NestedValueValidation
+	}
+	path, rest := root, strings.TrimPrefix(errorField, root.String())
+	structural, nested := schema, (*structuralschema.NestedValueValidation)(nil)
+	for rest != "" {
+		var elements []element
+		addProperty := func(name string, schema *structuralschema.Structural, nested *structuralschema.NestedValueValidation) {
+			elements = append(elements, element{name: ".properties[" + name + "]", path: path.Child("properties").Key(name), schema: schema, nested: nested})
+		}
+		addJunctors := func(v *structuralschema.ValueValidation) {
+			if v == nil {
+				return
+			}
+			for _, junctor := range []struct {
+				name     string
+				branches []structuralschema.NestedValueValidation
+			}{{"allOf", v.AllOf}, {"anyOf", v.AnyOf}, {"oneOf", v.OneOf}} {
+				for i := range junctor.branches {
+					elements = append(elements, element{name: fmt.Sprintf(".%s[%d]", junctor.name, i), path: path.Child(junctor.name).Index(i), nested: &junctor.branches[i]})
+				}
+			}
+			if v.Not != nil {
+				elements = append(elements, element{name: ".not", path: path.Child("not"), nested: v.Not})
+			}
+		}
+		if structural != nil {
+			for name := range structural.Properties {
+				propSchema := structural.Properties[name]
+				addProperty(name, &propSchema, nil)
+			}
+			if structural.Items != nil {
+				elements = append(elements, element{name: ".items", path: path.Child("items"), schema: structural.Items})
+			}
+			if structural.AdditionalProperties != nil && structural.AdditionalProperties.Structural != nil {
+				elements = append(elements, element{name: ".additionalProperties", path: path.Child("additionalProperties"), schema: structural.AdditionalProperties.Structural})
+			}
+			addJunctors(structural.ValueValidation)
+		} else {
+			for name := range nested.Properties {
+				propNested := nested.Properties[name]
+				addProperty(name, nil, &propNested)
+			}
+			if nested.Items != nil {
+				elements = append(elements, element{name: ".items", path: path.Child("items"), nested: nested.Items})
+			}
+			addJunctors(&nested.ValueValidation)
+		}
+		// the longest match, in case a property name starts like another
+		// followed by more elements
+		var next *element
+		for i, e := range elements {
+			if strings.HasPrefix(rest, e.name) && (len(rest) == len(e.name) || rest[len(e.name)] == '.') && (next == nil || len(e.name) > len(next.name)) {
+				next = &elements[i]
+			}
+		}
+		if next == nil {
+			// the keyword the error is reported for
+			return path.Child(strings.TrimPrefix(rest, "."))
+		}
+		path, rest, structural, nested = next.path, rest[len(next.name):], next.schema, next.nested
+	}
+	return path
+}
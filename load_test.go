@@ -0,0 +1,198 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	apiv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const v1beta1CRD = `
+apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Widget
+    plural: widgets
+  scope: Namespaced
+  version: v1
+  validation:
+    openAPIV3Schema:
+      type: object
+      properties:
+        spec:
+          type: object
+          properties:
+            name:
+              type: string
+`
+
+func TestLoadSchema(t *testing.T) {
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	tests := []struct {
+		name          string
+		props         *apiv1.JSONSchemaProps
+		expectedPaths []*field.Path
+	}{
+		{
+			name: "structural",
+			props: &apiv1.JSONSchemaProps{
+				Type: "object",
+				Properties: map[string]apiv1.JSONSchemaProps{
+					"name": {Type: "string"},
+				},
+			},
+		},
+		{
+			name: "missing types",
+			props: &apiv1.JSONSchemaProps{
+				Type: "object",
+				Properties: map[string]apiv1.JSONSchemaProps{
+					"name": {},
+					"list": {Type: "array", Items: &apiv1.JSONSchemaPropsOrArray{Schema: &apiv1.JSONSchemaProps{}}},
+				},
+			},
+			expectedPaths: []*field.Path{
+				rootPath.Child("properties").Key("list").Child("items", "type"),
+				rootPath.Child("properties").Key("name").Child("type"),
+			},
+		},
+		{
+			name: "not convertible",
+			props: &apiv1.JSONSchemaProps{
+				Type: "object",
+				ID:   "widget",
+			},
+			expectedPaths: []*field.Path{rootPath},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded := LoadSchema(tt.props)
+			if (loaded.Structural == nil) != (len(tt.expectedPaths) > 0) {
+				t.Errorf("Wrong structural schema: %v", loaded.Structural)
+			}
+			findings, err := NewLinter(Options{}).LintSchema(context.Background(), loaded)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			var paths []*field.Path
+			for _, finding := range findings {
+				if finding.CheckID == CheckIDStructuralSchema {
+					paths = append(paths, finding.Path)
+				}
+			}
+			if len(paths) != len(tt.expectedPaths) {
+				t.Fatalf("Wrong findings (got %v, expected paths %v)", findings, tt.expectedPaths)
+			}
+			for i, path := range paths {
+				if path.String() != tt.expectedPaths[i].String() {
+					t.Errorf("Wrong path (expected %s, got %s)", tt.expectedPaths[i], path)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	tests := []struct {
+		name             string
+		manifest         string
+		expectedVersions []string
+		expectError      bool
+	}{
+		{
+			name:             "v1",
+			manifest:         linterCRD,
+			expectedVersions: []string{"v1", "v2"},
+		},
+		{
+			name:             "v1beta1",
+			manifest:         v1beta1CRD,
+			expectedVersions: []string{"v1"},
+		},
+		{
+			name:        "not a CRD",
+			manifest:    "apiVersion: v1\nkind: ConfigMap\n",
+			expectError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crd, schemas, err := LoadManifest([]byte(tt.manifest))
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if crd.Spec.Names.Kind != "Widget" || len(schemas) != len(tt.expectedVersions) {
+				t.Fatalf("Wrong CRD (got %s with %d schemas)", crd.Spec.Names.Kind, len(schemas))
+			}
+			for i, schema := range schemas {
+				if schema.Version != tt.expectedVersions[i] || schema.Structural == nil || len(schema.Findings) > 0 {
+					t.Errorf("Wrong schema (expected structural version %s, got %+v)", tt.expectedVersions[i], schema)
+				}
+			}
+		})
+	}
+}
+
+func TestStructuralErrorPath(t *testing.T) {
+	rootPath := field.NewPath("spec", "versions").Index(0).Child("schema", "openAPIV3Schema")
+	schema := &structuralschema.Structural{
+		Generic: structuralschema.Generic{Type: "object"},
+		Properties: map[string]structuralschema.Structural{
+			"a].b": {},
+			"a":    {Generic: structuralschema.Generic{Type: "string"}},
+			"list": {Generic: structuralschema.Generic{Type: "array"}, Items: &structuralschema.Structural{}},
+		},
+		ValueValidation: &structuralschema.ValueValidation{
+			AllOf: []structuralschema.NestedValueValidation{{
+				Properties: map[string]structuralschema.NestedValueValidation{
+					"a].b": {ForbiddenGenerics: structuralschema.Generic{Type: "string"}},
+				},
+			}},
+		},
+	}
+	expectedPaths := map[string]*field.Path{}
+	for _, path := range []*field.Path{
+		rootPath.Child("properties").Key("a].b").Child("type"),
+		rootPath.Child("properties").Key("list").Child("items", "type"),
+		rootPath.Child("allOf").Index(0).Child("properties").Key("a].b").Child("type"),
+	} {
+		expectedPaths[path.String()] = path
+	}
+	errs := structuralschema.ValidateStructural(rootPath, schema)
+	if len(errs) != len(expectedPaths) {
+		t.Fatalf("Wrong errors (expected %d, got %v)", len(expectedPaths), errs)
+	}
+	for _, e := range errs {
+		path := structuralErrorPath(schema, rootPath, e.Field)
+		if expected, ok := expectedPaths[e.Field]; !ok || !reflect.DeepEqual(path, expected) {
+			t.Errorf("Wrong path for %s (expected %#v, got %#v)", e.Field, expected, path)
+		}
+	}
+}
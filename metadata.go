@@ -0,0 +1,88 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	schemacel "k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// accessibleMetadataFields lists the metadata fields the apiserver exposes to
+// rules declared on the root of a resource or an embedded resource.
+var accessibleMetadataFields = map[string]bool{
+	"name":         true,
+	"generateName": true,
+}
+
+// MetadataAccessError represents a rule that references a metadata field
+// other than name and generateName, the only metadata fields accessible to
+// rules.
+type MetadataAccessError struct {
+	// Path represents the path to the rule.
+	Path *field.Path
+	// Field is the name of the inaccessible metadata field.
+	Field string
+}
+
+func (m *MetadataAccessError) Error() string {
+	return fmt.Sprintf("rule %q references metadata.%s, but only metadata.name and metadata.generateName are accessible to rules", m.Path.String(), m.Field)
+}
+
+// CheckMetadataAccess takes a schema and returns an error for every rule on
+// the resource root or an embedded resource that references a metadata field
+// other than name or generateName.
+func CheckMetadataAccess(schema *structuralschema.Structural) []*MetadataAccessError {
+	return checkMetadataAccess(schema, field.NewPath("spec", "validation", "openAPIV3Schema"))
+}
+
+func checkMetadataAccess(schema *structuralschema.Structural, root *field.Path) []*MetadataAccessError {
+	var accessErrors []*MetadataAccessError
+	walkFrom(schema, root, func(node *Node) bool {
+		if !node.IsResourceRoot {
+			return true
+		}
+		for i, rule := range node.Schema.Extensions.XValidations {
+			ast, err := parseRule(rule.Rule)
+			if err != nil {
+				// reported by CheckExprCost as a compilation error
+				continue
+			}
+			reported := map[string]bool{}
+			visitExpr(ast.Expr(), func(e *expr.Expr) bool {
+				for _, variable := range []string{schemacel.ScopedVarName, schemacel.OldScopedVarName} {
+					fields, ok := selectPath(e, variable)
+					if !ok || len(fields) < 2 || fields[0] != "metadata" || accessibleMetadataFields[fields[1]] {
+						continue
+					}
+					if !reported[fields[1]] {
+						reported[fields[1]] = true
+						accessErrors = append(accessErrors, &MetadataAccessError{
+							Path:  node.Path.Child("x-kubernetes-validations").Index(i).Child("rule"),
+							Field: fields[1],
+						})
+					}
+					// skip the operands of a reported selection
+					return false
+				}
+				return true
+			})
+		}
+		return true
+	})
+	return accessErrors
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"testing"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func genEmbeddedResourceSchema() *structuralschema.Structural {
+	return &structuralschema.Structural{
+		Generic: structuralschema.Generic{
+			Type: "object",
+		},
+		Extensions: structuralschema.Extensions{
+			XEmbeddedResource:      true,
+			XPreserveUnknownFields: true,
+		},
+	}
+}
+
+func TestMetadataAccess(t *testing.T) {
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	tests := []struct {
+		name           string
+		schema         *structuralschema.Structural
+		expectedErrors []*MetadataAccessError
+	}{
+		{
+			name:           "nameAndGenerateName",
+			schema:         withRule(genRootSchema("spec", genStringSchema(int64ptr(5))), `self.metadata.name.startsWith('a') || has(self.metadata.generateName)`),
+			expectedErrors: []*MetadataAccessError{},
+		},
+		{
+			name:   "labelsAtRoot",
+			schema: withRule(genRootSchema("spec", genStringSchema(int64ptr(5))), `has(self.metadata.labels) && self.metadata.labels.foo == 'bar'`),
+			expectedErrors: []*MetadataAccessError{
+				{Path: rootPath.Child("x-kubernetes-validations").Index(0).Child("rule"), Field: "labels"},
+			},
+		},
+		{
+			name:   "namespaceInEmbeddedResource",
+			schema: genRootSchema("template", withRule(genEmbeddedResourceSchema(), `oldSelf.metadata.namespace == self.metadata.namespace`)),
+			expectedErrors: []*MetadataAccessError{
+				{Path: rootPath.Child("properties").Key("template").Child("x-kubernetes-validations").Index(0).Child("rule"), Field: "namespace"},
+			},
+		},
+		{
+			name:           "ordinaryObjectNamedMetadata",
+			schema:         genRootSchema("spec", withRule(genRootSchema("metadata", genRootSchema("labels", genStringSchema(int64ptr(5)))), `has(self.metadata.labels)`)),
+			expectedErrors: []*MetadataAccessError{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors := CheckMetadataAccess(test.schema)
+			if len(errors) != len(test.expectedErrors) {
+				t.Fatalf("Wrong number of expected errors (got %v, expected %v)", errors, test.expectedErrors)
+			}
+			for i, seenError := range errors {
+				expectedError := test.expectedErrors[i]
+				if seenError.Path.String() != expectedError.Path.String() || seenError.Field != expectedError.Field {
+					t.Errorf("Wrong error (expected %v, got %v)", expectedError, seenError)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+	"unicode"
+
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	schemacel "k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel"
+	celmodel "k8s.io/apiextensions-apiserver/third_party/forked/celopenapi/model"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// PropertyNameType represents the kind of problem found by CheckPropertyNames.
+type PropertyNameType int
+
+const (
+	// PropertyNameTypeEscaped represents a property that must be escaped to
+	// be referenced from rules.
+	PropertyNameTypeEscaped PropertyNameType = iota
+	// PropertyNameTypeInaccessible represents a property that cannot be
+	// referenced from rules at all.
+	PropertyNameTypeInaccessible
+	// PropertyNameTypeUnescapedReference represents a rule referencing a
+	// property by its unescaped name.
+	PropertyNameTypeUnescapedReference
+	// PropertyNameTypeInaccessibleReference represents a rule attempting to
+	// reference a property that cannot be referenced from rules.
+	PropertyNameTypeInaccessibleReference
+)
+
+// PropertyNameError represents a property whose name cannot be used as-is in
+// rules, or a rule that references such a property incorrectly. Property
+// names containing '.', '-' or '/', and names that are CEL reserved words,
+// must be escaped in rules (e.g. __dash__, __namespace__); names containing
+// any other character outside [a-zA-Z0-9_] or starting with a digit cannot be
+// referenced at all.
+type PropertyNameError struct {
+	// Path represents the path to the property, or to the rule for the
+	// reference types.
+	Path *field.Path
+	// Type indicates the kind of problem found.
+	Type PropertyNameType
+	// Name is the name of the property as declared in the schema.
+	Name string
+	// Escaped is the name of the property as it must be spelled in rules.
+	// It is empty for inaccessible properties.
+	Escaped string
+}
+
+func (p *PropertyNameError) Error() string {
+	switch p.Type {
+	case PropertyNameTypeEscaped:
+		return fmt.Sprintf("property %q must be referenced as %q in rules", p.Path.String(), p.Escaped)
+	case PropertyNameTypeInaccessible:
+		return fmt.Sprintf("property %q cannot be referenced from rules", p.Path.String())
+	case PropertyNameTypeUnescapedReference:
+		return fmt.Sprintf("rule %q references property %q without escaping it; use %q instead", p.Path.String(), p.Name, p.Escaped)
+	case PropertyNameTypeInaccessibleReference:
+		return fmt.Sprintf("rule %q references property %q, which cannot be referenced from rules", p.Path.String(), p.Name)
+	}
+	return ""
+}
+
+// Informational returns true if the error only lists a property, rather than
+// reporting a rule that references it incorrectly.
+func (p *PropertyNameError) Informational() bool {
+	return p.Type == PropertyNameTypeEscaped || p.Type == PropertyNameTypeInaccessible
+}
+
+// CheckPropertyNames takes a schema and returns an error for every property
+// whose name must be escaped or cannot be referenced in rules, and for every
+// rule that fails to compile because it references one of those properties
+// by its unescaped name.
+func CheckPropertyNames(schema *structuralschema.Structural) []*PropertyNameError {
+	root := field.NewPath("spec", "validation", "openAPIV3Schema")
+	return checkPropertyNames(newRuleCompiler(schema, root), schema, root)
+}
+
+func checkPropertyNames(compiler *ruleCompiler, schema *structuralschema.Structural, root *field.Path) []*PropertyNameError {
+	var nameErrors []*PropertyNameError
+	walkFrom(schema, root, func(node *Node) bool {
+		if node.property != nil {
+			propName := *node.property
+			if escaped, ok := celmodel.Escape(propName); !ok {
+				nameErrors = append(nameErrors, &PropertyNameError{Path: node.Path, Type: PropertyNameTypeInaccessible, Name: propName})
+			} else if escaped != propName {
+				nameErrors = append(nameErrors, &PropertyNameError{Path: node.Path, Type: PropertyNameTypeEscaped, Name: propName, Escaped: escaped})
+			}
+		}
+		if len(node.Schema.Extensions.XValidations) > 0 {
+			nameErrors = append(nameErrors, checkRuleNameReferences(compiler, node)...)
+		}
+		return true
+	})
+	return nameErrors
+}
+
+// checkRuleNameReferences reports the rules on node that fail to compile
+// and select a property by its unescaped name.
+func checkRuleNameReferences(compiler *ruleCompiler, node *Node) []*PropertyNameError {
+	results, err := compiler.compileRules(node.Schema, node.Path, node.IsResourceRoot)
+	if err != nil {
+		return nil
+	}
+	var nameErrors []*PropertyNameError
+	for i, result := range results {
+		if result.Error == nil {
+			continue
+		}
+		for _, name := range unescapedNameReferences(node.Schema.Extensions.XValidations[i].Rule, node.Schema, node.Path) {
+			nameError := &PropertyNameError{
+				Path: node.Path.Child("x-kubernetes-validations").Index(i).Child("rule"),
+				Type: PropertyNameTypeInaccessibleReference,
+				Name: name,
+			}
+			if escaped, ok := celmodel.Escape(name); ok {
+				nameError.Type = PropertyNameTypeUnescapedReference
+				nameError.Escaped = escaped
+			}
+			nameErrors = append(nameErrors, nameError)
+		}
+	}
+	return nameErrors
+}
+
+// unescapedNameReferences returns the names of the properties that rule, on
+// schema at path, selects by their unescaped names: the field selections from
+// schema nodes whose source spells the name of a property of that node that
+// must be escaped or cannot be referenced. Such rules often parse only up to
+// the property name, e.g. self.max-size parses as self.max - size and
+// self.ports.8080 as self.ports, so the expression preceding a syntax error is
+// checked as well.
+func unescapedNameReferences(rule string, schema *structuralschema.Structural, path *field.Path) []string {
+	parsed := parseRulePrefix(rule)
+	if parsed.Expr == nil {
+		return nil
+	}
+	// refs are the schema nodes the expressions of the rule refer to, by
+	// expression ID
+	refs := map[int64]schemaRef{}
+	scope := map[string]schemaRef{
+		schemacel.ScopedVarName:    {Schema: schema, Path: path},
+		schemacel.OldScopedVarName: {Schema: schema, Path: path},
+	}
+	visitSchemaRefs(parsed.Expr, scope, func(e *expr.Expr, ref schemaRef) {
+		refs[e.GetId()] = ref
+	})
+
+	var names []string
+	seen := map[string]bool{}
+	// check adds the properties of the node ref whose name is spelled at
+	// offset, following a '.'
+	check := func(ref schemaRef, offset int32) {
+		if len(ref.Rest) > 0 {
+			return
+		}
+		for _, propName := range sortedKeys(ref.Schema.Properties) {
+			if escaped, ok := celmodel.Escape(propName); ok && escaped == propName {
+				continue
+			}
+			if !seen[propName] && spellsField(parsed.Source, offset, propName) {
+				seen[propName] = true
+				names = append(names, propName)
+			}
+		}
+	}
+	visitExpr(parsed.Expr, func(e *expr.Expr) bool {
+		if sel, ok := e.ExprKind.(*expr.Expr_SelectExpr); ok {
+			if ref, ok := refs[sel.SelectExpr.Operand.GetId()]; ok {
+				check(ref, parsed.Positions[e.GetId()])
+			}
+		}
+		return true
+	})
+	if ref, ok := refs[parsed.Expr.GetId()]; ok {
+		for _, offset := range parsed.ErrorOffsets {
+			check(ref, offset)
+		}
+	}
+	return names
+}
+
+// spellsField returns true if source, at offset, is a '.' followed by name
+// and then by anything but an identifier character.
+func spellsField(source []rune, offset int32, name string) bool {
+	selection := "." + name
+	end := int(offset) + len([]rune(selection))
+	if offset < 0 || end > len(source) || string(source[offset:end]) != selection {
+		return false
+	}
+	if end == len(source) {
+		return true
+	}
+	next := source[end]
+	return !(next == '_' || unicode.IsLetter(next) || unicode.IsDigit(next))
+}
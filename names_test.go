@@ -0,0 +1,115 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"testing"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestPropertyNames(t *testing.T) {
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	rulePath := rootPath.Child("x-kubernetes-validations").Index(0).Child("rule")
+	tests := []struct {
+		name           string
+		schema         *structuralschema.Structural
+		expectedErrors []*PropertyNameError
+	}{
+		{
+			name:           "plainName",
+			schema:         withRule(genRootSchema("replicas", genIntegerSchema()), `self.replicas > 0`),
+			expectedErrors: []*PropertyNameError{},
+		},
+		{
+			name:   "escapedReference",
+			schema: withRule(genRootSchema("max-size", genIntegerSchema()), `self.max__dash__size > 0`),
+			expectedErrors: []*PropertyNameError{
+				{Path: rootPath.Child("properties").Key("max-size"), Type: PropertyNameTypeEscaped, Name: "max-size", Escaped: "max__dash__size"},
+			},
+		},
+		{
+			name:   "unescapedReservedWord",
+			schema: withRule(genRootSchema("namespace", genStringSchema(int64ptr(63))), `self.namespace != ''`),
+			expectedErrors: []*PropertyNameError{
+				{Path: rulePath, Type: PropertyNameTypeUnescapedReference, Name: "namespace", Escaped: "__namespace__"},
+				{Path: rootPath.Child("properties").Key("namespace"), Type: PropertyNameTypeEscaped, Name: "namespace", Escaped: "__namespace__"},
+			},
+		},
+		{
+			name:   "inaccessibleReference",
+			schema: withRule(genRootSchema("ports", genRootSchema("8080", genIntegerSchema())), `self.ports.8080 > 0`),
+			expectedErrors: []*PropertyNameError{
+				{Path: rulePath, Type: PropertyNameTypeInaccessibleReference, Name: "8080"},
+				{Path: rootPath.Child("properties").Key("ports").Child("properties").Key("8080"), Type: PropertyNameTypeInaccessible, Name: "8080"},
+			},
+		},
+		{
+			name:   "unescapedDash",
+			schema: withRule(genRootSchema("max-size", genIntegerSchema()), `self.max-size > 0`),
+			expectedErrors: []*PropertyNameError{
+				{Path: rulePath, Type: PropertyNameTypeUnescapedReference, Name: "max-size", Escaped: "max__dash__size"},
+				{Path: rootPath.Child("properties").Key("max-size"), Type: PropertyNameTypeEscaped, Name: "max-size", Escaped: "max__dash__size"},
+			},
+		},
+		{
+			name: "unescapedInMacro",
+			schema: genRootSchema("list", withRule(genArraySchema(int64ptr(10), genRootSchema("max-size", genIntegerSchema())),
+				`self.all(x, x.max-size > 0)`)),
+			expectedErrors: []*PropertyNameError{
+				{Path: rootPath.Child("properties").Key("list").Child("x-kubernetes-validations").Index(0).Child("rule"), Type: PropertyNameTypeUnescapedReference, Name: "max-size", Escaped: "max__dash__size"},
+				{Path: rootPath.Child("properties").Key("list").Child("items", "properties").Key("max-size"), Type: PropertyNameTypeEscaped, Name: "max-size", Escaped: "max__dash__size"},
+			},
+		},
+		{
+			// the rule fails to compile for another reason
+			name:   "nameInStringLiteral",
+			schema: withRule(genRootSchema("max-size", genIntegerSchema()), `self.maxSize == '.max-size'`),
+			expectedErrors: []*PropertyNameError{
+				{Path: rootPath.Child("properties").Key("max-size"), Type: PropertyNameTypeEscaped, Name: "max-size", Escaped: "max__dash__size"},
+			},
+		},
+		{
+			// namespace is selected from other, which does not declare it
+			name: "nameOfAnotherNode",
+			schema: withRule(withProperty(genRootSchema("namespace", genStringSchema(int64ptr(63))), "other", genRootSchema("name", genStringSchema(int64ptr(63)))),
+				`self.other.namespace != ''`),
+			expectedErrors: []*PropertyNameError{
+				{Path: rootPath.Child("properties").Key("namespace"), Type: PropertyNameTypeEscaped, Name: "namespace", Escaped: "__namespace__"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors := CheckPropertyNames(test.schema)
+			if len(errors) != len(test.expectedErrors) {
+				t.Fatalf("Wrong number of expected errors (got %v, expected %v)", errors, test.expectedErrors)
+			}
+			for i, seenError := range errors {
+				expectedError := test.expectedErrors[i]
+				if seenError.Path.String() != expectedError.Path.String() || seenError.Type != expectedError.Type ||
+					seenError.Name != expectedError.Name || seenError.Escaped != expectedError.Escaped {
+					t.Errorf("Wrong error (expected %v, got %v)", expectedError, seenError)
+				}
+			}
+		})
+	}
+}
+
+// withProperty adds the property name to schema.
+func withProperty(schema *structuralschema.Structural, name string, property *structuralschema.Structural) *structuralschema.Structural {
+	schema.Properties[name] = *property
+	return schema
+}
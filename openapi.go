@@ -0,0 +1,301 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	api "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+//go:generate go run ./hack/snapshot -o snapshot/kubernetes-v1.24.json
+
+// snapshotJSON is an OpenAPI v3 document describing common built-in
+// Kubernetes types, generated from the k8s.io/api types celvet is built
+// against.
+//
+//go:embed snapshot/kubernetes-v1.24.json
+var snapshotJSON []byte
+
+// AdmissionSchema is the schema of a resource that admission expressions can
+// refer to, either as the object being admitted or as the params of a policy.
+type AdmissionSchema struct {
+	GroupVersionKind schema.GroupVersionKind
+	// Resource is the plural resource name, e.g. deployments.
+	Resource string
+	Schema   *structuralschema.Structural
+}
+
+// openAPIDocument is the subset of an OpenAPI v3 document needed to resolve
+// its schemas.
+type openAPIDocument struct {
+	Components struct {
+		Schemas map[string]json.RawMessage `json:"schemas"`
+	} `json:"components"`
+	// Resources maps resources to their schemas. It is only set in the
+	// snapshot, since OpenAPI documents do not list resources.
+	Resources []struct {
+		Group    string `json:"group"`
+		Version  string `json:"version"`
+		Resource string `json:"resource"`
+		Kind     string `json:"kind"`
+		Schema   string `json:"schema"`
+	} `json:"x-celvet-resources"`
+}
+
+var (
+	snapshotOnce    sync.Once
+	snapshotSchemas []AdmissionSchema
+	snapshotErr     error
+	snapshotDoc     *openAPIDocument
+)
+
+// builtinSchemas returns the schemas of the built-in resources in the
+// snapshot.
+func builtinSchemas() ([]AdmissionSchema, error) {
+	snapshotOnce.Do(func() {
+		snapshotDoc = &openAPIDocument{}
+		if snapshotErr = json.Unmarshal(snapshotJSON, snapshotDoc); snapshotErr != nil {
+			return
+		}
+		for _, r := range snapshotDoc.Resources {
+			var s *structuralschema.Structural
+			s, snapshotErr = snapshotDoc.structural(r.Schema)
+			if snapshotErr != nil {
+				return
+			}
+			snapshotSchemas = append(snapshotSchemas, AdmissionSchema{
+				GroupVersionKind: schema.GroupVersionKind{Group: r.Group, Version: r.Version, Kind: r.Kind},
+				Resource:         r.Resource,
+				Schema:           s,
+			})
+		}
+	})
+	return snapshotSchemas, snapshotErr
+}
+
+// builtinSchema returns the structural schema named name in the snapshot,
+// such as io.k8s.api.admission.v1.AdmissionRequest.
+func builtinSchema(name string) (*structuralschema.Structural, error) {
+	if _, err := builtinSchemas(); err != nil {
+		return nil, err
+	}
+	return snapshotDoc.structural(name)
+}
+
+// structural returns the structural schema of the component named name, with
+// all references inlined.
+func (d *openAPIDocument) structural(name string) (*structuralschema.Structural, error) {
+	resolved, err := d.resolveRef("#/components/schemas/"+name, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(resolved)
+	if err != nil {
+		return nil, err
+	}
+	v1Props := &apiv1.JSONSchemaProps{}
+	if err := json.Unmarshal(data, v1Props); err != nil {
+		return nil, fmt.Errorf("schema %s: %w", name, err)
+	}
+	props := &api.JSONSchemaProps{}
+	if err := apiv1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(v1Props, props, nil); err != nil {
+		return nil, fmt.Errorf("schema %s: %w", name, err)
+	}
+	return structuralschema.NewStructural(props)
+}
+
+// resolveRef returns the schema ref points to with all references beneath it
+// inlined. Recursive references are replaced with objects preserving
+// unknown fields, since structural schemas cannot be recursive.
+func (d *openAPIDocument) resolveRef(ref string, resolving map[string]bool) (interface{}, error) {
+	name := strings.TrimPrefix(ref, "#/components/schemas/")
+	if name == ref {
+		return nil, fmt.Errorf("unsupported reference %q", ref)
+	}
+	if resolving[name] {
+		return map[string]interface{}{"type": "object", "x-kubernetes-preserve-unknown-fields": true}, nil
+	}
+	raw, ok := d.Components.Schemas[name]
+	if !ok {
+		return nil, fmt.Errorf("reference to undefined schema %q", name)
+	}
+	var node interface{}
+	if err := json.Unmarshal(raw, &node); err != nil {
+		return nil, fmt.Errorf("schema %s: %w", name, err)
+	}
+	resolving[name] = true
+	defer delete(resolving, name)
+	return d.resolveRefs(node, resolving)
+}
+
+// resolveRefs inlines the references in node, a decoded JSON schema.
+// References wrapped in a single-element allOf, as generated by Kubernetes
+// to attach defaults and descriptions to them, are inlined too.
+func (d *openAPIDocument) resolveRefs(node interface{}, resolving map[string]bool) (interface{}, error) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if ref, ok := n["$ref"].(string); ok {
+			return d.resolveRef(ref, resolving)
+		}
+		if allOf, ok := n["allOf"].([]interface{}); ok && len(allOf) == 1 {
+			if wrapped, ok := allOf[0].(map[string]interface{}); ok {
+				if ref, ok := wrapped["$ref"].(string); ok {
+					resolved, err := d.resolveRef(ref, resolving)
+					if err != nil {
+						return nil, err
+					}
+					merged := map[string]interface{}{}
+					for key, value := range resolved.(map[string]interface{}) {
+						merged[key] = value
+					}
+					for key, value := range n {
+						if key != "allOf" {
+							merged[key] = value
+						}
+					}
+					return merged, nil
+				}
+			}
+		}
+		resolved := make(map[string]interface{}, len(n))
+		for key, value := range n {
+			r, err := d.resolveRefs(value, resolving)
+			if err != nil {
+				return nil, err
+			}
+			resolved[key] = r
+		}
+		return resolved, nil
+	case []interface{}:
+		resolved := make([]interface{}, len(n))
+		for i, value := range n {
+			r, err := d.resolveRefs(value, resolving)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = r
+		}
+		return resolved, nil
+	}
+	return node, nil
+}
+
+// OpenAPISchema is the schema of a resource described by an OpenAPI v3
+// document, loaded by LoadOpenAPIDocument.
+type OpenAPISchema struct {
+	// Name is the name of the component schema, e.g. com.example.v1.Widget.
+	Name string
+	// GroupVersionKinds are the kinds the schema describes, from its
+	// x-kubernetes-group-version-kind extension.
+	GroupVersionKinds []schema.GroupVersionKind
+	// Schema is the schema with its references inlined. Its Version is Name,
+	// and its Path components.schemas[Name].
+	Schema *LoadedSchema
+	// RuleExtensions are the messageExpression, reason and fieldPath fields
+	// of its rules, keyed by paths beneath Schema.Path.
+	RuleExtensions RuleExtensions
+}
+
+// LoadOpenAPIDocument reads an OpenAPI v3 document, such as those the
+// apiserver serves at /openapi/v3/apis/<group>/<version>, and loads the
+// schemas of the resources it describes that declare rules: the component
+// schemas with an x-kubernetes-group-version-kind extension and
+// x-kubernetes-validations beneath them, in name order. References are
+// inlined, and the apiVersion, kind and metadata properties the apiserver
+// adds to the schemas of CRDs are removed, so that the schemas are those of
+// the CRDs. Schemas
+// that are not structural are reported as findings, like LoadSchema does.
+func LoadOpenAPIDocument(data []byte) ([]*OpenAPISchema, error) {
+	doc := &openAPIDocument{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("error decoding OpenAPI document: %w", err)
+	}
+	var schemas []*OpenAPISchema
+	for _, name := range sortedKeys(doc.Components.Schemas) {
+		var extensions struct {
+			GroupVersionKinds []schema.GroupVersionKind `json:"x-kubernetes-group-version-kind"`
+		}
+		if err := json.Unmarshal(doc.Components.Schemas[name], &extensions); err != nil || len(extensions.GroupVersionKinds) == 0 {
+			continue
+		}
+		resolved, err := doc.resolveRef("#/components/schemas/"+name, map[string]bool{})
+		if err != nil {
+			return nil, err
+		}
+		root, ok := resolved.(map[string]interface{})
+		if !ok || !hasRules(root) {
+			continue
+		}
+		if properties, ok := root["properties"].(map[string]interface{}); ok {
+			for _, implicit := range []string{"apiVersion", "kind", "metadata"} {
+				delete(properties, implicit)
+			}
+		}
+		delete(root, "x-kubernetes-group-version-kind")
+		rootData, err := json.Marshal(root)
+		if err != nil {
+			return nil, fmt.Errorf("schema %s: %w", name, err)
+		}
+		v1Props := &apiv1.JSONSchemaProps{}
+		if err := json.Unmarshal(rootData, v1Props); err != nil {
+			return nil, fmt.Errorf("schema %s: %w", name, err)
+		}
+		raw := &rawSchema{}
+		if err := json.Unmarshal(rootData, raw); err != nil {
+			return nil, fmt.Errorf("schema %s: %w", name, err)
+		}
+		schemaPath := field.NewPath("components", "schemas").Key(name)
+		ruleExtensions := RuleExtensions{}
+		extractRuleExtensions(raw, schemaPath, ruleExtensions)
+		schemas = append(schemas, &OpenAPISchema{
+			Name:              name,
+			GroupVersionKinds: extensions.GroupVersionKinds,
+			Schema:            loadSchema(name, v1Props, schemaPath),
+			RuleExtensions:    ruleExtensions,
+		})
+	}
+	return schemas, nil
+}
+
+// hasRules returns true if node, a decoded JSON schema, declares
+// x-kubernetes-validations on itself or a node beneath it.
+func hasRules(node interface{}) bool {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if _, ok := n["x-kubernetes-validations"]; ok {
+			return true
+		}
+		for _, value := range n {
+			if hasRules(value) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, value := range n {
+			if hasRules(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// openAPIDump is an OpenAPI v3 document like those the apiserver serves for
+// the group versions of CRDs.
+const openAPIDump = `{
+  "openapi": "3.0.0",
+  "components": {
+    "schemas": {
+      "com.example.v1.Widget": {
+        "type": "object",
+        "x-kubernetes-group-version-kind": [{"group": "example.com", "version": "v1", "kind": "Widget"}],
+        "properties": {
+          "apiVersion": {"type": "string"},
+          "kind": {"type": "string"},
+          "metadata": {"allOf": [{"$ref": "#/components/schemas/io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta"}]},
+          "spec": {"$ref": "#/components/schemas/com.example.v1.WidgetSpec"}
+        }
+      },
+      "com.example.v1.WidgetSpec": {
+        "type": "object",
+        "x-kubernetes-validations": [{"rule": "self.nope", "reason": "Bogus"}]
+      },
+      "com.example.v1.Gadget": {
+        "type": "object",
+        "x-kubernetes-group-version-kind": [{"group": "example.com", "version": "v1", "kind": "Gadget"}],
+        "properties": {
+          "name": {"x-kubernetes-validations": [{"rule": "self.size() > 0"}]}
+        }
+      },
+      "com.example.v1.Plain": {
+        "type": "object",
+        "x-kubernetes-group-version-kind": [{"group": "example.com", "version": "v1", "kind": "Plain"}],
+        "properties": {
+          "name": {"type": "string"}
+        }
+      },
+      "io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"}
+        }
+      }
+    }
+  }
+}`
+
+func TestLoadOpenAPIDocument(t *testing.T) {
+	schemas, err := LoadOpenAPIDocument([]byte(openAPIDump))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(schemas) != 2 || schemas[0].Name != "com.example.v1.Gadget" || schemas[1].Name != "com.example.v1.Widget" {
+		t.Fatalf("Wrong schemas: %v", schemas)
+	}
+	widget := schemas[1]
+	if len(widget.GroupVersionKinds) != 1 || widget.GroupVersionKinds[0] != (schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}) {
+		t.Errorf("Wrong kinds: %v", widget.GroupVersionKinds)
+	}
+	if widget.Schema.Structural == nil || widget.Schema.Version != widget.Name {
+		t.Fatalf("Wrong schema: %+v", widget.Schema)
+	}
+	if len(widget.Schema.Structural.Properties) != 1 {
+		t.Errorf("Implicit properties were not removed: %v", widget.Schema.Structural.Properties)
+	}
+	if len(widget.Schema.Structural.Properties["spec"].Extensions.XValidations) != 1 {
+		t.Errorf("Reference to spec was not inlined")
+	}
+	widgetPath := field.NewPath("components", "schemas").Key("com.example.v1.Widget")
+	if widget.Schema.Path.String() != widgetPath.String() {
+		t.Errorf("Wrong schema path: %s", widget.Schema.Path)
+	}
+	specPath := widgetPath.Child("properties").Key("spec")
+	if extensions := widget.RuleExtensions[specPath.String()]; len(extensions) != 1 || extensions[0].Reason != "Bogus" {
+		t.Errorf("Wrong rule extensions: %v", widget.RuleExtensions)
+	}
+	if _, err := LoadOpenAPIDocument([]byte("{")); err == nil {
+		t.Errorf("Expected an error for an invalid document")
+	}
+}
+
+func TestLintOpenAPIDocument(t *testing.T) {
+	gadgetPath := field.NewPath("components", "schemas").Key("com.example.v1.Gadget")
+	rulePath := field.NewPath("components", "schemas").Key("com.example.v1.Widget").Child("properties").Key("spec").Child("x-kubernetes-validations").Index(0)
+	expected := []Finding{
+		{CheckID: CheckIDStructuralSchema, Version: "com.example.v1.Gadget", Path: gadgetPath.Child("properties").Key("name").Child("type")},
+		{CheckID: CheckIDRuleExtensions, Version: "com.example.v1.Widget", Path: rulePath.Child("reason")},
+		{CheckID: CheckIDCost, Version: "com.example.v1.Widget", Path: rulePath.Child("rule")},
+	}
+	findings, err := NewLinter(Options{}).LintOpenAPIDocument(context.Background(), []byte(openAPIDump))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(findings) != len(expected) {
+		t.Fatalf("Wrong findings (got %v, expected %v)", findings, expected)
+	}
+	for i, finding := range findings {
+		if finding.CheckID != expected[i].CheckID || finding.Version != expected[i].Version || finding.Path.String() != expected[i].Path.String() {
+			t.Errorf("Wrong finding (expected %+v, got %+v)", expected[i], finding)
+		}
+		if strings.Contains(finding.Message, "spec.validation.openAPIV3Schema") {
+			t.Errorf("Message quotes a path outside the document: %s", finding.Message)
+		}
+	}
+}
+
+func TestLintOpenAPIDocumentTimeout(t *testing.T) {
+	check := &blockingCheck{block: map[string]bool{"com.example.v1.Widget": true}}
+	linter := NewLinter(Options{Checks: []Check{check}, Jobs: 2, Timeout: 50 * time.Millisecond})
+	findings, err := linter.LintOpenAPIDocument(context.Background(), []byte(openAPIDump))
+	var incomplete *IncompleteError
+	if !errors.As(err, &incomplete) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	if !reflect.DeepEqual(incomplete.Linted, []string{"com.example.v1.Gadget"}) || !reflect.DeepEqual(incomplete.Skipped, []string{"com.example.v1.Widget"}) {
+		t.Errorf("Wrong schemas (expected Gadget linted and Widget skipped, got %v and %v)", incomplete.Linted, incomplete.Skipped)
+	}
+	if len(findings) != 1 || findings[0].Version != "com.example.v1.Gadget" {
+		t.Errorf("Expected the findings of Gadget, got %v", findings)
+	}
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/parser"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/protobuf/proto"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	schemacel "k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel"
+	celmodel "k8s.io/apiextensions-apiserver/third_party/forked/celopenapi/model"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// RelocationError represents a rule of the form self.all(x, P(x)) on a list
+// or map that can be replaced by an equivalent, cheaper rule on the items (or
+// additionalProperties) node, or on a property beneath it.
+type RelocationError struct {
+	// Path represents the path to the rule.
+	Path *field.Path
+	// TargetPath represents the path to the node the rule can be moved to.
+	TargetPath *field.Path
+	// Rule is the suggested rule for the target node.
+	Rule string
+	// Cost is the estimated cost of the rule in its current location.
+	Cost uint64
+	// TargetCost is the estimated cost of the suggested rule on the target
+	// node.
+	TargetCost uint64
+}
+
+func (r *RelocationError) Error() string {
+	return fmt.Sprintf("rule %q (cost %d) can be replaced by %q on %q (cost %d)", r.Path.String(), r.Cost, r.Rule, r.TargetPath.String(), r.TargetCost)
+}
+
+// Informational returns true, since the rule is correct as it is.
+func (r *RelocationError) Informational() bool {
+	return true
+}
+
+// CheckRuleRelocation takes a schema and returns a suggestion for every rule
+// of the form self.all(x, P(x)) whose predicate only depends on the element,
+// proposing P(self) on the items or additionalProperties node instead. If P
+// only references fields beneath the element, the suggested rule is placed on
+// the deepest property common to all of them that every element has, i.e.
+// whose properties along the way are all required. Suggestions are only made when
+// they lower the estimated cost of the rule.
+func CheckRuleRelocation(schema *structuralschema.Structural) []*RelocationError {
+	root := field.NewPath("spec", "validation", "openAPIV3Schema")
+	return checkRuleRelocation(newRuleCompiler(schema, root), schema, root)
+}
+
+func checkRuleRelocation(compiler *ruleCompiler, schema *structuralschema.Structural, root *field.Path) []*RelocationError {
+	var relocationErrors []*RelocationError
+	walkFrom(schema, root, func(node *Node) bool {
+		for i, rule := range node.Schema.Extensions.XValidations {
+			if relocationError := relocateRule(compiler, node, rule.Rule); relocationError != nil {
+				relocationError.Path = node.Path.Child("x-kubernetes-validations").Index(i).Child("rule")
+				relocationErrors = append(relocationErrors, relocationError)
+			}
+		}
+		return true
+	})
+	return relocationErrors
+}
+
+// relocateRule returns a suggestion for rule on node, or nil if rule is not
+// of the form self.all(x, P(x)) or relocating it does not lower its cost.
+func relocateRule(compiler *ruleCompiler, node *Node, rule string) *RelocationError {
+	ast, err := parseRule(rule)
+	if err != nil {
+		return nil
+	}
+	call, ok := callExpr(ast.Expr())
+	if !ok || call.Function != operators.All || call.Target == nil || len(call.Args) != 2 || !isIdent(call.Target, schemacel.ScopedVarName) {
+		return nil
+	}
+	iterVar, ok := call.Args[0].ExprKind.(*expr.Expr_IdentExpr)
+	if !ok {
+		return nil
+	}
+
+	// isElem recognizes the expressions in the predicate that stand for the
+	// element: x for lists, self[x] for maps
+	var isElem func(e *expr.Expr) bool
+	var target *Node
+	schema := node.Schema
+	switch {
+	case schema.Type == "array" && schema.Items != nil:
+		isElem = func(e *expr.Expr) bool { return isIdent(e, iterVar.IdentExpr.Name) }
+		target = childNode(node, node.Path.Child("items"))
+	case schema.AdditionalProperties != nil && schema.AdditionalProperties.Structural != nil:
+		isElem = func(e *expr.Expr) bool {
+			index, ok := callExpr(e)
+			return ok && index.Function == operators.Index && len(index.Args) == 2 &&
+				isIdent(index.Args[0], schemacel.ScopedVarName) && isIdent(index.Args[1], iterVar.IdentExpr.Name)
+		}
+		target = childNode(node, node.Path.Child("additionalProperties"))
+	}
+	if target == nil {
+		return nil
+	}
+
+	elemPaths, ok := collectElemPaths(call.Args[1], isElem, iterVar.IdentExpr.Name)
+	if !ok || len(elemPaths) == 0 {
+		return nil
+	}
+	depth := 0
+	for prefix := commonPrefix(elemPaths); depth < len(prefix); depth++ {
+		propName, ok := celmodel.Unescape(prefix[depth])
+		if !ok || target.Schema.Type != "object" {
+			break
+		}
+		// rules on optional properties do not run when they are missing,
+		// where the original rule may fail
+		if _, ok := target.Schema.Properties[propName]; !ok || !isRequired(target.Schema, propName) {
+			break
+		}
+		target = childNode(target, target.Path.Child("properties").Key(propName))
+	}
+
+	body := proto.Clone(call.Args[1]).(*expr.Expr)
+	replaceElemPaths(body, isElem, depth)
+	suggestedRule, err := parser.Unparse(body, ast.SourceInfo())
+	if err != nil {
+		return nil
+	}
+	cost, ok := compiler.ruleCost(node, rule)
+	if !ok {
+		return nil
+	}
+	targetCost, ok := compiler.ruleCost(target, suggestedRule)
+	if !ok || targetCost >= cost {
+		return nil
+	}
+	return &RelocationError{TargetPath: target.Path, Rule: suggestedRule, Cost: cost, TargetCost: targetCost}
+}
+
+// isRequired returns true if schema requires the property name.
+func isRequired(schema *structuralschema.Structural, name string) bool {
+	if schema.ValueValidation == nil {
+		return false
+	}
+	for _, required := range schema.ValueValidation.Required {
+		if required == name {
+			return true
+		}
+	}
+	return false
+}
+
+// collectElemPaths returns the fields selected from every occurrence of the
+// element in e. The second return value is false if e references self,
+// oldSelf or the iteration variable other than through the element, or binds
+// the iteration variable again.
+func collectElemPaths(e *expr.Expr, isElem func(e *expr.Expr) bool, iterVar string) ([][]string, bool) {
+	var elemPaths [][]string
+	ok := true
+	visitExpr(e, func(e *expr.Expr) bool {
+		if !ok {
+			return false
+		}
+		if call, isCall := callExpr(e); isCall {
+			if call.Function == operators.Has && len(call.Args) == 1 {
+				// has(x.a.b) needs x.a to remain an object
+				if sel, isSel := call.Args[0].ExprKind.(*expr.Expr_SelectExpr); isSel {
+					if fields, found := elemSelectPath(sel.SelectExpr.Operand, isElem); found {
+						elemPaths = append(elemPaths, fields)
+						return false
+					}
+				}
+			}
+			if comprehensionMacros[call.Function] && len(call.Args) > 0 && isIdent(call.Args[0], iterVar) {
+				ok = false
+				return false
+			}
+		}
+		if fields, found := elemSelectPath(e, isElem); found {
+			elemPaths = append(elemPaths, fields)
+			return false
+		}
+		if ident, isIdentExpr := e.ExprKind.(*expr.Expr_IdentExpr); isIdentExpr {
+			switch ident.IdentExpr.Name {
+			case iterVar, schemacel.ScopedVarName, schemacel.OldScopedVarName:
+				ok = false
+			}
+		}
+		return true
+	})
+	return elemPaths, ok
+}
+
+// elemSelectPath is like selectPath, but for chains of field selections
+// starting at an expression recognized by isElem.
+func elemSelectPath(e *expr.Expr, isElem func(e *expr.Expr) bool) ([]string, bool) {
+	var fields []string
+	for !isElem(e) {
+		sel, ok := e.ExprKind.(*expr.Expr_SelectExpr)
+		if !ok || sel.SelectExpr.TestOnly {
+			return nil, false
+		}
+		fields = append([]string{sel.SelectExpr.Field}, fields...)
+		e = sel.SelectExpr.Operand
+	}
+	return fields, true
+}
+
+// commonPrefix returns the longest common prefix of paths.
+func commonPrefix(paths [][]string) []string {
+	prefix := paths[0]
+	for _, path := range paths[1:] {
+		n := 0
+		for n < len(prefix) && n < len(path) && prefix[n] == path[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return prefix
+}
+
+// replaceElemPaths rewrites every chain of field selections starting at the
+// element in e, replacing the element and the first depth selections with
+// self.
+func replaceElemPaths(e *expr.Expr, isElem func(e *expr.Expr) bool, depth int) {
+	visitExpr(e, func(e *expr.Expr) bool {
+		fields, ok := elemSelectPath(e, isElem)
+		if !ok {
+			return true
+		}
+		if len(fields) == depth {
+			e.ExprKind = &expr.Expr_IdentExpr{IdentExpr: &expr.Expr_Ident{Name: schemacel.ScopedVarName}}
+			return false
+		}
+		// e selects beyond the new root, so replace its innermost operand
+		operand := e
+		for i := len(fields); i > depth+1; i-- {
+			operand = operand.ExprKind.(*expr.Expr_SelectExpr).SelectExpr.Operand
+		}
+		operand.ExprKind.(*expr.Expr_SelectExpr).SelectExpr.Operand = &expr.Expr{
+			ExprKind: &expr.Expr_IdentExpr{IdentExpr: &expr.Expr_Ident{Name: schemacel.ScopedVarName}},
+		}
+		return false
+	})
+}
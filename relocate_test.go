@@ -0,0 +1,113 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"testing"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestRuleRelocation(t *testing.T) {
+	listPath := field.NewPath("spec", "validation", "openAPIV3Schema").Child("properties").Key("values")
+	rulePath := listPath.Child("x-kubernetes-validations").Index(0).Child("rule")
+	tests := []struct {
+		name           string
+		schema         *structuralschema.Structural
+		expectedErrors []*RelocationError
+	}{
+		{
+			name:   "listItems",
+			schema: genRootSchema("values", withRule(genArraySchema(int64ptr(10), genStringSchema(int64ptr(64))), `self.all(x, x.size() < 64)`)),
+			expectedErrors: []*RelocationError{
+				{Path: rulePath, TargetPath: listPath.Child("items"), Rule: `self.size() < 64`},
+			},
+		},
+		{
+			name: "itemProperty",
+			schema: genRootSchema("values", withRule(genArraySchema(int64ptr(10), withRequired(genRootSchema("name", genStringSchema(int64ptr(64))), "name")),
+				`self.all(c, c.name.size() < 64 && c.name != 'default')`)),
+			expectedErrors: []*RelocationError{
+				{Path: rulePath, TargetPath: listPath.Child("items").Child("properties").Key("name"), Rule: `self.size() < 64 && self != "default"`},
+			},
+		},
+		{
+			// a rule on name would not run on items without one, which the
+			// original rule rejects
+			name: "optionalItemProperty",
+			schema: genRootSchema("values", withRule(genArraySchema(int64ptr(10), genRootSchema("name", genStringSchema(int64ptr(64)))),
+				`self.all(c, c.name.size() < 64 && c.name != 'default')`)),
+			expectedErrors: []*RelocationError{
+				{Path: rulePath, TargetPath: listPath.Child("items"), Rule: `self.name.size() < 64 && self.name != "default"`},
+			},
+		},
+		{
+			name: "hasKeepsParent",
+			schema: genRootSchema("values", withRule(genArraySchema(int64ptr(10), genRootSchema("name", genStringSchema(int64ptr(64)))),
+				`self.all(c, !has(c.name) || c.name.size() < 64)`)),
+			expectedErrors: []*RelocationError{
+				{Path: rulePath, TargetPath: listPath.Child("items"), Rule: `!has(self.name) || self.name.size() < 64`},
+			},
+		},
+		{
+			name:   "mapValues",
+			schema: genRootSchema("values", withRule(genMapSchema(int64ptr(10), genStringSchema(int64ptr(64))), `self.all(k, self[k].size() < 64)`)),
+			expectedErrors: []*RelocationError{
+				{Path: rulePath, TargetPath: listPath.Child("additionalProperties"), Rule: `self.size() < 64`},
+			},
+		},
+		{
+			name:           "mapKeys",
+			schema:         genRootSchema("values", withRule(genMapSchema(int64ptr(10), genStringSchema(int64ptr(64))), `self.all(k, k.size() < 64)`)),
+			expectedErrors: []*RelocationError{},
+		},
+		{
+			name:           "referencesSelf",
+			schema:         genRootSchema("values", withRule(genArraySchema(int64ptr(10), genStringSchema(int64ptr(64))), `self.all(x, x != self[0])`)),
+			expectedErrors: []*RelocationError{},
+		},
+		{
+			name:           "notAll",
+			schema:         genRootSchema("values", withRule(genArraySchema(int64ptr(10), genStringSchema(int64ptr(64))), `self.exists(x, x == 'a')`)),
+			expectedErrors: []*RelocationError{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors := CheckRuleRelocation(test.schema)
+			if len(errors) != len(test.expectedErrors) {
+				t.Fatalf("Wrong number of expected errors (got %v, expected %v)", errors, test.expectedErrors)
+			}
+			for i, seenError := range errors {
+				expectedError := test.expectedErrors[i]
+				if seenError.Path.String() != expectedError.Path.String() || seenError.TargetPath.String() != expectedError.TargetPath.String() || seenError.Rule != expectedError.Rule {
+					t.Errorf("Wrong error (expected %v, got %v)", expectedError, seenError)
+				}
+				if seenError.TargetCost >= seenError.Cost {
+					t.Errorf("Suggested rule is not cheaper: %v", seenError)
+				}
+			}
+		})
+	}
+}
+
+// withRequired adds names to the required properties of schema.
+func withRequired(schema *structuralschema.Structural, names ...string) *structuralschema.Structural {
+	if schema.ValueValidation == nil {
+		schema.ValueValidation = &structuralschema.ValueValidation{}
+	}
+	schema.ValueValidation.Required = append(schema.ValueValidation.Required, names...)
+	return schema
+}
@@ -0,0 +1,311 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-go/checker/decls"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+)
+
+// allowedReasons lists the values accepted for the reason of a rule.
+var allowedReasons = map[string]bool{
+	"FieldValueInvalid":   true,
+	"FieldValueForbidden": true,
+	"FieldValueRequired":  true,
+	"FieldValueDuplicate": true,
+}
+
+// RuleExtension holds the fields of a validation rule added after the
+// apiextensions-apiserver release celvet is built against, which are dropped
+// when decoding CRDs into its types.
+type RuleExtension struct {
+	MessageExpression string `json:"messageExpression,omitempty"`
+	Reason            string `json:"reason,omitempty"`
+	FieldPath         string `json:"fieldPath,omitempty"`
+}
+
+// RuleExtensions maps the path of every schema node declaring rules (as
+// returned by field.Path.String) to the extensions of those rules, in the
+// order the rules are declared.
+type RuleExtensions map[string][]RuleExtension
+
+// rawSchema is the subset of a JSON schema needed to find the rules declared
+// on each of its nodes.
+type rawSchema struct {
+	Properties           map[string]*rawSchema `json:"properties,omitempty"`
+	Items                *rawSchema            `json:"items,omitempty"`
+	AdditionalProperties json.RawMessage       `json:"additionalProperties,omitempty"`
+	XValidations         []RuleExtension       `json:"x-kubernetes-validations,omitempty"`
+}
+
+// ExtractRuleExtensions reads the extensions of the rules in the schema of
+// the version at versionIndex of the CRD in crd, which may be YAML or JSON. For
+// v1beta1 CRDs, versions without a schema of their own use the top-level
+// validation schema, and a CRD declaring only spec.version has a single
+// version. Nodes are keyed by their paths beneath
+// spec.validation.openAPIV3Schema.
+func ExtractRuleExtensions(crd []byte, versionIndex int) (RuleExtensions, error) {
+	return extractVersionRuleExtensions(crd, versionIndex, field.NewPath("spec", "validation", "openAPIV3Schema"))
+}
+
+// extractVersionRuleExtensions is like ExtractRuleExtensions, but the schema
+// of the version is at rootPath.
+func extractVersionRuleExtensions(crd []byte, versionIndex int, rootPath *field.Path) (RuleExtensions, error) {
+	var raw struct {
+		Spec struct {
+			Validation struct {
+				OpenAPIV3Schema *rawSchema `json:"openAPIV3Schema"`
+			} `json:"validation"`
+			Versions []struct {
+				Schema struct {
+					OpenAPIV3Schema *rawSchema `json:"openAPIV3Schema"`
+				} `json:"schema"`
+			} `json:"versions"`
+		} `json:"spec"`
+	}
+	if err := yaml.Unmarshal(crd, &raw); err != nil {
+		return nil, err
+	}
+	versions := len(raw.Spec.Versions)
+	if versions == 0 && raw.Spec.Validation.OpenAPIV3Schema != nil {
+		versions = 1
+	}
+	if versionIndex < 0 || versionIndex >= versions {
+		return nil, fmt.Errorf("CRD has no version at index %d", versionIndex)
+	}
+	schema := raw.Spec.Validation.OpenAPIV3Schema
+	if versionIndex < len(raw.Spec.Versions) && raw.Spec.Versions[versionIndex].Schema.OpenAPIV3Schema != nil {
+		schema = raw.Spec.Versions[versionIndex].Schema.OpenAPIV3Schema
+	}
+	extensions := RuleExtensions{}
+	extractRuleExtensions(schema, rootPath, extensions)
+	return extensions, nil
+}
+
+// extractRuleExtensions records the rules declared on schema, the node at
+// path, and on the nodes beneath it. It does not recurse, so it handles
+// schemas of any depth.
+func extractRuleExtensions(schema *rawSchema, path *field.Path, extensions RuleExtensions) {
+	type rawNode struct {
+		schema *rawSchema
+		path   *field.Path
+	}
+	stack := []rawNode{{schema, path}}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if node.schema == nil {
+			continue
+		}
+		if len(node.schema.XValidations) > 0 {
+			extensions[node.path.String()] = node.schema.XValidations
+		}
+		for propName, propSchema := range node.schema.Properties {
+			stack = append(stack, rawNode{propSchema, node.path.Child("properties").Key(propName)})
+		}
+		stack = append(stack, rawNode{node.schema.Items, node.path.Child("items")})
+		if len(node.schema.AdditionalProperties) > 0 {
+			// additionalProperties may also be a bool, which declares no
+			// rules
+			var additionalProperties rawSchema
+			if err := json.Unmarshal(node.schema.AdditionalProperties, &additionalProperties); err == nil {
+				stack = append(stack, rawNode{&additionalProperties, node.path.Child("additionalProperties")})
+			}
+		}
+	}
+}
+
+// RuleExtensionType represents the kind of problem found by
+// CheckRuleExtensions.
+type RuleExtensionType int
+
+const (
+	// RuleExtensionTypeMessageExpressionCompile represents a messageExpression
+	// that fails to compile or does not evaluate to a string.
+	RuleExtensionTypeMessageExpressionCompile RuleExtensionType = iota
+	// RuleExtensionTypeMessageExpressionCost represents a messageExpression
+	// whose estimated cost exceeds the per-expression cost limit.
+	RuleExtensionTypeMessageExpressionCost
+	// RuleExtensionTypeReason represents a reason that is not one of the
+	// allowed values.
+	RuleExtensionTypeReason
+	// RuleExtensionTypeFieldPath represents a fieldPath that is malformed or
+	// does not resolve to a node of the schema.
+	RuleExtensionTypeFieldPath
+)
+
+// RuleExtensionError represents an invalid messageExpression, reason or
+// fieldPath on a validation rule.
+type RuleExtensionError struct {
+	// Path represents the path to the offending field of the rule.
+	Path *field.Path
+	// Type indicates the kind of problem found.
+	Type RuleExtensionType
+	// Detail describes the problem.
+	Detail string
+	// Cost is the estimated cost of the messageExpression, for
+	// RuleExtensionTypeMessageExpressionCost.
+	Cost uint64
+	// Limit is the cost limit exceeded, for
+	// RuleExtensionTypeMessageExpressionCost.
+	Limit uint64
+}
+
+func (r *RuleExtensionError) Error() string {
+	switch r.Type {
+	case RuleExtensionTypeMessageExpressionCompile:
+		return fmt.Sprintf("messageExpression %q is invalid: %s", r.Path.String(), r.Detail)
+	case RuleExtensionTypeMessageExpressionCost:
+		return fmt.Sprintf("messageExpression %q has cost of %d which exceeds cost limit of %d", r.Path.String(), r.Cost, r.Limit)
+	case RuleExtensionTypeReason:
+		return fmt.Sprintf("reason %q is invalid: %s", r.Path.String(), r.Detail)
+	case RuleExtensionTypeFieldPath:
+		return fmt.Sprintf("fieldPath %q is invalid: %s", r.Path.String(), r.Detail)
+	}
+	return ""
+}
+
+// CheckRuleExtensions takes a schema, the extensions of its rules as returned
+// by ExtractRuleExtensions, and cost limits, and returns an error for every
+// messageExpression that fails to compile to a string or exceeds the cost
+// limit, every reason that is not an allowed value, and every fieldPath that
+// does not resolve to a node beneath the node declaring the rule.
+func CheckRuleExtensions(schema *structuralschema.Structural, extensions RuleExtensions, limits CostLimits) []*RuleExtensionError {
+	root := field.NewPath("spec", "validation", "openAPIV3Schema")
+	return checkRuleExtensions(newRuleCompiler(schema, root), schema, extensions, root, limits)
+}
+
+func checkRuleExtensions(compiler *ruleCompiler, schema *structuralschema.Structural, extensions RuleExtensions, root *field.Path, limits CostLimits) []*RuleExtensionError {
+	var extensionErrors []*RuleExtensionError
+	walkFrom(schema, root, func(node *Node) bool {
+		for i, extension := range extensions[node.Path.String()] {
+			rulePath := node.Path.Child("x-kubernetes-validations").Index(i)
+			if extension.MessageExpression != "" {
+				result, envErr := compiler.compile(node.Schema, node.Path, node.IsResourceRoot, extension.MessageExpression, decls.String)
+				if envErr != nil {
+					extensionErrors = append(extensionErrors, &RuleExtensionError{
+						Path:   rulePath.Child("messageExpression"),
+						Type:   RuleExtensionTypeMessageExpressionCompile,
+						Detail: envErr.Error(),
+					})
+				} else if result.Error != nil {
+					extensionErrors = append(extensionErrors, &RuleExtensionError{
+						Path:   rulePath.Child("messageExpression"),
+						Type:   RuleExtensionTypeMessageExpressionCompile,
+						Detail: result.Error.Error(),
+					})
+				} else if cost := getExpressionCost(result, costInfo{MaxCardinality: node.MaxCardinality}); limits.PerExpression != 0 && cost > limits.PerExpression {
+					extensionErrors = append(extensionErrors, &RuleExtensionError{
+						Path:  rulePath.Child("messageExpression"),
+						Type:  RuleExtensionTypeMessageExpressionCost,
+						Cost:  cost,
+						Limit: limits.PerExpression,
+					})
+				}
+			}
+			if extension.Reason != "" && !allowedReasons[extension.Reason] {
+				extensionErrors = append(extensionErrors, &RuleExtensionError{
+					Path:   rulePath.Child("reason"),
+					Type:   RuleExtensionTypeReason,
+					Detail: fmt.Sprintf("%q is not one of FieldValueInvalid, FieldValueForbidden, FieldValueRequired, FieldValueDuplicate", extension.Reason),
+				})
+			}
+			if extension.FieldPath != "" {
+				if err := resolveFieldPath(node.Schema, extension.FieldPath, node.IsResourceRoot); err != nil {
+					extensionErrors = append(extensionErrors, &RuleExtensionError{
+						Path:   rulePath.Child("fieldPath"),
+						Type:   RuleExtensionTypeFieldPath,
+						Detail: err.Error(),
+					})
+				}
+			}
+		}
+		return true
+	})
+	return extensionErrors
+}
+
+// resolveFieldPath returns an error if fieldPath, a path relative to schema
+// such as .spec.replicas or ['a.b'].c, is malformed or does not resolve to a
+// node beneath schema. List items cannot be selected. Resource roots also
+// have apiVersion, kind and metadata, whether the schema declares them or not.
+func resolveFieldPath(schema *structuralschema.Structural, fieldPath string, isResourceRoot bool) error {
+	keys, err := parseFieldPath(fieldPath)
+	if err != nil {
+		return err
+	}
+	if isResourceRoot && (keys[0] == "apiVersion" || keys[0] == "kind" || keys[0] == "metadata") {
+		return nil
+	}
+	for i, key := range keys {
+		if prop, ok := schema.Properties[key]; ok {
+			schema = &prop
+			continue
+		}
+		switch {
+		case schema.AdditionalProperties != nil && schema.AdditionalProperties.Structural != nil:
+			schema = schema.AdditionalProperties.Structural
+		case schema.XPreserveUnknownFields || (schema.AdditionalProperties != nil && schema.AdditionalProperties.Bool):
+			// nothing is known about the fields beneath
+			return nil
+		case schema.Type == "array":
+			return fmt.Errorf("%s selects %q from a list, but list items cannot be selected", fieldPath, key)
+		default:
+			return fmt.Errorf("%s selects %q, which is not declared by the schema", fieldPath, strings.Join(keys[:i+1], "."))
+		}
+	}
+	return nil
+}
+
+// parseFieldPath splits fieldPath into the keys it selects. Keys are either
+// selected with a dot (.name) or with a quoted subscript (['name']).
+func parseFieldPath(fieldPath string) ([]string, error) {
+	var keys []string
+	rest := fieldPath
+	for len(rest) > 0 {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end == -1 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("%s has an empty field name", fieldPath)
+			}
+			keys = append(keys, rest[1:end+1])
+			rest = rest[end+1:]
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest[2:], "']")
+			if end == -1 {
+				return nil, fmt.Errorf("%s has an unterminated subscript", fieldPath)
+			}
+			keys = append(keys, rest[2:end+2])
+			rest = rest[end+4:]
+		case rest[0] == '[':
+			return nil, fmt.Errorf("%s has a subscript that is not a quoted string; list items cannot be selected", fieldPath)
+		default:
+			return nil, fmt.Errorf("%s must start with '.' or '['", fieldPath)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s selects no field", fieldPath)
+	}
+	return keys, nil
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"testing"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const ruleExtensionsCRD = `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+spec:
+  versions:
+  - name: v1
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            x-kubernetes-validations:
+            - rule: self.replicas >= 0
+              messageExpression: "'replicas is ' + string(self.replicas)"
+              reason: FieldValueInvalid
+              fieldPath: .replicas
+            properties:
+              replicas:
+                type: integer
+              labels:
+                type: object
+                additionalProperties:
+                  type: string
+                  x-kubernetes-validations:
+                  - rule: self != ''
+                    reason: FieldValueRequired
+`
+
+func TestExtractRuleExtensions(t *testing.T) {
+	extensions, err := ExtractRuleExtensions([]byte(ruleExtensionsCRD), 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	specPath := field.NewPath("spec", "validation", "openAPIV3Schema").Child("properties").Key("spec")
+	expected := RuleExtensions{
+		specPath.String(): {{MessageExpression: "'replicas is ' + string(self.replicas)", Reason: "FieldValueInvalid", FieldPath: ".replicas"}},
+		specPath.Child("properties").Key("labels").Child("additionalProperties").String(): {{Reason: "FieldValueRequired"}},
+	}
+	if len(extensions) != len(expected) {
+		t.Fatalf("Wrong extensions (expected %v, got %v)", expected, extensions)
+	}
+	for path, rules := range expected {
+		if len(extensions[path]) != len(rules) || extensions[path][0] != rules[0] {
+			t.Errorf("Wrong extensions at %s (expected %v, got %v)", path, rules, extensions[path])
+		}
+	}
+	if _, err := ExtractRuleExtensions([]byte(ruleExtensionsCRD), 1); err == nil {
+		t.Errorf("Expected an error for a missing version")
+	}
+}
+
+func TestRuleExtensions(t *testing.T) {
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	rulePath := rootPath.Child("x-kubernetes-validations").Index(0)
+	genSchema := func() *structuralschema.Structural {
+		schema := genRootSchema("name", genStringSchema(int64ptr(10)))
+		schema.Properties["labels"] = *genMapSchema(int64ptr(10), genStringSchema(int64ptr(10)))
+		schema.Properties["items"] = *genArraySchema(int64ptr(10), genStringSchema(int64ptr(10)))
+		return withRule(schema, "true")
+	}
+	tests := []struct {
+		name      string
+		extension RuleExtension
+		// schema overrides the schema returned by genSchema
+		schema         *structuralschema.Structural
+		expectedErrors []*RuleExtensionError
+	}{
+		{
+			name:           "valid",
+			extension:      RuleExtension{MessageExpression: "'name is ' + self.name", Reason: "FieldValueForbidden", FieldPath: ".name"},
+			expectedErrors: []*RuleExtensionError{},
+		},
+		{
+			name:      "messageExpressionNotString",
+			extension: RuleExtension{MessageExpression: "self.name.size()"},
+			expectedErrors: []*RuleExtensionError{
+				{Path: rulePath.Child("messageExpression"), Type: RuleExtensionTypeMessageExpressionCompile},
+			},
+		},
+		{
+			name:      "messageExpressionUndeclared",
+			extension: RuleExtension{MessageExpression: "self.nope"},
+			expectedErrors: []*RuleExtensionError{
+				{Path: rulePath.Child("messageExpression"), Type: RuleExtensionTypeMessageExpressionCompile},
+			},
+		},
+		{
+			name:      "messageExpressionCost",
+			extension: RuleExtension{MessageExpression: "self.items.map(x, self.items.map(y, x + y).join(',')).join(',')"},
+			schema:    withRule(genRootSchema("items", genArraySchema(nil, genStringSchema(nil))), "true"),
+			expectedErrors: []*RuleExtensionError{
+				{Path: rulePath.Child("messageExpression"), Type: RuleExtensionTypeMessageExpressionCost},
+			},
+		},
+		{
+			name:      "invalidReason",
+			extension: RuleExtension{Reason: "FieldValueNotSupported"},
+			expectedErrors: []*RuleExtensionError{
+				{Path: rulePath.Child("reason"), Type: RuleExtensionTypeReason},
+			},
+		},
+		{
+			name:           "mapKeyFieldPath",
+			extension:      RuleExtension{FieldPath: ".labels['app.kubernetes.io/name']"},
+			expectedErrors: []*RuleExtensionError{},
+		},
+		{
+			name:           "metadataFieldPath",
+			extension:      RuleExtension{FieldPath: ".metadata.name"},
+			expectedErrors: []*RuleExtensionError{},
+		},
+		{
+			name:      "undeclaredFieldPath",
+			extension: RuleExtension{FieldPath: ".nmae"},
+			expectedErrors: []*RuleExtensionError{
+				{Path: rulePath.Child("fieldPath"), Type: RuleExtensionTypeFieldPath},
+			},
+		},
+		{
+			name:      "listIndexFieldPath",
+			extension: RuleExtension{FieldPath: ".items[0]"},
+			expectedErrors: []*RuleExtensionError{
+				{Path: rulePath.Child("fieldPath"), Type: RuleExtensionTypeFieldPath},
+			},
+		},
+		{
+			name:      "malformedFieldPath",
+			extension: RuleExtension{FieldPath: "name"},
+			expectedErrors: []*RuleExtensionError{
+				{Path: rulePath.Child("fieldPath"), Type: RuleExtensionTypeFieldPath},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			extensions := RuleExtensions{rootPath.String(): {test.extension}}
+			schema := test.schema
+			if schema == nil {
+				schema = genSchema()
+			}
+			errors := CheckRuleExtensions(schema, extensions, DefaultCostLimits())
+			if len(errors) != len(test.expectedErrors) {
+				t.Fatalf("Wrong number of expected errors (got %v, expected %v)", errors, test.expectedErrors)
+			}
+			for i, seenError := range errors {
+				expectedError := test.expectedErrors[i]
+				if seenError.Path.String() != expectedError.Path.String() || seenError.Type != expectedError.Type {
+					t.Errorf("Wrong error (expected %v, got %v)", expectedError, seenError)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/parser"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/protobuf/proto"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	schemacel "k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// StringOpType represents the kind of string operation found by
+// CheckStringOps.
+type StringOpType int
+
+const (
+	// StringOpTypeNonConstantRegex represents a regex built from data, which
+	// is compiled on every evaluation.
+	StringOpTypeNonConstantRegex StringOpType = iota
+	// StringOpTypeInvalidRegex represents a literal regex that RE2 rejects.
+	StringOpTypeInvalidRegex
+	// StringOpTypeStringBuildingInLoop represents string concatenation,
+	// split or join inside a comprehension macro.
+	StringOpTypeStringBuildingInLoop
+)
+
+// regexFunctions lists the string methods taking a regex as their argument.
+var regexFunctions = map[string]bool{
+	"matches": true,
+	"find":    true,
+	"findAll": true,
+}
+
+// stringBuildingFunctions lists the functions that build new strings (or
+// lists of strings) from their arguments.
+var stringBuildingFunctions = map[string]bool{
+	"split": true,
+	"join":  true,
+}
+
+// stringFunctions lists the functions known to return strings, used to
+// recognize string concatenation without type-checking the rule.
+var stringFunctions = map[string]bool{
+	"string":     true,
+	"join":       true,
+	"replace":    true,
+	"substring":  true,
+	"lowerAscii": true,
+	"upperAscii": true,
+	"trim":       true,
+}
+
+// StringOpError represents a regex or string operation in a rule that is
+// invalid or disproportionately expensive.
+type StringOpError struct {
+	// Path represents the path to the rule.
+	Path *field.Path
+	// Type indicates the kind of operation found.
+	Type StringOpType
+	// Expr is the offending subexpression.
+	Expr string
+	// Position is the position of Expr in the rule, if known.
+	Position *Position
+	// RegexError is the error returned by RE2 for invalid regexes.
+	RegexError error
+	// Cost is the estimated cost the subexpression contributes to the rule,
+	// computed by recompiling the rule with the subexpression replaced by a
+	// literal. It is 0 if the contribution could not be estimated.
+	Cost uint64
+}
+
+func (s *StringOpError) Error() string {
+	var msg string
+	switch s.Type {
+	case StringOpTypeNonConstantRegex:
+		msg = fmt.Sprintf("rule %q uses a regex built from data in %q, which is compiled on every evaluation", s.Path.String(), s.Expr)
+	case StringOpTypeInvalidRegex:
+		return fmt.Sprintf("rule %q uses an invalid regex in %q: %s", s.Path.String(), s.Expr, s.RegexError)
+	case StringOpTypeStringBuildingInLoop:
+		msg = fmt.Sprintf("rule %q builds strings inside a comprehension in %q", s.Path.String(), s.Expr)
+	}
+	if s.Cost > 0 {
+		msg += fmt.Sprintf(" (estimated cost contribution: %d)", s.Cost)
+	}
+	return msg
+}
+
+// CheckStringOps takes a schema and returns an error for every non-literal
+// regex, invalid literal regex and string concatenation, split or join inside
+// a comprehension macro in its rules.
+func CheckStringOps(schema *structuralschema.Structural) []*StringOpError {
+	root := field.NewPath("spec", "validation", "openAPIV3Schema")
+	return checkStringOps(newRuleCompiler(schema, root), schema, root)
+}
+
+func checkStringOps(compiler *ruleCompiler, schema *structuralschema.Structural, root *field.Path) []*StringOpError {
+	var opErrors []*StringOpError
+	walkFrom(schema, root, func(node *Node) bool {
+		for i, rule := range node.Schema.Extensions.XValidations {
+			ast, err := parseRule(rule.Rule)
+			if err != nil {
+				// reported by CheckExprCost as a compilation error
+				continue
+			}
+			scope := map[string]schemaRef{
+				schemacel.ScopedVarName:    {Schema: node.Schema, Path: node.Path},
+				schemacel.OldScopedVarName: {Schema: node.Schema, Path: node.Path},
+			}
+			rulePath := node.Path.Child("x-kubernetes-validations").Index(i).Child("rule")
+			findStringOps(ast.Expr(), scope, false, func(e *expr.Expr, opType StringOpType, regexErr error) {
+				opError := &StringOpError{Path: rulePath, Type: opType, Expr: unparseExpr(e, ast), Position: exprPosition(ast, e), RegexError: regexErr}
+				if opType != StringOpTypeInvalidRegex {
+					opError.Cost = costContribution(compiler, node, rule.Rule, ast, e)
+				}
+				opErrors = append(opErrors, opError)
+			})
+		}
+		return true
+	})
+	return opErrors
+}
+
+// findStringOps walks e and calls report for every regex and string operation
+// worth reporting. inLoop is true inside the body of a comprehension macro.
+func findStringOps(e *expr.Expr, scope map[string]schemaRef, inLoop bool, report func(e *expr.Expr, opType StringOpType, regexErr error)) {
+	if e == nil {
+		return
+	}
+	call, ok := callExpr(e)
+	if !ok {
+		visitExpr(e, func(child *expr.Expr) bool {
+			if child == e {
+				return true
+			}
+			findStringOps(child, scope, inLoop, report)
+			return false
+		})
+		return
+	}
+
+	if comprehensionMacros[call.Function] && call.Target != nil && len(call.Args) >= 2 {
+		findStringOps(call.Target, scope, inLoop, report)
+		bodyScope := macroScope(call, scope)
+		for _, arg := range call.Args[1:] {
+			findStringOps(arg, bodyScope, true, report)
+		}
+		return
+	}
+
+	if pattern, ok := regexArg(call); ok {
+		if literal, ok := constString(pattern); !ok {
+			report(e, StringOpTypeNonConstantRegex, nil)
+		} else if _, err := regexp.Compile(literal); err != nil {
+			report(e, StringOpTypeInvalidRegex, err)
+		}
+	} else if inLoop && (stringBuildingFunctions[call.Function] || isStringConcat(e, scope)) {
+		report(e, StringOpTypeStringBuildingInLoop, nil)
+		// the operands of a reported operation are part of the same report
+		return
+	}
+	findStringOps(call.Target, scope, inLoop, report)
+	for _, arg := range call.Args {
+		findStringOps(arg, scope, inLoop, report)
+	}
+}
+
+// regexArg returns the regex argument of call if call is to a method taking
+// a regex.
+func regexArg(call *expr.Expr_Call) (*expr.Expr, bool) {
+	if !regexFunctions[call.Function] || call.Target == nil || len(call.Args) != 1 {
+		return nil, false
+	}
+	return call.Args[0], true
+}
+
+// isStringConcat returns true if e is an addition with an operand that is
+// known to be a string: a string literal, a reference to a string schema
+// node, or a call returning a string.
+func isStringConcat(e *expr.Expr, scope map[string]schemaRef) bool {
+	call, ok := callExpr(e)
+	if !ok || call.Function != operators.Add {
+		return false
+	}
+	for _, arg := range call.Args {
+		if _, ok := constString(arg); ok {
+			return true
+		}
+		if ref, ok := resolveSchemaRef(arg, scope); ok && len(ref.Rest) == 0 && ref.Schema.Type == "string" {
+			return true
+		}
+		if argCall, ok := callExpr(arg); ok && stringFunctions[argCall.Function] {
+			return true
+		}
+		if isStringConcat(arg, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// unparseExpr returns the source of e, a subexpression of ast.
+func unparseExpr(e *expr.Expr, ast *cel.Ast) string {
+	source, err := parser.Unparse(e, ast.SourceInfo())
+	if err != nil {
+		return ""
+	}
+	return source
+}
+
+// costContribution returns how much the estimated cost of rule decreases when
+// e, a subexpression of its ast, is replaced by a literal of the same type.
+// It returns 0 if either version of the rule cannot be compiled.
+func costContribution(compiler *ruleCompiler, node *Node, rule string, ast *cel.Ast, e *expr.Expr) uint64 {
+	rewritten := proto.Clone(ast.Expr()).(*expr.Expr)
+	visitExpr(rewritten, func(candidate *expr.Expr) bool {
+		if candidate.Id != e.Id {
+			return true
+		}
+		setLiteral(candidate, e)
+		return false
+	})
+	rewrittenRule, err := parser.Unparse(rewritten, ast.SourceInfo())
+	if err != nil {
+		return 0
+	}
+	before, ok := compiler.ruleCost(node, rule)
+	if !ok {
+		return 0
+	}
+	after, ok := compiler.ruleCost(node, rewrittenRule)
+	if !ok || after > before {
+		return 0
+	}
+	return before - after
+}
+
+// setLiteral replaces the contents of target with a literal of the same type
+// as the result of e.
+func setLiteral(target, e *expr.Expr) {
+	call, _ := callExpr(e)
+	switch {
+	case call != nil && call.Function == "matches":
+		target.ExprKind = &expr.Expr_ConstExpr{ConstExpr: &expr.Constant{ConstantKind: &expr.Constant_BoolValue{BoolValue: true}}}
+	case call != nil && (call.Function == "split" || call.Function == "findAll"):
+		target.ExprKind = &expr.Expr_ListExpr{ListExpr: &expr.Expr_CreateList{}}
+	default:
+		target.ExprKind = &expr.Expr_ConstExpr{ConstExpr: &expr.Constant{ConstantKind: &expr.Constant_StringValue{StringValue: ""}}}
+	}
+}
+
+// ruleCost compiles rule against node and returns its estimated cost, the
+// same way CheckExprCost does.
+func (c *ruleCompiler) ruleCost(node *Node, rule string) (uint64, bool) {
+	ruleSchema := *node.Schema
+	ruleSchema.Extensions.XValidations = apiextensionsv1.ValidationRules{{Rule: rule}}
+	results, err := c.compileRules(&ruleSchema, node.Path, node.IsResourceRoot)
+	if err != nil || len(results) != 1 || results[0].Error != nil {
+		return 0, false
+	}
+	return getExpressionCost(results[0], costInfo{MaxCardinality: node.MaxCardinality}), true
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"testing"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestStringOps(t *testing.T) {
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	rulePath := rootPath.Child("x-kubernetes-validations").Index(0).Child("rule")
+	listRulePath := rootPath.Child("properties").Key("values").Child("x-kubernetes-validations").Index(0).Child("rule")
+	tests := []struct {
+		name           string
+		schema         *structuralschema.Structural
+		expectedErrors []*StringOpError
+		// expectCost indicates whether the errors should carry a cost
+		// contribution
+		expectCost bool
+	}{
+		{
+			name:           "constantRegex",
+			schema:         withRule(genStringSchema(int64ptr(10)), `self.matches('^[a-z]+$')`),
+			expectedErrors: []*StringOpError{},
+		},
+		{
+			name:   "invalidRegex",
+			schema: withRule(genStringSchema(int64ptr(10)), `self.matches('^[a-z+$')`),
+			expectedErrors: []*StringOpError{
+				{Path: rulePath, Type: StringOpTypeInvalidRegex, Expr: `self.matches("^[a-z+$")`},
+			},
+		},
+		{
+			name: "nonConstantRegex",
+			schema: withRule(genRootSchema("value", genStringSchema(int64ptr(10))),
+				`self.value.matches('^' + self.value + '$')`),
+			expectedErrors: []*StringOpError{
+				{Path: rulePath, Type: StringOpTypeNonConstantRegex, Expr: `self.value.matches("^" + self.value + "$")`},
+			},
+			expectCost: true,
+		},
+		{
+			name:           "concatOutsideLoop",
+			schema:         withRule(genStringSchema(int64ptr(10)), `self + 'x' != 'ax'`),
+			expectedErrors: []*StringOpError{},
+		},
+		{
+			name:   "concatInLoop",
+			schema: genRootSchema("values", withRule(genArraySchema(int64ptr(10), genStringSchema(int64ptr(10))), `self.all(x, x + '.example.com' != 'a.example.com')`)),
+			expectedErrors: []*StringOpError{
+				{Path: listRulePath, Type: StringOpTypeStringBuildingInLoop, Expr: `x + ".example.com"`},
+			},
+			expectCost: true,
+		},
+		{
+			name:   "splitInLoop",
+			schema: genRootSchema("values", withRule(genArraySchema(int64ptr(10), genStringSchema(int64ptr(10))), `self.all(x, x.split('.').size() < 3)`)),
+			expectedErrors: []*StringOpError{
+				{Path: listRulePath, Type: StringOpTypeStringBuildingInLoop, Expr: `x.split(".")`},
+			},
+			// split is not priced by the cost estimator, so its
+			// contribution cannot be told apart from that of a list literal
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors := CheckStringOps(test.schema)
+			if len(errors) != len(test.expectedErrors) {
+				t.Fatalf("Wrong number of expected errors (got %v, expected %v)", errors, test.expectedErrors)
+			}
+			for i, seenError := range errors {
+				expectedError := test.expectedErrors[i]
+				if seenError.Path.String() != expectedError.Path.String() || seenError.Type != expectedError.Type || seenError.Expr != expectedError.Expr {
+					t.Errorf("Wrong error (expected %v, got %v)", expectedError, seenError)
+				}
+				if (seenError.Cost > 0) != test.expectCost {
+					t.Errorf("Wrong cost contribution %d for %v", seenError.Cost, seenError)
+				}
+			}
+		})
+	}
+}
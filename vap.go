@@ -0,0 +1,463 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types/ref"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	api "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	schemacel "k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel/library"
+	celmodel "k8s.io/apiextensions-apiserver/third_party/forked/celopenapi/model"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+)
+
+// ValidatingAdmissionPolicy is the subset of a ValidatingAdmissionPolicy
+// (admissionregistration.k8s.io v1alpha1, v1beta1 or v1) holding CEL
+// expressions and the information needed to type-check them. The
+// apiextensions-apiserver release celvet is built against predates these
+// types, so they are declared here.
+type ValidatingAdmissionPolicy struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		ParamKind *struct {
+			APIVersion string `json:"apiVersion"`
+			Kind       string `json:"kind"`
+		} `json:"paramKind,omitempty"`
+		MatchConstraints *struct {
+			ResourceRules []ResourceRule `json:"resourceRules"`
+		} `json:"matchConstraints,omitempty"`
+		Validations []struct {
+			Expression        string `json:"expression"`
+			MessageExpression string `json:"messageExpression,omitempty"`
+		} `json:"validations"`
+		AuditAnnotations []struct {
+			Key             string `json:"key"`
+			ValueExpression string `json:"valueExpression"`
+		} `json:"auditAnnotations"`
+		MatchConditions []MatchCondition `json:"matchConditions"`
+		Variables       []struct {
+			Name       string `json:"name"`
+			Expression string `json:"expression"`
+		} `json:"variables"`
+	} `json:"spec"`
+}
+
+// ResourceRule is the subset of an admission rule selecting the resources it
+// applies to.
+type ResourceRule struct {
+	APIGroups   []string `json:"apiGroups"`
+	APIVersions []string `json:"apiVersions"`
+	Resources   []string `json:"resources"`
+}
+
+// MatchCondition is a CEL expression deciding whether a request is sent to a
+// policy or webhook.
+type MatchCondition struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+// ParseValidatingAdmissionPolicy decodes a ValidatingAdmissionPolicy from
+// YAML or JSON.
+func ParseValidatingAdmissionPolicy(data []byte) (*ValidatingAdmissionPolicy, error) {
+	policy := &ValidatingAdmissionPolicy{}
+	if err := yaml.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+	gv, err := schema.ParseGroupVersion(policy.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+	if gv.Group != "admissionregistration.k8s.io" || policy.Kind != "ValidatingAdmissionPolicy" {
+		return nil, fmt.Errorf("expected admissionregistration.k8s.io ValidatingAdmissionPolicy, got %s %s", policy.APIVersion, policy.Kind)
+	}
+	return policy, nil
+}
+
+// CRDAdmissionSchemas returns the schemas of every version of crd, so that
+// policies matching its resources or using it as their paramKind can be
+// type-checked. Like the apiserver, they declare apiVersion and kind, and
+// type metadata as an ObjectMeta, whatever the CRD declares for them.
+func CRDAdmissionSchemas(crd *apiv1.CustomResourceDefinition) ([]AdmissionSchema, error) {
+	var schemas []AdmissionSchema
+	for _, version := range crd.Spec.Versions {
+		if version.Schema == nil || version.Schema.OpenAPIV3Schema == nil {
+			continue
+		}
+		props := &api.JSONSchemaProps{}
+		if err := apiv1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(version.Schema.OpenAPIV3Schema, props, nil); err != nil {
+			return nil, fmt.Errorf("version %s: %w", version.Name, err)
+		}
+		s, err := structuralschema.NewStructural(props)
+		if err != nil {
+			return nil, fmt.Errorf("version %s: %w", version.Name, err)
+		}
+		if s, err = withResourceFields(s); err != nil {
+			return nil, fmt.Errorf("version %s: %w", version.Name, err)
+		}
+		schemas = append(schemas, AdmissionSchema{
+			GroupVersionKind: schema.GroupVersionKind{Group: crd.Spec.Group, Version: version.Name, Kind: crd.Spec.Names.Kind},
+			Resource:         crd.Spec.Names.Plural,
+			Schema:           s,
+		})
+	}
+	return schemas, nil
+}
+
+// objectMetaSchema is the snapshot schema of the metadata of resources.
+const objectMetaSchema = "io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta"
+
+// withResourceFields returns a copy of s, the schema of a custom resource,
+// declaring the apiVersion, kind and metadata fields the apiserver adds to
+// the schemas of custom resources it serves, and thus to the types of
+// admission variables. s is returned as is if it is not an object.
+func withResourceFields(s *structuralschema.Structural) (*structuralschema.Structural, error) {
+	if s.Type != "object" {
+		return s, nil
+	}
+	objectMeta, err := builtinSchema(objectMetaSchema)
+	if err != nil {
+		return nil, err
+	}
+	copied := *s
+	copied.Properties = make(map[string]structuralschema.Structural, len(s.Properties)+3)
+	for name, propSchema := range s.Properties {
+		copied.Properties[name] = propSchema
+	}
+	copied.Properties["apiVersion"] = structuralschema.Structural{Generic: structuralschema.Generic{Type: "string"}}
+	copied.Properties["kind"] = structuralschema.Structural{Generic: structuralschema.Generic{Type: "string"}}
+	copied.Properties["metadata"] = *objectMeta
+	return &copied, nil
+}
+
+// AdmissionExpressionError reports the outcome of compiling an admission
+// expression: its estimated cost, and whether it failed to compile or its
+// cost may exceed the runtime per-expression limit.
+type AdmissionExpressionError struct {
+	// Path represents the path to the expression.
+	Path *field.Path
+	// CompileError is set if the expression failed to compile.
+	CompileError error
+	// Cost is the estimated cost of the expression.
+	Cost uint64
+	// Limit is the runtime cost limit of a single expression.
+	Limit uint64
+}
+
+func (a *AdmissionExpressionError) Error() string {
+	switch {
+	case a.CompileError != nil:
+		return fmt.Sprintf("expression %q failed to compile: %s", a.Path.String(), a.CompileError)
+	case a.Cost > a.Limit:
+		return fmt.Sprintf("expression %q has estimated cost of %d which may exceed the runtime cost limit of %d", a.Path.String(), a.Cost, a.Limit)
+	}
+	return fmt.Sprintf("expression %q has estimated cost of %d", a.Path.String(), a.Cost)
+}
+
+// Informational returns true if the expression compiles and its cost is
+// within the limit.
+func (a *AdmissionExpressionError) Informational() bool {
+	return a.CompileError == nil && a.Cost <= a.Limit
+}
+
+// admissionRequestSchema and namespaceSchema are the snapshot schemas of the
+// request and namespaceObject variables.
+const (
+	admissionRequestSchema = "io.k8s.api.admission.v1.AdmissionRequest"
+	namespaceSchema        = "io.k8s.api.core.v1.Namespace"
+)
+
+// CheckAdmissionPolicy compiles every expression of policy and returns its
+// estimated cost, or the reason it failed to compile. object and oldObject
+// are typed with the schema of the resource matched by the policy if its
+// resource rules match exactly one of the known schemas, params with the
+// schema of its paramKind, and request and namespaceObject with the built-in
+// schemas. Known schemas are those of schemas, typically custom resources the
+// policy applies to or takes as params, followed by the built-in resources of
+// the bundled OpenAPI snapshot. Anything else is dynamically typed, as are
+// variables. The authorizer variable is not supported.
+func CheckAdmissionPolicy(policy *ValidatingAdmissionPolicy, schemas []AdmissionSchema) ([]*AdmissionExpressionError, error) {
+	known, err := knownSchemas(schemas)
+	if err != nil {
+		return nil, err
+	}
+	var rules []ResourceRule
+	if policy.Spec.MatchConstraints != nil {
+		rules = policy.Spec.MatchConstraints.ResourceRules
+	}
+	env, err := newAdmissionEnv(matchedSchema(rules, known), paramSchema(policy, known), true)
+	if err != nil {
+		return nil, err
+	}
+
+	specPath := field.NewPath("spec")
+	var results []*AdmissionExpressionError
+	check := func(path *field.Path, source string, resultTypes ...*expr.Type) {
+		if source != "" {
+			results = append(results, compileAdmissionExpression(env, path, source, resultTypes...))
+		}
+	}
+	for i, variable := range policy.Spec.Variables {
+		check(specPath.Child("variables").Index(i).Child("expression"), variable.Expression)
+	}
+	for i, condition := range policy.Spec.MatchConditions {
+		check(specPath.Child("matchConditions").Index(i).Child("expression"), condition.Expression, decls.Bool)
+	}
+	for i, validation := range policy.Spec.Validations {
+		check(specPath.Child("validations").Index(i).Child("expression"), validation.Expression, decls.Bool)
+		check(specPath.Child("validations").Index(i).Child("messageExpression"), validation.MessageExpression, decls.String)
+	}
+	for i, annotation := range policy.Spec.AuditAnnotations {
+		check(specPath.Child("auditAnnotations").Index(i).Child("valueExpression"), annotation.ValueExpression, decls.String, decls.Null)
+	}
+	return results, nil
+}
+
+// compileAdmissionExpression compiles source, the admission expression at
+// path, in env.
+func compileAdmissionExpression(env *ruleEnv, path *field.Path, source string, resultTypes ...*expr.Type) *AdmissionExpressionError {
+	result := &AdmissionExpressionError{Path: path, Limit: schemacel.PerCallLimit}
+	compiled := env.compile(source, resultTypes...)
+	if compiled.Error != nil {
+		result.CompileError = compiled.Error
+	} else {
+		result.Cost = compiled.MaxCost
+	}
+	return result
+}
+
+// newAdmissionEnv returns the CEL environment of admission expressions, with
+// object and oldObject typed with the schema of object and request with the
+// built-in schema. Policy expressions additionally have params, typed with the
+// schema of params, namespaceObject and variables. object and params are
+// dynamically typed if nil.
+func newAdmissionEnv(object, params *AdmissionSchema, policy bool) (*ruleEnv, error) {
+	env, err := cel.NewEnv(cel.HomogeneousAggregateLiterals())
+	if err != nil {
+		return nil, err
+	}
+	roots := map[string]*celmodel.DeclType{}
+	var varDecls []*expr.Decl
+
+	// declareTyped declares the variables in names with the type of s, or as
+	// dyn if s is nil
+	declareTyped := func(typeName string, s *AdmissionSchema, names ...string) error {
+		if s == nil {
+			for _, name := range names {
+				varDecls = append(varDecls, decls.NewVar(name, decls.Dyn))
+			}
+			return nil
+		}
+		// the apiserver exposes all of the metadata of admitted objects, so
+		// they are not typed as resource roots, which would only expose
+		// metadata.name and metadata.generateName
+		declType := celmodel.SchemaDeclType(s.Schema, false)
+		if declType == nil {
+			for _, name := range names {
+				varDecls = append(varDecls, decls.NewVar(name, decls.Dyn))
+			}
+			return nil
+		}
+		root := withUnescapedFields(declType.MaybeAssignTypeName(typeName))
+		provider := &admissionTypeProvider{TypeProvider: env.TypeProvider(), types: celmodel.FieldTypeMap(typeName, root)}
+		env, err = env.Extend(cel.CustomTypeProvider(provider), cel.CustomTypeAdapter(env.TypeAdapter()))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			roots[name] = root
+			varDecls = append(varDecls, decls.NewVar(name, root.ExprType()))
+		}
+		return nil
+	}
+
+	if err := declareTyped("object", object, "object", "oldObject"); err != nil {
+		return nil, err
+	}
+	request, err := builtinSchema(admissionRequestSchema)
+	if err != nil {
+		return nil, err
+	}
+	if err := declareTyped("request", &AdmissionSchema{Schema: request}, "request"); err != nil {
+		return nil, err
+	}
+	if policy {
+		if err := declareTyped("params", params, "params"); err != nil {
+			return nil, err
+		}
+		namespace, err := builtinSchema(namespaceSchema)
+		if err != nil {
+			return nil, err
+		}
+		if err := declareTyped("namespaceObject", &AdmissionSchema{Schema: namespace}, "namespaceObject"); err != nil {
+			return nil, err
+		}
+		varDecls = append(varDecls, decls.NewVar("variables", decls.NewMapType(decls.String, decls.Dyn)))
+	}
+
+	opts := []cel.EnvOption{cel.Declarations(varDecls...), cel.HomogeneousAggregateLiterals()}
+	opts = append(opts, library.ExtensionLibs...)
+	env, err = env.Extend(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &ruleEnv{
+		env:            env,
+		estimator:      &library.CostEstimator{SizeEstimator: &sizeEstimator{roots: roots}},
+		maxCardinality: 1,
+	}, nil
+}
+
+// admissionTypeProvider resolves the types declared from the schema of an
+// admission variable, and the types of the environment it extends.
+type admissionTypeProvider struct {
+	ref.TypeProvider
+	// types are the types declared from the schema, by name
+	types map[string]*celmodel.DeclType
+}
+
+func (p *admissionTypeProvider) FindType(typeName string) (*expr.Type, bool) {
+	if declType, ok := p.types[typeName]; ok {
+		return declType.ExprType(), true
+	}
+	return p.TypeProvider.FindType(typeName)
+}
+
+func (p *admissionTypeProvider) FindFieldType(typeName, fieldName string) (*ref.FieldType, bool) {
+	declType, ok := p.types[typeName]
+	if !ok {
+		return p.TypeProvider.FindFieldType(typeName, fieldName)
+	}
+	if f, ok := declType.Fields[fieldName]; ok {
+		return &ref.FieldType{Type: f.Type.ExprType()}, true
+	}
+	if declType.IsMap() {
+		return &ref.FieldType{Type: declType.ElemType.ExprType()}, true
+	}
+	return nil, false
+}
+
+// withUnescapedFields returns a copy of t, and of the types beneath it, whose
+// escaped fields are accessible by their unescaped names too. The apiserver
+// declares the types of admission variables directly rather than from
+// schemas, so their fields are not escaped: object.metadata.namespace and
+// request.namespace, for instance, need not be written with __namespace__.
+// Types are copied without recursing, so they can be nested to any depth.
+func withUnescapedFields(t *celmodel.DeclType) *celmodel.DeclType {
+	// the types whose copies still refer to the original types beneath them
+	var pending []*celmodel.DeclType
+	copies := map[*celmodel.DeclType]*celmodel.DeclType{}
+	copyOf := func(t *celmodel.DeclType) *celmodel.DeclType {
+		if t == nil {
+			return nil
+		}
+		if copied, ok := copies[t]; ok {
+			return copied
+		}
+		copied := *t
+		copies[t] = &copied
+		pending = append(pending, t)
+		return &copied
+	}
+	root := copyOf(t)
+	for len(pending) > 0 {
+		t := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		copied := copies[t]
+		copied.ElemType = copyOf(t.ElemType)
+		copied.KeyType = copyOf(t.KeyType)
+		if t.Fields != nil {
+			copied.Fields = make(map[string]*celmodel.DeclField, len(t.Fields))
+			for name, f := range t.Fields {
+				copiedField := *f
+				copiedField.Type = copyOf(f.Type)
+				copied.Fields[name] = &copiedField
+				if unescaped, ok := celmodel.Unescape(name); ok && unescaped != name {
+					copied.Fields[unescaped] = &copiedField
+				}
+			}
+		}
+	}
+	return root
+}
+
+// knownSchemas returns schemas followed by the built-in schemas.
+func knownSchemas(schemas []AdmissionSchema) ([]AdmissionSchema, error) {
+	builtins, err := builtinSchemas()
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]AdmissionSchema{}, schemas...), builtins...), nil
+}
+
+// matchedSchema returns the schema of the only known resource matched by
+// rules, or nil if they match none or several.
+func matchedSchema(rules []ResourceRule, known []AdmissionSchema) *AdmissionSchema {
+	var matched *AdmissionSchema
+	for i := range known {
+		candidate := &known[i]
+		for _, rule := range rules {
+			if !matchesAny(rule.APIGroups, candidate.GroupVersionKind.Group) || !matchesAny(rule.APIVersions, candidate.GroupVersionKind.Version) || !matchesAny(rule.Resources, candidate.Resource) {
+				continue
+			}
+			if matched != nil && matched.GroupVersionKind != candidate.GroupVersionKind {
+				return nil
+			}
+			matched = candidate
+		}
+	}
+	return matched
+}
+
+// paramSchema returns the schema of the paramKind of policy, or nil if it has
+// none or it is not known.
+func paramSchema(policy *ValidatingAdmissionPolicy, known []AdmissionSchema) *AdmissionSchema {
+	if policy.Spec.ParamKind == nil {
+		return nil
+	}
+	gv, err := schema.ParseGroupVersion(policy.Spec.ParamKind.APIVersion)
+	if err != nil {
+		return nil
+	}
+	gvk := gv.WithKind(policy.Spec.ParamKind.Kind)
+	for i := range known {
+		if known[i].GroupVersionKind == gvk {
+			return &known[i]
+		}
+	}
+	return nil
+}
+
+// matchesAny returns true if values contains value or the "*" wildcard.
+func matchesAny(values []string, value string) bool {
+	for _, v := range values {
+		if v == "*" || v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"strings"
+	"testing"
+
+	apiv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const replicaLimitPolicy = `
+apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingAdmissionPolicy
+metadata:
+  name: replica-limit
+spec:
+  paramKind:
+    apiVersion: example.com/v1
+    kind: ReplicaLimit
+  matchConstraints:
+    resourceRules:
+    - apiGroups: ["apps"]
+      apiVersions: ["v1"]
+      operations: ["CREATE", "UPDATE"]
+      resources: ["deployments"]
+  variables:
+  - name: containers
+    expression: object.spec.template.spec.containers
+  matchConditions:
+  - name: not-kube-system
+    expression: request.namespace != 'kube-system'
+  validations:
+  - expression: object.spec.replicas <= params.maxReplicas
+    messageExpression: "'images must come from ' + params.registry"
+  - expression: object.spec.replicas <= params.maxReplica
+  - expression: object.spec.template.spec.containers.all(c, c.image.startsWith(params.registry))
+  - expression: "'not a bool'"
+  auditAnnotations:
+  - key: replicas
+    valueExpression: string(object.spec.replicas)
+`
+
+func replicaLimitSchemas() []AdmissionSchema {
+	crd := &apiv1.CustomResourceDefinition{
+		Spec: apiv1.CustomResourceDefinitionSpec{
+			Group: "example.com",
+			Names: apiv1.CustomResourceDefinitionNames{Plural: "replicalimits", Kind: "ReplicaLimit"},
+			Versions: []apiv1.CustomResourceDefinitionVersion{{
+				Name: "v1",
+				Schema: &apiv1.CustomResourceValidation{OpenAPIV3Schema: &apiv1.JSONSchemaProps{
+					Type: "object",
+					Properties: map[string]apiv1.JSONSchemaProps{
+						"maxReplicas": {Type: "integer"},
+						"registry":    {Type: "string", MaxLength: int64ptr(64)},
+					},
+				}},
+			}},
+		},
+	}
+	schemas, err := CRDAdmissionSchemas(crd)
+	if err != nil {
+		panic(err)
+	}
+	return schemas
+}
+
+func TestParseValidatingAdmissionPolicy(t *testing.T) {
+	policy, err := ParseValidatingAdmissionPolicy([]byte(replicaLimitPolicy))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if policy.Metadata.Name != "replica-limit" || policy.Spec.ParamKind.Kind != "ReplicaLimit" || len(policy.Spec.Validations) != 4 {
+		t.Errorf("Unexpected policy: %+v", policy)
+	}
+	if _, err := ParseValidatingAdmissionPolicy([]byte("apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\n")); err == nil {
+		t.Errorf("Expected error parsing a CustomResourceDefinition")
+	}
+}
+
+func TestCheckAdmissionPolicy(t *testing.T) {
+	policy, err := ParseValidatingAdmissionPolicy([]byte(replicaLimitPolicy))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	results, err := CheckAdmissionPolicy(policy, replicaLimitSchemas())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	specPath := field.NewPath("spec")
+	cases := []struct {
+		path          *field.Path
+		compileError  string
+		informational bool
+	}{
+		{
+			path:          specPath.Child("variables").Index(0).Child("expression"),
+			informational: true,
+		},
+		{
+			path:          specPath.Child("matchConditions").Index(0).Child("expression"),
+			informational: true,
+		},
+		{
+			path:          specPath.Child("validations").Index(0).Child("expression"),
+			informational: true,
+		},
+		{
+			path:          specPath.Child("validations").Index(0).Child("messageExpression"),
+			informational: true,
+		},
+		{
+			path:         specPath.Child("validations").Index(1).Child("expression"),
+			compileError: "undefined field 'maxReplica'",
+		},
+		{
+			// the number of containers and the length of their images are
+			// unbounded
+			path: specPath.Child("validations").Index(2).Child("expression"),
+		},
+		{
+			path:         specPath.Child("validations").Index(3).Child("expression"),
+			compileError: "must evaluate to a bool",
+		},
+		{
+			path:          specPath.Child("auditAnnotations").Index(0).Child("valueExpression"),
+			informational: true,
+		},
+	}
+	if len(results) != len(cases) {
+		for _, result := range results {
+			t.Logf("%s", result)
+		}
+		t.Fatalf("Expected %d results, got %d", len(cases), len(results))
+	}
+	for i, tt := range cases {
+		t.Run(tt.path.String(), func(t *testing.T) {
+			result := results[i]
+			if result.Path.String() != tt.path.String() {
+				t.Fatalf("Expected path %s, got %s", tt.path, result.Path)
+			}
+			if tt.compileError != "" {
+				if result.CompileError == nil || !strings.Contains(result.CompileError.Error(), tt.compileError) {
+					t.Errorf("Expected compile error containing %q, got %v", tt.compileError, result.CompileError)
+				}
+			} else if result.CompileError != nil {
+				t.Errorf("Unexpected compile error: %s", result.CompileError)
+			}
+			if result.Informational() != tt.informational {
+				t.Errorf("Expected informational %t, got %t: %s", tt.informational, result.Informational(), result)
+			}
+		})
+	}
+}
+
+func TestCheckAdmissionPolicyUntyped(t *testing.T) {
+	// without its paramKind schema, and matching several resources, params
+	// and object are dynamically typed
+	policy, err := ParseValidatingAdmissionPolicy([]byte(replicaLimitPolicy))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	policy.Spec.MatchConstraints.ResourceRules[0].Resources = []string{"*"}
+	results, err := CheckAdmissionPolicy(policy, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, result := range results {
+		if result.CompileError != nil && !strings.Contains(result.CompileError.Error(), "must evaluate to a bool") {
+			t.Errorf("Unexpected compile error: %s", result)
+		}
+	}
+}
+
+func TestCheckAdmissionPolicyMetadata(t *testing.T) {
+	policy, err := ParseValidatingAdmissionPolicy([]byte(replicaLimitPolicy))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// unlike in CRD rules, all of the metadata of admitted objects is
+	// accessible, and escaped fields by their unescaped names
+	policy.Spec.Validations = policy.Spec.Validations[:1]
+	for _, expression := range []string{
+		"object.metadata.namespace == request.namespace",
+		"object.metadata.labels['app'] == oldObject.metadata.labels['app']",
+		"namespaceObject.metadata.name == object.metadata.namespace",
+	} {
+		policy.Spec.Validations[0].Expression = expression
+		results, err := CheckAdmissionPolicy(policy, replicaLimitSchemas())
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for _, result := range results {
+			if result.CompileError != nil {
+				t.Errorf("Unexpected compile error for %q: %s", expression, result)
+			}
+		}
+	}
+}
+
+func TestCheckAdmissionPolicyCRDMetadata(t *testing.T) {
+	policy, err := ParseValidatingAdmissionPolicy([]byte(replicaLimitPolicy))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// the CRD declares metadata without its fields, which the apiserver
+	// replaces with ObjectMeta
+	crd := &apiv1.CustomResourceDefinition{
+		Spec: apiv1.CustomResourceDefinitionSpec{
+			Group: "example.com",
+			Names: apiv1.CustomResourceDefinitionNames{Plural: "widgets", Kind: "Widget"},
+			Versions: []apiv1.CustomResourceDefinitionVersion{{
+				Name: "v1",
+				Schema: &apiv1.CustomResourceValidation{OpenAPIV3Schema: &apiv1.JSONSchemaProps{
+					Type: "object",
+					Properties: map[string]apiv1.JSONSchemaProps{
+						"metadata": {Type: "object"},
+						"spec": {Type: "object", Properties: map[string]apiv1.JSONSchemaProps{
+							"replicas": {Type: "integer"},
+						}},
+					},
+				}},
+			}},
+		},
+	}
+	widgetSchemas, err := CRDAdmissionSchemas(crd)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	schemas := append(widgetSchemas, replicaLimitSchemas()...)
+	policy.Spec.MatchConstraints.ResourceRules = []ResourceRule{{APIGroups: []string{"example.com"}, APIVersions: []string{"v1"}, Resources: []string{"widgets"}}}
+	policy.Spec.Variables = nil
+	policy.Spec.AuditAnnotations = nil
+	policy.Spec.Validations = policy.Spec.Validations[:1]
+	for _, expression := range []string{
+		"object.metadata.name.startsWith('widget-')",
+		"object.metadata.labels['app'] == oldObject.metadata.labels['app']",
+		"object.apiVersion == 'example.com/v1' && object.kind == 'Widget'",
+		"params.metadata.namespace == object.metadata.namespace",
+		"object.spec.replicas <= params.maxReplicas",
+	} {
+		policy.Spec.Validations[0].Expression = expression
+		results, err := CheckAdmissionPolicy(policy, schemas)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for _, result := range results {
+			if result.CompileError != nil {
+				t.Errorf("Unexpected compile error for %q: %s", expression, result)
+			}
+		}
+	}
+	policy.Spec.Validations[0].Expression = "object.metadata.nope == 'x'"
+	results, err := CheckAdmissionPolicy(policy, schemas)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	validationPath := field.NewPath("spec", "validations").Index(0).Child("expression")
+	for _, result := range results {
+		if result.Path.String() == validationPath.String() && result.CompileError == nil {
+			t.Errorf("Expected a compile error for an undeclared metadata field, got %s", result)
+		}
+	}
+}
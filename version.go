@@ -0,0 +1,222 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/validation"
+)
+
+// KubeVersion is a Kubernetes minor release, such as 1.25.
+type KubeVersion struct {
+	Major int
+	Minor int
+}
+
+func (k KubeVersion) String() string {
+	return fmt.Sprintf("%d.%d", k.Major, k.Minor)
+}
+
+// Less returns true if k is an older release than other.
+func (k KubeVersion) Less(other KubeVersion) bool {
+	if k.Major != other.Major {
+		return k.Major < other.Major
+	}
+	return k.Minor < other.Minor
+}
+
+// DefaultKubeVersion is the release of the apiextensions-apiserver celvet is
+// built against, which is used to compile rules.
+var DefaultKubeVersion = KubeVersion{Major: 1, Minor: 24}
+
+// minKubeVersion is the first release supporting validation rules.
+var minKubeVersion = KubeVersion{Major: 1, Minor: 23}
+
+// maxModeledKubeVersion is the last release whose libraries are all declared
+// by the environments celvet compiles rules with. Rules of CRDs that only
+// target later releases may use libraries celvet cannot compile, which are
+// then reported as compile errors.
+var maxModeledKubeVersion = KubeVersion{Major: 1, Minor: 28}
+
+// ParseKubeVersion parses a release such as "1.25" or "v1.25". Patch
+// versions are accepted and ignored.
+func ParseKubeVersion(s string) (KubeVersion, error) {
+	parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(s), "v"), ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return KubeVersion{}, fmt.Errorf("invalid Kubernetes version %q: expected major.minor", s)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major < 0 {
+		return KubeVersion{}, fmt.Errorf("invalid Kubernetes version %q: bad major version", s)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil || minor < 0 {
+		return KubeVersion{}, fmt.Errorf("invalid Kubernetes version %q: bad minor version", s)
+	}
+	return KubeVersion{Major: major, Minor: minor}, nil
+}
+
+// VersionRange is a set of Kubernetes releases the CRD must work on. Min and
+// Max are inclusive; a nil bound leaves that end of the range open.
+type VersionRange struct {
+	Min *KubeVersion
+	Max *KubeVersion
+}
+
+// ParseVersionRange parses a single release ("1.25"), or a comma-separated
+// list of comparisons against releases (">=1.25", ">=1.25,<1.28").
+func ParseVersionRange(s string) (VersionRange, error) {
+	var r VersionRange
+	for _, constraint := range strings.Split(s, ",") {
+		constraint = strings.TrimSpace(constraint)
+		op := ""
+		for _, candidate := range []string{">=", "<=", ">", "<", "="} {
+			if strings.HasPrefix(constraint, candidate) {
+				op = candidate
+				break
+			}
+		}
+		v, err := ParseKubeVersion(strings.TrimPrefix(constraint, op))
+		if err != nil {
+			return VersionRange{}, err
+		}
+		switch op {
+		case ">=":
+			r.Min = &v
+		case ">":
+			next := KubeVersion{Major: v.Major, Minor: v.Minor + 1}
+			r.Min = &next
+		case "<=":
+			r.Max = &v
+		case "<":
+			if v.Minor == 0 {
+				return VersionRange{}, fmt.Errorf("invalid Kubernetes version range %q: no release before %s", s, v)
+			}
+			prev := KubeVersion{Major: v.Major, Minor: v.Minor - 1}
+			r.Max = &prev
+		default:
+			r.Min, r.Max = &v, &v
+		}
+	}
+	if r.Min != nil && r.Max != nil && r.Max.Less(*r.Min) {
+		return VersionRange{}, fmt.Errorf("invalid Kubernetes version range %q: empty range", s)
+	}
+	if err := r.Validate(); err != nil {
+		return VersionRange{}, err
+	}
+	return r, nil
+}
+
+// Validate returns an error if r includes releases that do not support
+// validation rules, i.e. releases before 1.23.
+func (r VersionRange) Validate() error {
+	if (r.Min != nil && r.Min.Less(minKubeVersion)) || (r.Max != nil && r.Max.Less(minKubeVersion)) {
+		return fmt.Errorf("unsupported Kubernetes version range %q: validation rules are only supported from %s on", r, minKubeVersion)
+	}
+	return nil
+}
+
+// Modeled returns false if the oldest release in r is later than the last
+// release whose CEL libraries celvet compiles rules with. Rules using
+// libraries added since are then reported as compile errors, while cost
+// limits are those of the newest release celvet knows of.
+func (r VersionRange) Modeled() bool {
+	return !maxModeledKubeVersion.Less(r.Oldest())
+}
+
+func (r VersionRange) String() string {
+	switch {
+	case r.Min != nil && r.Max != nil && *r.Min == *r.Max:
+		return r.Min.String()
+	case r.Min != nil && r.Max != nil:
+		return fmt.Sprintf(">=%s,<=%s", r.Min, r.Max)
+	case r.Min != nil:
+		return fmt.Sprintf(">=%s", r.Min)
+	case r.Max != nil:
+		return fmt.Sprintf("<=%s", r.Max)
+	}
+	return "any"
+}
+
+// Oldest returns the oldest release in the range, or the first release
+// supporting validation rules if the range has no lower bound.
+func (r VersionRange) Oldest() KubeVersion {
+	if r.Min == nil {
+		return minKubeVersion
+	}
+	return *r.Min
+}
+
+// Contains returns true if v is in the range.
+func (r VersionRange) Contains(v KubeVersion) bool {
+	return (r.Min == nil || !v.Less(*r.Min)) && (r.Max == nil || !r.Max.Less(v))
+}
+
+// CostLimits are the limits the apiserver enforces on the estimated cost of
+// rules.
+type CostLimits struct {
+	// PerExpression is the limit on the estimated cost of a single rule,
+	// including the cardinality of the schema node it is declared on. 0 means
+	// the estimated cost is not checked.
+	PerExpression uint64
+	// PerCRD is the limit on the total estimated cost of the rules of a CRD
+	// version schema. 0 means the total is not checked.
+	PerCRD uint64
+}
+
+// costLimitsByVersion lists the cost limits in effect from each release on,
+// oldest first. Releases before 1.24 only enforce the cost of rules at
+// runtime; the limits have not changed since.
+var costLimitsByVersion = []struct {
+	since  KubeVersion
+	limits CostLimits
+}{
+	{since: KubeVersion{Major: 1, Minor: 23}, limits: CostLimits{}},
+	{since: KubeVersion{Major: 1, Minor: 24}, limits: CostLimits{PerExpression: validation.StaticEstimatedCostLimit, PerCRD: validation.StaticEstimatedCRDCostLimit}},
+}
+
+// DefaultCostLimits returns the cost limits of DefaultKubeVersion.
+func DefaultCostLimits() CostLimits {
+	return CostLimitsFor(VersionRange{Min: &DefaultKubeVersion, Max: &DefaultKubeVersion})
+}
+
+// CostLimitsFor returns the most restrictive cost limits among the releases
+// in r.
+func CostLimitsFor(r VersionRange) CostLimits {
+	var limits CostLimits
+	for i, entry := range costLimitsByVersion {
+		// the entry applies until the next one, so it overlaps r if r
+		// contains any release in [since, next since)
+		if r.Max != nil && r.Max.Less(entry.since) {
+			continue
+		}
+		if i+1 < len(costLimitsByVersion) && r.Min != nil && !r.Min.Less(costLimitsByVersion[i+1].since) {
+			continue
+		}
+		limits.PerExpression = minLimit(limits.PerExpression, entry.limits.PerExpression)
+		limits.PerCRD = minLimit(limits.PerCRD, entry.limits.PerCRD)
+	}
+	return limits
+}
+
+// minLimit returns the most restrictive of two limits, where 0 is no limit.
+func minLimit(a, b uint64) uint64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"testing"
+
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/validation"
+)
+
+func TestVersionRange(t *testing.T) {
+	staticLimits := CostLimits{PerExpression: validation.StaticEstimatedCostLimit, PerCRD: validation.StaticEstimatedCRDCostLimit}
+	tests := []struct {
+		name           string
+		versionRange   string
+		expectedRange  string
+		expectedOldest string
+		expectedLimits CostLimits
+		unmodeled      bool
+		expectError    bool
+	}{
+		{
+			name:           "exact",
+			versionRange:   "1.25",
+			expectedRange:  "1.25",
+			expectedOldest: "1.25",
+			expectedLimits: staticLimits,
+		},
+		{
+			name:           "patchAndPrefix",
+			versionRange:   "v1.26.3",
+			expectedRange:  "1.26",
+			expectedOldest: "1.26",
+			expectedLimits: staticLimits,
+		},
+		{
+			name:           "atLeast",
+			versionRange:   ">=1.25",
+			expectedRange:  ">=1.25",
+			expectedOldest: "1.25",
+			expectedLimits: staticLimits,
+		},
+		{
+			name:           "bounded",
+			versionRange:   ">1.24, <1.28",
+			expectedRange:  ">=1.25,<=1.27",
+			expectedOldest: "1.25",
+			expectedLimits: staticLimits,
+		},
+		{
+			name:           "beforeStaticEstimation",
+			versionRange:   "1.23",
+			expectedRange:  "1.23",
+			expectedOldest: "1.23",
+			expectedLimits: CostLimits{},
+		},
+		{
+			name:           "spanningStaticEstimation",
+			versionRange:   "<=1.25",
+			expectedRange:  "<=1.25",
+			expectedOldest: "1.23",
+			expectedLimits: staticLimits,
+		},
+		{
+			name:           "spanningModeledReleases",
+			versionRange:   ">=1.28",
+			expectedRange:  ">=1.28",
+			expectedOldest: "1.28",
+			expectedLimits: staticLimits,
+		},
+		{
+			name:           "beyondModeledReleases",
+			versionRange:   ">=1.29",
+			expectedRange:  ">=1.29",
+			expectedOldest: "1.29",
+			expectedLimits: staticLimits,
+			unmodeled:      true,
+		},
+		{
+			name:           "exactBeyondModeledReleases",
+			versionRange:   "1.30",
+			expectedRange:  "1.30",
+			expectedOldest: "1.30",
+			expectedLimits: staticLimits,
+			unmodeled:      true,
+		},
+		{
+			name:         "beforeRules",
+			versionRange: "1.22",
+			expectError:  true,
+		},
+		{
+			name:         "spanningBeforeRules",
+			versionRange: ">=1.22",
+			expectError:  true,
+		},
+		{
+			name:         "endingBeforeRules",
+			versionRange: "<1.23",
+			expectError:  true,
+		},
+		{
+			name:         "empty",
+			versionRange: ">=1.26,<1.25",
+			expectError:  true,
+		},
+		{
+			name:         "invalid",
+			versionRange: "latest",
+			expectError:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := ParseVersionRange(test.versionRange)
+			if test.expectError {
+				if err == nil {
+					t.Fatalf("Expected an error, got range %s", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if r.String() != test.expectedRange {
+				t.Errorf("Wrong range (expected %s, got %s)", test.expectedRange, r)
+			}
+			if r.Oldest().String() != test.expectedOldest {
+				t.Errorf("Wrong oldest version (expected %s, got %s)", test.expectedOldest, r.Oldest())
+			}
+			if limits := CostLimitsFor(r); limits != test.expectedLimits {
+				t.Errorf("Wrong cost limits (expected %+v, got %+v)", test.expectedLimits, limits)
+			}
+			if r.Modeled() == test.unmodeled {
+				t.Errorf("Wrong modeled (expected %t, got %t)", !test.unmodeled, r.Modeled())
+			}
+		})
+	}
+}
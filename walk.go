@@ -0,0 +1,204 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+	"sort"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Node is a schema node visited by Walk.
+type Node struct {
+	Schema *structuralschema.Structural
+	// Path represents the path to the node, starting at
+	// spec.validation.openAPIV3Schema like the paths reported by checks.
+	Path *field.Path
+	// Depth is the number of nodes above this one, 0 for the root.
+	Depth int
+	// MaxCardinality is the maximum number of times the node can occur in a
+	// custom resource: the product of the maxItems and maxProperties of the
+	// lists and maps above it. It is nil if one of them is unbounded. This is
+	// the factor the apiserver multiplies the cost of the rules of the node
+	// by.
+	MaxCardinality *uint64
+	// IsResourceRoot is true for the root node and embedded resources, whose
+	// rules can access apiVersion, kind and metadata even if the schema does
+	// not declare them.
+	IsResourceRoot bool
+
+	parent *Node
+	// property is the name of the node if it is a property of its parent.
+	property *string
+}
+
+// Parent returns the node directly above n, or nil for the root.
+func (n *Node) Parent() *Node {
+	return n.parent
+}
+
+// Parents returns the nodes above n, the root first.
+func (n *Node) Parents() []*Node {
+	parents := make([]*Node, n.Depth)
+	for i, parent := n.Depth-1, n.parent; parent != nil; i, parent = i-1, parent.parent {
+		parents[i] = parent
+	}
+	return parents
+}
+
+// Visitor is called by Walk for every node. If it returns false, the nodes
+// beneath the node are skipped.
+type Visitor func(node *Node) bool
+
+// Walk calls visitor for schema and every node beneath it, parents before
+// children: the items of lists, then properties in name order, then the
+// additionalProperties of maps. Walk does not recurse, so it can walk schemas
+// of any depth.
+func Walk(schema *structuralschema.Structural, visitor Visitor) {
+	walkFrom(schema, field.NewPath("spec", "validation", "openAPIV3Schema"), visitor)
+}
+
+// walkFrom is like Walk, but the path of the root node is root, for checks
+// reporting paths into a schema found elsewhere.
+func walkFrom(schema *structuralschema.Structural, root *field.Path, visitor Visitor) {
+	// no limits, no error
+	_ = walk(schema, root, WalkLimits{}, visitor)
+}
+
+// WalkLimits bound the nodes visited by WalkWithLimits. Zero or negative
+// values mean no limit.
+type WalkLimits struct {
+	// MaxDepth is the depth of the deepest nodes visited.
+	MaxDepth int
+	// MaxNodes is the number of nodes visited.
+	MaxNodes int
+}
+
+// WalkLimitError is returned by WalkWithLimits for the first node beyond its
+// limits.
+type WalkLimitError struct {
+	// Path represents the path to the node.
+	Path *field.Path
+	// MaxDepth is set if the node is deeper than the depth limit.
+	MaxDepth int
+	// MaxNodes is set if the node is beyond the node limit.
+	MaxNodes int
+}
+
+func (w *WalkLimitError) Error() string {
+	if w.MaxDepth > 0 {
+		return fmt.Sprintf("schema node %q is nested more than %d levels deep", w.Path.String(), w.MaxDepth)
+	}
+	return fmt.Sprintf("schema has more than %d nodes (reached %q)", w.MaxNodes, w.Path.String())
+}
+
+// WalkWithLimits is like Walk, but stops at the first node that is deeper than
+// limits.MaxDepth or would be visited after limits.MaxNodes other nodes, and
+// returns a *WalkLimitError for it.
+func WalkWithLimits(schema *structuralschema.Structural, limits WalkLimits, visitor Visitor) error {
+	return walk(schema, field.NewPath("spec", "validation", "openAPIV3Schema"), limits, visitor)
+}
+
+func walk(schema *structuralschema.Structural, root *field.Path, limits WalkLimits, visitor Visitor) error {
+	if schema == nil {
+		return nil
+	}
+	stack := []*Node{{
+		Schema:         schema,
+		Path:           root,
+		MaxCardinality: rootCostInfo().MaxCardinality,
+		IsResourceRoot: true,
+	}}
+	visited := 0
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if limits.MaxDepth > 0 && node.Depth > limits.MaxDepth {
+			return &WalkLimitError{Path: node.Path, MaxDepth: limits.MaxDepth}
+		}
+		if limits.MaxNodes > 0 && visited == limits.MaxNodes {
+			return &WalkLimitError{Path: node.Path, MaxNodes: limits.MaxNodes}
+		}
+		visited++
+		if !visitor(node) {
+			continue
+		}
+		children := childNodes(node)
+		// pushed in reverse so that they are visited in order
+		for i := len(children) - 1; i >= 0; i-- {
+			stack = append(stack, children[i])
+		}
+	}
+	return nil
+}
+
+// childNodes returns the nodes directly beneath node, in the order Walk visits
+// them.
+func childNodes(node *Node) []*Node {
+	nodeCostInfo := costInfo{MaxCardinality: node.MaxCardinality}
+	childCostInfo := nodeCostInfo.MultiplyByElementCost(node.Schema)
+	var children []*Node
+	child := func(schema *structuralschema.Structural, path *field.Path, property *string) {
+		if schema == nil {
+			return
+		}
+		children = append(children, &Node{
+			Schema:         schema,
+			Path:           path,
+			Depth:          node.Depth + 1,
+			MaxCardinality: childCostInfo.MaxCardinality,
+			IsResourceRoot: schema.XEmbeddedResource,
+			parent:         node,
+			property:       property,
+		})
+	}
+
+	switch node.Schema.Type {
+	case "array":
+		child(node.Schema.Items, node.Path.Child("items"), nil)
+	case "object":
+		for _, name := range sortedKeys(node.Schema.Properties) {
+			name, propSchema := name, node.Schema.Properties[name]
+			child(&propSchema, node.Path.Child("properties").Key(name), &name)
+		}
+		if node.Schema.AdditionalProperties != nil {
+			child(node.Schema.AdditionalProperties.Structural, node.Path.Child("additionalProperties"), nil)
+		}
+	}
+	return children
+}
+
+// childNode returns the node directly beneath node at path, or nil if there
+// is none.
+func childNode(node *Node, path *field.Path) *Node {
+	for _, child := range childNodes(node) {
+		if child.Path.String() == path.String() {
+			return child
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in order. Checks iterate over properties
+// in this order so that they report findings in the same order on every run.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"testing"
+
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestWalk(t *testing.T) {
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	type visited struct {
+		path           *field.Path
+		parents        int
+		maxCardinality *uint64
+		isResourceRoot bool
+	}
+	tests := []struct {
+		name     string
+		schema   *structuralschema.Structural
+		skip     string
+		expected []visited
+	}{
+		{
+			name:   "bounded",
+			schema: genRootSchema("list", genArraySchema(int64ptr(10), genMapSchema(int64ptr(5), genStringSchema(nil)))),
+			expected: []visited{
+				{path: rootPath, maxCardinality: uint64ptr(1), isResourceRoot: true},
+				{path: rootPath.Child("properties").Key("list"), parents: 1, maxCardinality: uint64ptr(1)},
+				{path: rootPath.Child("properties").Key("list").Child("items"), parents: 2, maxCardinality: uint64ptr(10)},
+				{path: rootPath.Child("properties").Key("list").Child("items", "additionalProperties"), parents: 3, maxCardinality: uint64ptr(50)},
+			},
+		},
+		{
+			name:   "unbounded",
+			schema: genRootSchema("list", genArraySchema(nil, genArraySchema(int64ptr(10), genStringSchema(nil)))),
+			expected: []visited{
+				{path: rootPath, maxCardinality: uint64ptr(1), isResourceRoot: true},
+				{path: rootPath.Child("properties").Key("list"), parents: 1, maxCardinality: uint64ptr(1)},
+				{path: rootPath.Child("properties").Key("list").Child("items"), parents: 2},
+				{path: rootPath.Child("properties").Key("list").Child("items", "items"), parents: 3},
+			},
+		},
+		{
+			name: "sorted properties and embedded resources",
+			schema: &structuralschema.Structural{
+				Generic: structuralschema.Generic{Type: "object"},
+				Properties: map[string]structuralschema.Structural{
+					"b": *genStringSchema(nil),
+					"a": *genEmbeddedResourceSchema(),
+					"c": *genIntegerSchema(),
+				},
+			},
+			expected: []visited{
+				{path: rootPath, maxCardinality: uint64ptr(1), isResourceRoot: true},
+				{path: rootPath.Child("properties").Key("a"), parents: 1, maxCardinality: uint64ptr(1), isResourceRoot: true},
+				{path: rootPath.Child("properties").Key("b"), parents: 1, maxCardinality: uint64ptr(1)},
+				{path: rootPath.Child("properties").Key("c"), parents: 1, maxCardinality: uint64ptr(1)},
+			},
+		},
+		{
+			name:   "skipped children",
+			schema: genRootSchema("list", genArraySchema(int64ptr(10), genStringSchema(nil))),
+			skip:   rootPath.Child("properties").Key("list").String(),
+			expected: []visited{
+				{path: rootPath, maxCardinality: uint64ptr(1), isResourceRoot: true},
+				{path: rootPath.Child("properties").Key("list"), parents: 1, maxCardinality: uint64ptr(1)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var nodes []*Node
+			Walk(tt.schema, func(node *Node) bool {
+				nodes = append(nodes, node)
+				return node.Path.String() != tt.skip
+			})
+			if len(nodes) != len(tt.expected) {
+				t.Fatalf("Wrong number of nodes visited (got %d, expected %d)", len(nodes), len(tt.expected))
+			}
+			for i, node := range nodes {
+				expected := tt.expected[i]
+				if node.Path.String() != expected.path.String() || len(node.Parents()) != expected.parents || node.Depth != expected.parents || node.IsResourceRoot != expected.isResourceRoot {
+					t.Errorf("Wrong node (expected %+v, got %+v)", expected, node)
+				}
+				if (node.MaxCardinality == nil) != (expected.maxCardinality == nil) || (node.MaxCardinality != nil && *node.MaxCardinality != *expected.maxCardinality) {
+					t.Errorf("Wrong cardinality for %s (expected %v, got %v)", node.Path, expected.maxCardinality, node.MaxCardinality)
+				}
+				if parents := node.Parents(); len(parents) > 0 && parents[len(parents)-1] != node.Parent() {
+					t.Errorf("Parents of %s do not end with its parent", node.Path)
+				}
+				if i > 0 && node.Parent() != nodes[i-1] && node.Parent() != nodes[0] {
+					t.Errorf("Wrong parent for %s: %s", node.Path, node.Parent().Path)
+				}
+			}
+		})
+	}
+}
+
+// genDeepSchema returns a schema nesting depth lists of objects with a single
+// property, name, beneath the root.
+func genDeepSchema(depth int) *structuralschema.Structural {
+	schema := genStringSchema(int64ptr(10))
+	for i := 0; i < depth; i++ {
+		schema = genArraySchema(int64ptr(10), genRootSchema("name", schema))
+	}
+	return genRootSchema("list", schema)
+}
+
+func TestWalkWithLimits(t *testing.T) {
+	rootPath := field.NewPath("spec", "validation", "openAPIV3Schema")
+	listPath := rootPath.Child("properties").Key("list")
+	tests := []struct {
+		name          string
+		schema        *structuralschema.Structural
+		limits        WalkLimits
+		expectedNodes int
+		expectedError *WalkLimitError
+	}{
+		{
+			name:          "within limits",
+			schema:        genDeepSchema(2),
+			limits:        WalkLimits{MaxDepth: 5, MaxNodes: 6},
+			expectedNodes: 6,
+		},
+		{
+			name:          "no limits",
+			schema:        genDeepSchema(2),
+			limits:        WalkLimits{MaxDepth: -1},
+			expectedNodes: 6,
+		},
+		{
+			name:          "too deep",
+			schema:        genDeepSchema(2),
+			limits:        WalkLimits{MaxDepth: 2},
+			expectedNodes: 3,
+			expectedError: &WalkLimitError{Path: listPath.Child("items", "properties").Key("name"), MaxDepth: 2},
+		},
+		{
+			name: "too many nodes",
+			schema: &structuralschema.Structural{
+				Generic: structuralschema.Generic{Type: "object"},
+				Properties: map[string]structuralschema.Structural{
+					"a": *genStringSchema(nil),
+					"b": *genStringSchema(nil),
+					"c": *genStringSchema(nil),
+				},
+			},
+			limits:        WalkLimits{MaxNodes: 3},
+			expectedNodes: 3,
+			expectedError: &WalkLimitError{Path: rootPath.Child("properties").Key("c"), MaxNodes: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes := 0
+			err := WalkWithLimits(tt.schema, tt.limits, func(*Node) bool {
+				nodes++
+				return true
+			})
+			if nodes != tt.expectedNodes {
+				t.Errorf("Wrong number of nodes visited (got %d, expected %d)", nodes, tt.expectedNodes)
+			}
+			if tt.expectedError == nil {
+				if err != nil {
+					t.Errorf("Unexpected error: %s", err)
+				}
+				return
+			}
+			limitErr, ok := err.(*WalkLimitError)
+			if !ok {
+				t.Fatalf("Expected a WalkLimitError, got %v", err)
+			}
+			if limitErr.Path.String() != tt.expectedError.Path.String() || limitErr.MaxDepth != tt.expectedError.MaxDepth || limitErr.MaxNodes != tt.expectedError.MaxNodes {
+				t.Errorf("Wrong error (expected %v, got %v)", tt.expectedError, limitErr)
+			}
+		})
+	}
+}
+
+func TestWalkDeep(t *testing.T) {
+	// a walk copying the parents of every node would need over a hundred
+	// gigabytes
+	const depth = 100000
+	schema := genDeepSchema(depth)
+	deepest := 0
+	Walk(schema, func(node *Node) bool {
+		if node.Depth > deepest {
+			deepest = node.Depth
+		}
+		return true
+	})
+	if deepest != 2*depth+1 {
+		t.Errorf("Wrong depth (got %d, expected %d)", deepest, 2*depth+1)
+	}
+}
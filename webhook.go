@@ -0,0 +1,83 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/checker/decls"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+)
+
+// WebhookConfiguration is the subset of a ValidatingWebhookConfiguration or
+// MutatingWebhookConfiguration holding the matchConditions of its webhooks.
+type WebhookConfiguration struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Webhooks []struct {
+		Name            string           `json:"name"`
+		Rules           []ResourceRule   `json:"rules"`
+		MatchConditions []MatchCondition `json:"matchConditions"`
+	} `json:"webhooks"`
+}
+
+// ParseWebhookConfiguration decodes a ValidatingWebhookConfiguration or
+// MutatingWebhookConfiguration from YAML or JSON.
+func ParseWebhookConfiguration(data []byte) (*WebhookConfiguration, error) {
+	config := &WebhookConfiguration{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	gv, err := schema.ParseGroupVersion(config.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+	if gv.Group != "admissionregistration.k8s.io" || (config.Kind != "ValidatingWebhookConfiguration" && config.Kind != "MutatingWebhookConfiguration") {
+		return nil, fmt.Errorf("expected admissionregistration.k8s.io ValidatingWebhookConfiguration or MutatingWebhookConfiguration, got %s %s", config.APIVersion, config.Kind)
+	}
+	return config, nil
+}
+
+// CheckWebhookMatchConditions compiles the matchConditions of every webhook of
+// config and returns their estimated cost, or the reason they failed to
+// compile. Conditions are identified by the names of their webhook and of the
+// condition. object and oldObject are typed the same way as for
+// CheckAdmissionPolicy, using the rules of each webhook, and request with the
+// built-in schema. The authorizer variable is not supported.
+func CheckWebhookMatchConditions(config *WebhookConfiguration, schemas []AdmissionSchema) ([]*AdmissionExpressionError, error) {
+	known, err := knownSchemas(schemas)
+	if err != nil {
+		return nil, err
+	}
+	var results []*AdmissionExpressionError
+	for _, webhook := range config.Webhooks {
+		if len(webhook.MatchConditions) == 0 {
+			continue
+		}
+		env, err := newAdmissionEnv(matchedSchema(webhook.Rules, known), nil, false)
+		if err != nil {
+			return nil, err
+		}
+		conditionsPath := field.NewPath("webhooks").Key(webhook.Name).Child("matchConditions")
+		for _, condition := range webhook.MatchConditions {
+			results = append(results, compileAdmissionExpression(env, conditionsPath.Key(condition.Name).Child("expression"), condition.Expression, decls.Bool))
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const podWebhookConfiguration = `
+apiVersion: admissionregistration.k8s.io/v1
+kind: MutatingWebhookConfiguration
+metadata:
+  name: sidecar-injector
+webhooks:
+- name: pods.example.com
+  rules:
+  - apiGroups: [""]
+    apiVersions: ["v1"]
+    operations: ["CREATE"]
+    resources: ["pods"]
+  matchConditions:
+  - name: exclude-kube-system
+    expression: request.namespace != 'kube-system'
+  - name: not-host-network
+    expression: "!object.spec.hostNetwork && object.metadata.namespace != 'kube-system'"
+  - name: typo
+    expression: object.spec.hostNetwrk
+  - name: not-a-bool
+    expression: request.name
+- name: all.example.com
+  rules:
+  - apiGroups: ["*"]
+    apiVersions: ["*"]
+    operations: ["*"]
+    resources: ["*"]
+  matchConditions:
+  - name: labelled
+    expression: "'inject' in object.metadata.labels"
+  - name: params
+    expression: params.enabled
+`
+
+func TestParseWebhookConfiguration(t *testing.T) {
+	config, err := ParseWebhookConfiguration([]byte(podWebhookConfiguration))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if config.Kind != "MutatingWebhookConfiguration" || len(config.Webhooks) != 2 || len(config.Webhooks[0].MatchConditions) != 4 {
+		t.Errorf("Unexpected configuration: %+v", config)
+	}
+	if _, err := ParseWebhookConfiguration([]byte(replicaLimitPolicy)); err == nil {
+		t.Errorf("Expected error parsing a ValidatingAdmissionPolicy")
+	}
+}
+
+func TestCheckWebhookMatchConditions(t *testing.T) {
+	config, err := ParseWebhookConfiguration([]byte(podWebhookConfiguration))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	results, err := CheckWebhookMatchConditions(config, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	podPath := field.NewPath("webhooks").Key("pods.example.com").Child("matchConditions")
+	allPath := field.NewPath("webhooks").Key("all.example.com").Child("matchConditions")
+	cases := []struct {
+		path         *field.Path
+		compileError string
+	}{
+		{
+			path: podPath.Key("exclude-kube-system").Child("expression"),
+		},
+		{
+			path: podPath.Key("not-host-network").Child("expression"),
+		},
+		{
+			path:         podPath.Key("typo").Child("expression"),
+			compileError: "undefined field 'hostNetwrk'",
+		},
+		{
+			path:         podPath.Key("not-a-bool").Child("expression"),
+			compileError: "must evaluate to a bool",
+		},
+		{
+			// object is dynamically typed, since every resource is matched
+			path: allPath.Key("labelled").Child("expression"),
+		},
+		{
+			// params are only available to policies
+			path:         allPath.Key("params").Child("expression"),
+			compileError: "undeclared reference to 'params'",
+		},
+	}
+	if len(results) != len(cases) {
+		for _, result := range results {
+			t.Logf("%s", result)
+		}
+		t.Fatalf("Expected %d results, got %d", len(cases), len(results))
+	}
+	for i, tt := range cases {
+		t.Run(tt.path.String(), func(t *testing.T) {
+			result := results[i]
+			if result.Path.String() != tt.path.String() {
+				t.Fatalf("Expected path %s, got %s", tt.path, result.Path)
+			}
+			if tt.compileError != "" {
+				if result.CompileError == nil || !strings.Contains(result.CompileError.Error(), tt.compileError) {
+					t.Errorf("Expected compile error containing %q, got %v", tt.compileError, result.CompileError)
+				}
+			} else if result.CompileError != nil {
+				t.Errorf("Unexpected compile error: %s", result.CompileError)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"fmt"
+
+	apiv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+)
+
+// CompositeResourceDefinition is the subset of a Crossplane
+// CompositeResourceDefinition (apiextensions.crossplane.io) needed to build
+// the CRD Crossplane derives from it. Crossplane types are not dependencies of
+// celvet, so they are declared here.
+type CompositeResourceDefinition struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		Group    string                              `json:"group"`
+		Names    apiv1.CustomResourceDefinitionNames `json:"names"`
+		Versions []struct {
+			Name          string                          `json:"name"`
+			Served        bool                            `json:"served"`
+			Referenceable bool                            `json:"referenceable"`
+			Schema        *apiv1.CustomResourceValidation `json:"schema,omitempty"`
+		} `json:"versions"`
+	} `json:"spec"`
+}
+
+// isCompositeResourceDefinition returns true if data, which may be YAML or
+// JSON, is a Crossplane CompositeResourceDefinition.
+func isCompositeResourceDefinition(data []byte) bool {
+	var typeMeta metav1.TypeMeta
+	if err := yaml.Unmarshal(data, &typeMeta); err != nil {
+		return false
+	}
+	gv, err := schema.ParseGroupVersion(typeMeta.APIVersion)
+	return err == nil && gv.Group == "apiextensions.crossplane.io" && typeMeta.Kind == "CompositeResourceDefinition"
+}
+
+// ParseCompositeResourceDefinition decodes a Crossplane
+// CompositeResourceDefinition from YAML or JSON.
+func ParseCompositeResourceDefinition(data []byte) (*CompositeResourceDefinition, error) {
+	if !isCompositeResourceDefinition(data) {
+		return nil, fmt.Errorf("expected apiextensions.crossplane.io CompositeResourceDefinition")
+	}
+	xrd := &CompositeResourceDefinition{}
+	if err := yaml.Unmarshal(data, xrd); err != nil {
+		return nil, err
+	}
+	return xrd, nil
+}
+
+// CRD returns the CRD of the composite resources defined by x, whose versions
+// have the schemas of the versions of x. The storage version is the
+// referenceable version, as it is for the CRD Crossplane creates. The fields
+// Crossplane adds to the schemas, such as spec.compositionRef, are left out:
+// only the schemas the XRD declares are linted.
+func (x *CompositeResourceDefinition) CRD() *apiv1.CustomResourceDefinition {
+	crd := &apiv1.CustomResourceDefinition{
+		TypeMeta:   metav1.TypeMeta{APIVersion: apiv1.SchemeGroupVersion.String(), Kind: "CustomResourceDefinition"},
+		ObjectMeta: metav1.ObjectMeta{Name: x.Metadata.Name},
+		Spec: apiv1.CustomResourceDefinitionSpec{
+			Group: x.Spec.Group,
+			Names: x.Spec.Names,
+			Scope: apiv1.ClusterScoped,
+		},
+	}
+	for _, version := range x.Spec.Versions {
+		crd.Spec.Versions = append(crd.Spec.Versions, apiv1.CustomResourceDefinitionVersion{
+			Name:    version.Name,
+			Served:  version.Served,
+			Storage: version.Referenceable,
+			Schema:  version.Schema,
+		})
+	}
+	return crd
+}
+
+// decodeCompositeResourceDefinition decodes a Crossplane
+// CompositeResourceDefinition like decodeCRD, returning its CRD and the paths
+// of the schemas of its versions.
+func decodeCompositeResourceDefinition(data []byte) (*apiv1.CustomResourceDefinition, []*field.Path, error) {
+	xrd, err := ParseCompositeResourceDefinition(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while decoding: %w", err)
+	}
+	crd := xrd.CRD()
+	schemaPaths := make([]*field.Path, len(crd.Spec.Versions))
+	for i := range schemaPaths {
+		schemaPaths[i] = field.NewPath("spec", "versions").Index(i).Child("schema", "openAPIV3Schema")
+	}
+	return crd, schemaPaths, nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celvet
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const compositeResourceDefinition = `
+apiVersion: apiextensions.crossplane.io/v1
+kind: CompositeResourceDefinition
+metadata:
+  name: xdatabases.example.com
+spec:
+  group: example.com
+  names:
+    kind: XDatabase
+    plural: xdatabases
+  claimNames:
+    kind: Database
+    plural: databases
+  versions:
+  - name: v1alpha1
+    served: true
+    referenceable: false
+    schema:
+      openAPIV3Schema:
+        type: object
+  - name: v1
+    served: true
+    referenceable: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            x-kubernetes-validations:
+            - rule: self.nope
+              reason: Bogus
+`
+
+func TestCompositeResourceDefinitionCRD(t *testing.T) {
+	xrd, err := ParseCompositeResourceDefinition([]byte(compositeResourceDefinition))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	crd := xrd.CRD()
+	if crd.Name != "xdatabases.example.com" || crd.Spec.Group != "example.com" || crd.Spec.Names.Kind != "XDatabase" || len(crd.Spec.Versions) != 2 {
+		t.Fatalf("Wrong CRD: %+v", crd)
+	}
+	if crd.Spec.Versions[0].Storage || !crd.Spec.Versions[1].Storage || crd.Spec.Versions[1].Schema.OpenAPIV3Schema.Properties["spec"].XValidations[0].Rule != "self.nope" {
+		t.Errorf("Wrong versions: %+v", crd.Spec.Versions)
+	}
+	if _, err := ParseCompositeResourceDefinition([]byte(linterCRD)); err == nil {
+		t.Errorf("Expected an error for a CRD")
+	}
+}
+
+func TestLintCompositeResourceDefinition(t *testing.T) {
+	rulePath := field.NewPath("spec", "versions").Index(1).Child("schema", "openAPIV3Schema").Child("properties").Key("spec").Child("x-kubernetes-validations").Index(0)
+	expected := []Finding{
+		{CheckID: CheckIDRuleExtensions, Version: "v1", Path: rulePath.Child("reason")},
+		{CheckID: CheckIDCost, Version: "v1", Path: rulePath.Child("rule")},
+	}
+	findings, err := NewLinter(Options{}).LintManifest(context.Background(), []byte(compositeResourceDefinition))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(findings) != len(expected) {
+		t.Fatalf("Wrong findings (got %v, expected %v)", findings, expected)
+	}
+	for i, finding := range findings {
+		if finding.CheckID != expected[i].CheckID || finding.Version != expected[i].Version || finding.Path.String() != expected[i].Path.String() {
+			t.Errorf("Wrong finding (expected %+v, got %+v)", expected[i], finding)
+		}
+		if finding.CheckID == CheckIDRuleExtensions && !strings.Contains(finding.Message, expected[i].Path.String()) {
+			t.Errorf("Message does not quote %s: %s", expected[i].Path, finding.Message)
+		}
+	}
+}